@@ -3,67 +3,194 @@ package main
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 type Assembly struct {
-	blocks       []*Block
-	constants    map[int]bool
-	maxTemp      int
-	currentTemp  int
-	currentBlock int
+	options        Options
+	blocks         []*Block
+	statementUsage []StatementUsage
+	peepholeSaved  int
+	layoutSaved    int
+	sharingSaved   int
+	labels         map[string]bool
+	constants      map[int]string
+	instConstants  map[Instruction]string
+	bounds         *BoundsTrap
+	overflow       *OverflowTrap
+	runtime        map[string]*Routine
+	routineOrder   []string
+	currentBlock   int
 }
 
 type Block struct {
 	label string
+	kind  BlockKind
 	insts []Instruction
 }
 
+type BlockKind int
+
+const (
+	CodeBlock     BlockKind = iota
+	VariableBlock BlockKind = iota
+	ConstantBlock BlockKind = iota
+	TempBlock     BlockKind = iota
+	ArrayBlock    BlockKind = iota
+	LocalBlock    BlockKind = iota
+)
+
+type Options struct {
+	boundsCheck   bool
+	comments      bool
+	peephole      bool
+	layout        bool
+	share         bool
+	signed        bool
+	checkOverflow bool
+}
+
+// trapLabels are the labels of the blocks that failed runtime checks halt in,
+// which no other block is given so that the simulator can tell when a program
+// stopped in one.
+var trapLabels = []string{"bounds", "overflow"}
+
+type BoundsTrap struct {
+	label string
+	index string
+}
+
+// OverflowTrap is the block that failed overflow checks branch to with the
+// code of the check in the accumulator. The code is an index into sites,
+// starting from 1.
+type OverflowTrap struct {
+	label string
+	code  string
+	sites []Span
+}
+
 type Instruction struct {
 	opcode  string
 	operand string
+	comment string
+}
+
+// uniqueLabel returns base, with underscores appended until it no longer
+// clashes with a label that has already been handed out.
+func (asm *Assembly) uniqueLabel(base string) string {
+	label := base
+	for asm.labels[label] {
+		label += "_"
+	}
+	asm.labels[label] = true
+	return label
 }
 
 func (asm *Assembly) newBlock(label string) *Block {
-	block := &Block{label, []Instruction{}}
+	asm.labels[label] = true
+	block := &Block{label, CodeBlock, []Instruction{}}
 	asm.blocks = append(asm.blocks, block)
 	return block
 }
 
 func (asm *Assembly) newUniqueBlock() *Block {
-	block := asm.newBlock(fmt.Sprintf("b%d", asm.currentBlock))
+	block := asm.newBlock(asm.uniqueLabel(fmt.Sprintf("b%d", asm.currentBlock)))
 	asm.currentBlock++
 	return block
 }
 
-func (asm *Assembly) createVariable(label string, value int) {
+func (asm *Assembly) createVariable(label string, value int, kind BlockKind) {
 	block := asm.newBlock(label)
+	block.kind = kind
 	block.emitInstruction("DAT", fmt.Sprint(value))
 }
 
 func (asm *Assembly) getConstant(value int) string {
-	if _, contains := asm.constants[value]; !contains {
-		asm.createVariable(fmt.Sprintf("c%d", value), value)
-		asm.constants[value] = true
+	label, contains := asm.constants[value]
+	if !contains {
+		label = asm.uniqueLabel(fmt.Sprintf("c%d", value))
+		asm.createVariable(label, value, ConstantBlock)
+		asm.constants[value] = label
+	}
+	return label
+}
+
+func (asm *Assembly) createArray(label string, size, value int) {
+	block := asm.newBlock(label)
+	block.kind = ArrayBlock
+	for i := 0; i < size; i++ {
+		block.emitInstruction("DAT", fmt.Sprint(value))
 	}
-	return "c" + fmt.Sprint(value)
 }
 
-func (asm *Assembly) pushTemp() string {
-	label := "temp" + fmt.Sprint(asm.currentTemp)
-	if asm.currentTemp == asm.maxTemp {
-		asm.maxTemp++
-		asm.createVariable(label, 0)
+// getInstructionConstant returns a mailbox holding the machine word for an
+// instruction, which is used as data by code that patches itself.
+func (asm *Assembly) getInstructionConstant(opcode string, operand string) string {
+	inst := Instruction{opcode, operand, ""}
+	label, contains := asm.instConstants[inst]
+	if !contains {
+		label = asm.uniqueLabel(operand + "_" + strings.ToLower(opcode))
+		block := asm.newBlock(label)
+		block.kind = ConstantBlock
+		block.emitInstruction(opcode, operand)
+		asm.instConstants[inst] = label
 	}
-	asm.currentTemp++
 	return label
 }
 
-func (asm *Assembly) popTemp() {
-	asm.currentTemp--
+// boundsTrap returns the block that out of range array accesses branch to,
+// which outputs 999 followed by the offending index and halts.
+func (asm *Assembly) boundsTrap() *BoundsTrap {
+	if asm.bounds == nil {
+		asm.bounds = &BoundsTrap{"bounds", asm.uniqueLabel("bounds_index")}
+		block := asm.newBlock(asm.bounds.label)
+		block.emitInstruction("LDA", asm.getConstant(999))
+		block.emitInstruction("OUT", "")
+		block.emitInstruction("LDA", asm.bounds.index)
+		block.emitInstruction("OUT", "")
+		block.emitInstruction("HLT", "")
+		asm.createVariable(asm.bounds.index, 0, VariableBlock)
+	}
+	return asm.bounds
+}
+
+// overflowSite returns a new block that loads the code for an overflow check
+// of span and branches to the trap, which outputs 998 followed by the code
+// and halts.
+func (asm *Assembly) overflowSite(span Span) *Block {
+	if asm.overflow == nil {
+		asm.overflow = &OverflowTrap{"overflow", asm.uniqueLabel("overflow_code"), nil}
+		block := asm.newBlock(asm.overflow.label)
+		block.emitInstruction("STA", asm.overflow.code)
+		block.emitInstruction("LDA", asm.getConstant(998))
+		block.emitInstruction("OUT", "")
+		block.emitInstruction("LDA", asm.overflow.code)
+		block.emitInstruction("OUT", "")
+		block.emitInstruction("HLT", "")
+		asm.createVariable(asm.overflow.code, 0, VariableBlock)
+	}
+	asm.overflow.sites = append(asm.overflow.sites, span)
+	code := len(asm.overflow.sites)
+	block := asm.newUniqueBlock()
+	block.insts = append(block.insts, Instruction{"LDA", asm.getConstant(code), fmt.Sprintf("overflow %d at %s", code, span.pos)})
+	block.emitInstruction("BRA", asm.overflow.label)
+	return block
+}
+
+// writeOverflowReport lists the code of every overflow check along with the
+// expression it guards.
+func (asm *Assembly) writeOverflowReport(w io.Writer, source string) {
+	if asm.overflow == nil {
+		return
+	}
+	fmt.Fprintln(w, "overflow codes:")
+	for i, site := range asm.overflow.sites {
+		fmt.Fprintf(w, "  %3d  %-10s %s\n", i+1, site.pos, statementSummary(source, site.pos, site.length))
+	}
 }
 
 func (block *Block) emitInstruction(opcode string, operand string) {
-	block.insts = append(block.insts, Instruction{opcode, operand})
+	block.insts = append(block.insts, Instruction{opcode, operand, ""})
 }
 
 func (asm *Assembly) assemble(w io.Writer) {
@@ -75,12 +202,26 @@ func (asm *Assembly) assemble(w io.Writer) {
 func (block Block) assemble(w io.Writer) {
 	fmt.Fprintf(w, "%s", block.label)
 	for _, inst := range block.insts {
-		fmt.Fprintf(w, "\t%s %s\n", inst.opcode, inst.operand)
+		if inst.comment != "" {
+			fmt.Fprintf(w, "\t%s %s\t// %s\n", inst.opcode, inst.operand, inst.comment)
+		} else {
+			fmt.Fprintf(w, "\t%s %s\n", inst.opcode, inst.operand)
+		}
 	}
 }
 
 func InitAssembly() Assembly {
-	return Assembly{
-		constants: make(map[int]bool),
+	asm := Assembly{
+		instConstants: make(map[Instruction]string),
+		labels:        make(map[string]bool),
+		constants:     make(map[int]string),
+		runtime:       make(map[string]*Routine),
+	}
+	for opcode := range opcodes {
+		asm.labels[opcode] = true
+	}
+	for _, label := range trapLabels {
+		asm.labels[label] = true
 	}
+	return asm
 }
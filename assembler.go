@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const MailboxCount = 100
+
+var opcodes = map[string]int{
+	"HLT": 0,
+	"ADD": 100,
+	"SUB": 200,
+	"STA": 300,
+	"LDA": 500,
+	"BRA": 600,
+	"BRZ": 700,
+	"BRP": 800,
+	"INP": 901,
+	"OUT": 902,
+	"DAT": 0,
+}
+
+type Image struct {
+	memory [MailboxCount]int
+	size   int
+	labels map[string]int
+}
+
+// link lays the blocks out one after another from mailbox 0, resolves every
+// label to its address and encodes each instruction as a machine word.
+func (asm *Assembly) link() (Image, []error) {
+	image := Image{labels: make(map[string]int)}
+	errors := []error{}
+
+	address := 0
+	for _, block := range asm.blocks {
+		if block.label != "" {
+			if _, prs := image.labels[block.label]; prs {
+				errors = append(errors, fmt.Errorf("duplicate label '%s'", block.label))
+			} else {
+				image.labels[block.label] = address
+			}
+		}
+		address += len(block.insts)
+	}
+	image.size = address
+	if address > MailboxCount {
+		return image, append(errors, fmt.Errorf("program needs %d mailboxes but only %d are available", address, MailboxCount))
+	}
+
+	address = 0
+	for _, block := range asm.blocks {
+		for _, inst := range block.insts {
+			word, err := inst.encode(image.labels)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("%s in block '%s'", err, block.label))
+			}
+			image.memory[address] = word
+			address++
+		}
+	}
+	return image, errors
+}
+
+func (inst Instruction) encode(labels map[string]int) (int, error) {
+	base, prs := opcodes[inst.opcode]
+	if !prs {
+		return 0, fmt.Errorf("unknown instruction '%s'", inst.opcode)
+	}
+	operand := 0
+	if inst.operand != "" {
+		if value, err := strconv.Atoi(inst.operand); err == nil {
+			operand = value
+		} else if address, prs := labels[inst.operand]; prs {
+			operand = address
+		} else {
+			return 0, fmt.Errorf("unresolved label '%s'", inst.operand)
+		}
+	}
+	switch inst.opcode {
+	case "DAT":
+		if operand < 0 || operand > 999 {
+			return 0, fmt.Errorf("value %d out of range", operand)
+		}
+		return operand, nil
+	case "INP", "OUT", "HLT":
+		return base, nil
+	default:
+		if operand < 0 || operand >= MailboxCount {
+			return 0, fmt.Errorf("address %d out of range", operand)
+		}
+		return base + operand, nil
+	}
+}
+
+// parseAssembly reads mnemonic assembly, such as the text written by
+// Assembly.assemble, back into blocks. Each label starts a new block and
+// `//` comments are ignored.
+func parseAssembly(text string) (Assembly, error) {
+	asm := InitAssembly()
+	var block *Block
+	for i, line := range strings.Split(text, "\n") {
+		if index := strings.Index(line, "//"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, isOpcode := opcodes[fields[0]]; !isOpcode {
+			block = asm.newBlock(fields[0])
+			fields = fields[1:]
+		} else if block == nil {
+			block = asm.newBlock("")
+		}
+		if len(fields) == 0 {
+			return asm, fmt.Errorf("label '%s' has no instruction on line %d", block.label, i+1)
+		}
+		if _, isOpcode := opcodes[fields[0]]; !isOpcode {
+			return asm, fmt.Errorf("unknown instruction '%s' on line %d", fields[0], i+1)
+		}
+		if len(fields) > 2 {
+			return asm, fmt.Errorf("unexpected '%s' on line %d", fields[2], i+1)
+		}
+		operand := ""
+		if len(fields) > 1 {
+			operand = fields[1]
+		}
+		block.emitInstruction(fields[0], operand)
+	}
+	return asm, nil
+}
+
+func (image Image) writeNumbers(w io.Writer) {
+	for _, word := range image.memory {
+		fmt.Fprintln(w, word)
+	}
+}
+
+func (image Image) writeJSON(w io.Writer) error {
+	encoded, err := json.MarshalIndent(struct {
+		Size   int            `json:"size"`
+		Memory []int          `json:"memory"`
+		Labels map[string]int `json:"labels"`
+	}{image.size, image.memory[:], image.labels}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", encoded)
+	return err
+}
+
+func (image Image) writeDump(w io.Writer) {
+	for row := 0; row < MailboxCount; row += 10 {
+		fmt.Fprintf(w, "%02d:", row)
+		for _, word := range image.memory[row : row+10] {
+			fmt.Fprintf(w, " %03d", word)
+		}
+		fmt.Fprintln(w)
+	}
+}
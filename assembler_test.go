@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []int
+	}{
+		{
+			"every opcode",
+			"INP\nADD one\nSUB one\nSTA x\nLDA x\nBRA end\nBRZ end\nBRP end\nOUT\nend HLT\none DAT 1\nx DAT\n",
+			[]int{901, 110, 210, 311, 511, 609, 709, 809, 902, 0, 1, 0},
+		},
+		{
+			"numeric operands and comments",
+			"LDA 3 // load\nOUT\nHLT\nDAT 999\n",
+			[]int{503, 902, 0, 999},
+		},
+		{
+			"label on its own block",
+			"loop LDA n\n     SUB one\n     STA n\n     BRP loop\n     HLT\nn    DAT 3\none  DAT 1\n",
+			[]int{505, 206, 305, 800, 0, 3, 1},
+		},
+	}
+	for _, test := range tests {
+		memory, err := assembleText(test.text)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		want := [MailboxCount]int{}
+		copy(want[:], test.want)
+		if memory != want {
+			t.Errorf("%s: got %v, want %v", test.name, memory[:len(test.want)], test.want)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		err  string
+	}{
+		{"unknown instruction", "x FOO 1\n", "unknown instruction 'FOO'"},
+		{"label without an instruction", "x\n", "label 'x' has no instruction"},
+		{"extra operand", "LDA x y\n", "unexpected 'y'"},
+		{"unresolved label", "LDA x\n", "unresolved label 'x'"},
+		{"duplicate label", "x HLT\nx HLT\n", "duplicate label 'x'"},
+		{"value out of range", "DAT 1000\n", "value 1000 out of range"},
+		{"address out of range", "LDA 100\n", "address 100 out of range"},
+		{"too many mailboxes", strings.Repeat("HLT\n", MailboxCount+1), "needs 101 mailboxes"},
+	}
+	for _, test := range tests {
+		_, err := assembleText(test.text)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestImageFormats(t *testing.T) {
+	asm, err := parseAssembly("start LDA x\nOUT\nHLT\nx DAT 42\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, errors := asm.link()
+	if len(errors) > 0 {
+		t.Fatal(errors[0])
+	}
+	if image.size != 4 {
+		t.Errorf("got size %d, want 4", image.size)
+	}
+	if want := map[string]int{"start": 0, "x": 3}; !reflect.DeepEqual(image.labels, want) {
+		t.Errorf("got labels %v, want %v", image.labels, want)
+	}
+
+	numbers := strings.Builder{}
+	image.writeNumbers(&numbers)
+	lines := strings.Split(numbers.String(), "\n")
+	if len(lines) != MailboxCount+1 || strings.Join(lines[:5], ",") != "503,902,0,42,0" {
+		t.Errorf("numbers: got %q", numbers.String())
+	}
+
+	dump := strings.Builder{}
+	image.writeDump(&dump)
+	if !strings.HasPrefix(dump.String(), "00: 503 902 000 042 000") {
+		t.Errorf("dump: got %q", dump.String())
+	}
+
+	encoded := strings.Builder{}
+	if err := image.writeJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded.String(), `"x": 3`) {
+		t.Errorf("json: got %q", encoded.String())
+	}
+}
+
+func TestAssembleCompiled(t *testing.T) {
+	statements, diagnostics := Parse("a := in\nb := in\nout a - b\nout a + b\n")
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+	asm, errors := Compile(Fold(statements, false), Options{peephole: true, layout: true, share: true})
+	if len(errors) > 0 {
+		t.Fatal(errors[0])
+	}
+	image, errors := asm.link()
+	if len(errors) > 0 {
+		t.Fatal(errors[0])
+	}
+	builder := strings.Builder{}
+	asm.assemble(&builder)
+	memory, err := assembleText(builder.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory != image.memory {
+		t.Error("assembly text assembles differently to the program it was written from")
+	}
+	machine := InitMachine(memory, []int{3, 5})
+	if err := machine.run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{998, 8}; !reflect.DeepEqual(machine.output, want) {
+		t.Errorf("got %v, want %v", machine.output, want)
+	}
+}
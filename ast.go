@@ -9,8 +9,8 @@ type Expr struct {
 }
 
 type ExprNode interface {
-	compileValue(*Assembly, **Block, *Scope, Position) (Value, error)
-	compileCondition(*Assembly, **Block, *Block, *Block, *Scope, Position) error
+	compileValue(*IRProgram, **IRBlock, *Scope, Span) (Operand, error)
+	compileCondition(*IRProgram, **IRBlock, *IRBlock, *IRBlock, *Scope, Span) error
 	prettyPrint(*strings.Builder)
 }
 
@@ -28,6 +28,11 @@ type Ident struct {
 	name string
 }
 
+type Index struct {
+	name  string
+	index Expr
+}
+
 type Binary struct {
 	symbol      string
 	left, right Expr
@@ -39,24 +44,37 @@ type Unary struct {
 }
 
 type Statement struct {
-	pos    Position
-	length int
-	node   StatementNode
+	pos      Position
+	length   int
+	node     StatementNode
+	comments []Comment
 }
 
 type StatementNode interface {
-	compile(*Assembly, **Block, *Scope, Position, []error) []error
+	compile(*IRProgram, **IRBlock, *Scope, Span, []error) []error
 	prettyPrint(*strings.Builder, string)
 }
 
-func (statement Statement) compile(asm *Assembly, block **Block, scope *Scope, errors []error) []error {
-	return statement.node.compile(asm, block, scope, statement.pos, errors)
+// compile compiles the statement, copying its comments onto the first
+// instruction it adds to the current block.
+func (statement Statement) compile(ir *IRProgram, block **IRBlock, scope *Scope, errors []error) []error {
+	start, count := *block, len((*block).insts)
+	errors = statement.node.compile(ir, block, scope, statement.span(), errors)
+	if len(statement.comments) > 0 && len(start.insts) > count {
+		texts := []string{}
+		for _, comment := range statement.comments {
+			texts = append(texts, comment.text)
+		}
+		start.insts[count].comment = strings.Join(texts, "; ")
+	}
+	return errors
 }
 
 type Declare struct {
 	name string
 	expr Expr
 	ty   Type
+	size int
 }
 
 type Assign struct {
@@ -64,6 +82,12 @@ type Assign struct {
 	expr Expr
 }
 
+type AssignIndex struct {
+	name  string
+	index Expr
+	expr  Expr
+}
+
 type BlockScope struct {
 	statements []Statement
 }
@@ -82,3 +106,31 @@ type While struct {
 type Output struct {
 	expr Expr
 }
+
+type Param struct {
+	name string
+	ty   Type
+	pos  Position
+}
+
+// Function is a function declaration, with pos giving where its name is.
+type Function struct {
+	name   string
+	params []Param
+	ret    Type
+	body   Statement
+	pos    Position
+}
+
+type Call struct {
+	name string
+	args []Expr
+}
+
+type CallStatement struct {
+	call Expr
+}
+
+type Return struct {
+	expr Expr
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CFG is the control-flow graph of a function in the IR. Blocks are referred
+// to by their index in the function, and only blocks reachable from the entry
+// have a dominator.
+type CFG struct {
+	function *IRFunction
+	index    map[string]int
+	succs    [][]int
+	preds    [][]int
+	order    []int
+	idom     []int
+	loops    []*Loop
+}
+
+// Loop is a natural loop, made of the header and every block that can reach
+// one of the latches without passing through the header. The latches are the
+// blocks with a back edge to the header, which dominates all of them.
+type Loop struct {
+	header  int
+	latches []int
+	body    map[int]bool
+}
+
+func BuildCFG(function *IRFunction) *CFG {
+	count := len(function.blocks)
+	cfg := &CFG{
+		function: function,
+		index:    make(map[string]int),
+		succs:    make([][]int, count),
+		preds:    make([][]int, count),
+	}
+	for i, block := range function.blocks {
+		cfg.index[block.label] = i
+	}
+	for i, block := range function.blocks {
+		for _, inst := range block.insts {
+			for _, target := range inst.targets {
+				if j, prs := cfg.index[target]; prs {
+					cfg.addEdge(i, j)
+				}
+			}
+		}
+	}
+	cfg.findOrder()
+	cfg.findDominators()
+	cfg.findLoops()
+	return cfg
+}
+
+func (cfg *CFG) addEdge(from, to int) {
+	for _, succ := range cfg.succs[from] {
+		if succ == to {
+			return
+		}
+	}
+	cfg.succs[from] = append(cfg.succs[from], to)
+	cfg.preds[to] = append(cfg.preds[to], from)
+}
+
+// findOrder lists the blocks reachable from the entry in reverse postorder,
+// where a block comes before its successors except along back edges.
+func (cfg *CFG) findOrder() {
+	if len(cfg.function.blocks) == 0 {
+		return
+	}
+	visited := make([]bool, len(cfg.function.blocks))
+	postorder := []int{}
+	var visit func(int)
+	visit = func(block int) {
+		visited[block] = true
+		for _, succ := range cfg.succs[block] {
+			if !visited[succ] {
+				visit(succ)
+			}
+		}
+		postorder = append(postorder, block)
+	}
+	visit(0)
+	for i := len(postorder) - 1; i >= 0; i-- {
+		cfg.order = append(cfg.order, postorder[i])
+	}
+}
+
+// findDominators works out the immediate dominator of each block with the
+// iterative algorithm of Cooper, Harvey and Kennedy. The entry is its own
+// immediate dominator and unreachable blocks have none, which is -1.
+func (cfg *CFG) findDominators() {
+	cfg.idom = make([]int, len(cfg.function.blocks))
+	for i := range cfg.idom {
+		cfg.idom[i] = -1
+	}
+	if len(cfg.order) == 0 {
+		return
+	}
+	rank := make([]int, len(cfg.function.blocks))
+	for i, block := range cfg.order {
+		rank[block] = i
+	}
+	intersect := func(a, b int) int {
+		for a != b {
+			for rank[a] > rank[b] {
+				a = cfg.idom[a]
+			}
+			for rank[b] > rank[a] {
+				b = cfg.idom[b]
+			}
+		}
+		return a
+	}
+
+	cfg.idom[cfg.order[0]] = cfg.order[0]
+	for changed := true; changed; {
+		changed = false
+		for _, block := range cfg.order[1:] {
+			idom := -1
+			for _, pred := range cfg.preds[block] {
+				if cfg.idom[pred] == -1 {
+					continue
+				}
+				if idom == -1 {
+					idom = pred
+				} else {
+					idom = intersect(pred, idom)
+				}
+			}
+			if cfg.idom[block] != idom {
+				cfg.idom[block] = idom
+				changed = true
+			}
+		}
+	}
+}
+
+// dominates reports whether every path from the entry to b passes through a.
+func (cfg *CFG) dominates(a, b int) bool {
+	if cfg.idom[b] == -1 {
+		return false
+	}
+	for b != a {
+		if cfg.idom[b] == b {
+			return false
+		}
+		b = cfg.idom[b]
+	}
+	return true
+}
+
+// findLoops finds the back edges, which go to a block that dominates where
+// they come from, and collects the natural loop of each header.
+func (cfg *CFG) findLoops() {
+	loops := make(map[int]*Loop)
+	for _, block := range cfg.order {
+		for _, succ := range cfg.succs[block] {
+			if !cfg.dominates(succ, block) {
+				continue
+			}
+			loop, prs := loops[succ]
+			if !prs {
+				loop = &Loop{succ, nil, map[int]bool{succ: true}}
+				loops[succ] = loop
+				cfg.loops = append(cfg.loops, loop)
+			}
+			loop.latches = append(loop.latches, block)
+			worklist := []int{block}
+			for len(worklist) > 0 {
+				current := worklist[len(worklist)-1]
+				worklist = worklist[:len(worklist)-1]
+				if loop.body[current] {
+					continue
+				}
+				loop.body[current] = true
+				worklist = append(worklist, cfg.preds[current]...)
+			}
+		}
+	}
+}
+
+func (cfg *CFG) isBackEdge(from, to int) bool {
+	for _, loop := range cfg.loops {
+		if loop.header != to {
+			continue
+		}
+		for _, latch := range loop.latches {
+			if latch == from {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cfg *CFG) isHeader(block int) bool {
+	for _, loop := range cfg.loops {
+		if loop.header == block {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDot writes the control-flow graph of every function in Graphviz's DOT
+// language, with a cluster for each function. The edges out of a conditional
+// branch are labelled, back edges are dashed and loop headers have a double
+// border.
+func (ir *IRProgram) writeDot(w io.Writer) {
+	fmt.Fprintln(w, "digraph cfg {")
+	fmt.Fprintln(w, "\tnode [shape=box fontname=monospace]")
+	for i, function := range ir.functions {
+		cfg := BuildCFG(function)
+		name := "program"
+		if function.sig != nil {
+			name = function.sig.entry
+		}
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "\t\tlabel=%q\n", name)
+		for j, block := range function.blocks {
+			lines := []string{block.label + ":"}
+			for _, inst := range block.insts {
+				lines = append(lines, "  "+inst.String())
+			}
+			attrs := ""
+			if cfg.isHeader(j) {
+				attrs = " peripheries=2"
+			}
+			fmt.Fprintf(w, "\t\t%q [label=\"%s\\l\"%s]\n", block.label, strings.Join(lines, "\\l"), attrs)
+		}
+		for j, block := range function.blocks {
+			var last IRInst
+			if len(block.insts) > 0 {
+				last = block.insts[len(block.insts)-1]
+			}
+			for _, succ := range cfg.succs[j] {
+				attrs := []string{}
+				target := function.blocks[succ].label
+				if len(last.targets) == 2 && last.targets[0] != last.targets[1] {
+					if target == last.targets[0] {
+						attrs = append(attrs, "label=true")
+					} else if target == last.targets[1] {
+						attrs = append(attrs, "label=false")
+					}
+				}
+				if cfg.isBackEdge(j, succ) {
+					attrs = append(attrs, "style=dashed")
+				}
+				fmt.Fprintf(w, "\t\t%q -> %q", block.label, target)
+				if len(attrs) > 0 {
+					fmt.Fprintf(w, " [%s]", strings.Join(attrs, " "))
+				}
+				fmt.Fprintln(w)
+			}
+		}
+		fmt.Fprintln(w, "\t}")
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// graphFunction makes a function with a block for each list of successors,
+// labelled by its index.
+func graphFunction(succs [][]int) *IRFunction {
+	function := &IRFunction{}
+	for _, targets := range succs {
+		inst := IRInst{op: "jump"}
+		for _, target := range targets {
+			inst.targets = append(inst.targets, fmt.Sprint(target))
+		}
+		function.blocks = append(function.blocks, &IRBlock{fmt.Sprint(len(function.blocks)), []IRInst{inst}})
+	}
+	return function
+}
+
+func TestCFG(t *testing.T) {
+	type loop struct {
+		header  int
+		latches []int
+		body    []int
+	}
+	tests := []struct {
+		name  string
+		succs [][]int
+		order []int
+		idom  []int
+		loops []loop
+	}{
+		{
+			"diamond",
+			[][]int{{1, 2}, {3}, {3}, {}},
+			[]int{0, 2, 1, 3},
+			[]int{0, 0, 0, 0},
+			nil,
+		},
+		{
+			"while",
+			[][]int{{1}, {2, 3}, {1}, {}},
+			[]int{0, 1, 3, 2},
+			[]int{0, 0, 1, 1},
+			[]loop{{1, []int{2}, []int{1, 2}}},
+		},
+		{
+			"nested loops",
+			[][]int{{1}, {2, 5}, {3, 4}, {2}, {1}, {}},
+			[]int{0, 1, 5, 2, 4, 3},
+			[]int{0, 0, 1, 2, 2, 1},
+			[]loop{{1, []int{4}, []int{1, 2, 3, 4}}, {2, []int{3}, []int{2, 3}}},
+		},
+		{
+			"loop with two latches",
+			[][]int{{1}, {2, 3}, {1, 1}, {1, 4}, {}},
+			[]int{0, 1, 3, 4, 2},
+			[]int{0, 0, 1, 1, 3},
+			[]loop{{1, []int{2, 3}, []int{1, 2, 3}}},
+		},
+		{
+			"self loop",
+			[][]int{{1}, {1, 2}, {}},
+			[]int{0, 1, 2},
+			[]int{0, 0, 1},
+			[]loop{{1, []int{1}, []int{1}}},
+		},
+		{
+			"unreachable block",
+			[][]int{{1}, {}, {1}},
+			[]int{0, 1},
+			[]int{0, 0, -1},
+			nil,
+		},
+		{
+			"irreducible",
+			[][]int{{1, 2}, {2}, {1}},
+			[]int{0, 1, 2},
+			[]int{0, 0, 0},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		cfg := BuildCFG(graphFunction(test.succs))
+		if !reflect.DeepEqual(cfg.order, test.order) {
+			t.Errorf("%s: got order %v, want %v", test.name, cfg.order, test.order)
+		}
+		if !reflect.DeepEqual(cfg.idom, test.idom) {
+			t.Errorf("%s: got dominators %v, want %v", test.name, cfg.idom, test.idom)
+		}
+		var loops []loop
+		for _, l := range cfg.loops {
+			body := []int{}
+			for block := range l.body {
+				body = append(body, block)
+			}
+			sort.Ints(body)
+			latches := append([]int{}, l.latches...)
+			sort.Ints(latches)
+			loops = append(loops, loop{l.header, latches, body})
+		}
+		sort.Slice(loops, func(i, j int) bool { return loops[i].header < loops[j].header })
+		if !reflect.DeepEqual(loops, test.loops) {
+			t.Errorf("%s: got loops %v, want %v", test.name, loops, test.loops)
+		}
+		for _, l := range test.loops {
+			if !cfg.isHeader(l.header) {
+				t.Errorf("%s: %d isn't a header", test.name, l.header)
+			}
+			for _, latch := range l.latches {
+				if !cfg.isBackEdge(latch, l.header) {
+					t.Errorf("%s: %d to %d isn't a back edge", test.name, latch, l.header)
+				}
+			}
+		}
+	}
+}
+
+func TestDominates(t *testing.T) {
+	cfg := BuildCFG(graphFunction([][]int{{1, 2}, {3}, {3}, {}, {3}}))
+	tests := []struct {
+		a, b int
+		want bool
+	}{
+		{0, 0, true},
+		{0, 3, true},
+		{1, 3, false},
+		{2, 3, false},
+		{3, 3, true},
+		{0, 4, false},
+		{4, 3, false},
+	}
+	for _, test := range tests {
+		if got := cfg.dominates(test.a, test.b); got != test.want {
+			t.Errorf("dominates(%d, %d): got %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestCFGOfProgram(t *testing.T) {
+	statements, diagnostics := Parse("i := 0\nwhile i < 3 {\n    j := 0\n    while j < 2 {\n        j = j + 1\n    }\n    i = i + 1\n}\nout i\n")
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+	ir, errors := BuildIR(statements, false)
+	if len(errors) > 0 {
+		t.Fatal(errors[0])
+	}
+	cfg := BuildCFG(ir.functions[0])
+	if len(cfg.loops) != 2 {
+		t.Fatalf("got %d loops, want 2", len(cfg.loops))
+	}
+	outer, inner := cfg.loops[0], cfg.loops[1]
+	if len(outer.body) < len(inner.body) {
+		outer, inner = inner, outer
+	}
+	for block := range inner.body {
+		if !outer.body[block] {
+			t.Errorf("block %d of the inner loop isn't in the outer loop", block)
+		}
+	}
+	if !cfg.dominates(outer.header, inner.header) {
+		t.Error("the outer loop's header doesn't dominate the inner loop's header")
+	}
+}
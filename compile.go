@@ -1,22 +1,15 @@
 package main
 
-import (
-	"fmt"
-	"strings"
-)
+import "fmt"
 
 const (
 	Int       Type = iota
 	Bool      Type = iota
 	Undefined Type = iota
+	IntArray  Type = iota
+	BoolArray Type = iota
 )
 
-type Value struct {
-	ty    Type
-	acc   bool
-	label string
-}
-
 type Type int
 
 func (k Type) String() string {
@@ -25,296 +18,361 @@ func (k Type) String() string {
 		return "int"
 	case Bool:
 		return "bool"
+	case IntArray:
+		return "int array"
+	case BoolArray:
+		return "bool array"
 	default:
 		return "undefined"
 	}
 }
 
-func (expr Expr) compileValue(asm *Assembly, block **Block, scope *Scope) (Value, error) {
-	return expr.node.compileValue(asm, block, scope, expr.pos)
+// withArticle returns the name of the type after "a" or "an".
+func (k Type) withArticle() string {
+	if k == Int || k == IntArray || k == Undefined {
+		return "an " + k.String()
+	}
+	return "a " + k.String()
+}
+
+func (k Type) isArray() bool {
+	return k == IntArray || k == BoolArray
+}
+
+func (k Type) arrayOf() Type {
+	if k == Bool {
+		return BoolArray
+	}
+	return IntArray
+}
+
+func (k Type) elem() Type {
+	if k == BoolArray {
+		return Bool
+	}
+	return Int
+}
+
+var arithmeticOps = map[string]string{
+	"+": "add",
+	"-": "sub",
+	"*": "mul",
+	"/": "div",
+	"%": "mod",
+}
+
+func (expr Expr) compileValue(ir *IRProgram, block **IRBlock, scope *Scope) (Operand, error) {
+	return expr.node.compileValue(ir, block, scope, expr.span())
+}
+
+func (expr Expr) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope) error {
+	return expr.node.compileCondition(ir, block, ifTrue, ifFalse, scope, expr.span())
 }
 
-func (expr Expr) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope) error {
-	return expr.node.compileCondition(asm, block, ifTrue, ifFalse, scope, expr.pos)
+// checkIntLiteral reports a literal that doesn't fit in a mailbox. Negative
+// literals are written with -, which checks its operand itself.
+func checkIntLiteral(literal IntLiteral, span Span, signed bool) error {
+	if signed && literal.value >= SignedOffset {
+		return newError("E021", span, fmt.Sprintf("integer %d is too big for signed mode", literal.value)).
+			withHelp("integers go from -500 to 499 in signed mode")
+	}
+	if literal.value > 999 {
+		return newError("E021", span, fmt.Sprintf("integer %d is too big", literal.value)).
+			withHelp("integers go from 0 to 999")
+	}
+	return nil
 }
 
-func (literal IntLiteral) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
-	return Value{Int, false, asm.getConstant(literal.value)}, nil
+func (literal IntLiteral) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
+	if err := checkIntLiteral(literal, span, scope.signed); err != nil {
+		return Operand{}, err
+	}
+	return constant(literal.value, Int), nil
 }
 
-func (literal BoolLiteral) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
+func (literal BoolLiteral) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
 	value := 0
 	if literal.value {
 		value = 1
 	}
-	return Value{Bool, false, asm.getConstant(value)}, nil
+	return constant(value, Bool), nil
 }
 
-func (input Input) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
-	(*block).emitInstruction("INP", "")
-	return Value{Int, true, ""}, nil
+func (input Input) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
+	dst := ir.newTemp(Int)
+	ir.emitOp(*block, "in", dst)
+	return dst, nil
 }
 
-func (ident Ident) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
-	label, ty, prs := scope.get(ident.name)
+func (ident Ident) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
+	decl, prs := scope.use(ident.name, span)
 	if !prs {
-		return Value{}, fmt.Errorf("undefined variable '%s' at %s", ident.name, pos)
+		return Operand{}, undefinedVariable(ident.name, span)
+	}
+	if decl.kind.isArray() {
+		return Operand{}, newError("E012", span, fmt.Sprintf("array '%s' must be indexed", ident.name)).
+			withLabel("this is an array").
+			withHelp(fmt.Sprintf("use '%s[index]' to get one of its elements", ident.name))
 	}
-	return Value{ty, false, label}, nil
+	return variable(decl.label, decl.kind), nil
 }
 
-func (bin Binary) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
+func (bin Binary) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
 	switch bin.symbol {
-	case "+", "-":
-		return compileArithmetic(asm, block, scope, bin.symbol, bin.left, bin.right, pos)
+	case "+", "-", "*", "/", "%":
+		return compileArithmetic(ir, block, scope, bin.symbol, bin.left, bin.right, span)
 	case "==", "!=", ">", "<", ">=", "<=", "and", "or":
-		ifTrue := asm.newUniqueBlock()
-		ifFalse := asm.newUniqueBlock()
-		exitBlock := asm.newUniqueBlock()
-
-		ifFalse.emitInstruction("LDA", asm.getConstant(0))
-		ifTrue.emitInstruction("LDA", asm.getConstant(1))
-		ifTrue.emitInstruction("BRA", exitBlock.label)
-		ifFalse.emitInstruction("BRA", exitBlock.label)
-
-		if err := compileBinaryCondition(bin, asm, block, ifTrue, ifFalse, scope); err != nil {
-			return Value{}, err
-		}
-		*block = exitBlock
-		return Value{Bool, true, ""}, nil
+		return compileConditionValue(ir, block, func(ifTrue, ifFalse *IRBlock) error {
+			return compileBinaryCondition(bin, ir, block, ifTrue, ifFalse, scope, span)
+		})
 	default:
-		panic("undefined symbol")
+		return Operand{}, unknownOperator(bin.symbol, span)
 	}
 }
 
-func (unary Unary) compileValue(asm *Assembly, block **Block, scope *Scope, pos Position) (Value, error) {
+// unknownOperator is the error for an operator the parser never produces, so
+// that an AST built some other way gives an error instead of a panic.
+func unknownOperator(symbol string, span Span) error {
+	return fmt.Errorf("unknown operator '%s' at %s", symbol, span.pos)
+}
+
+func (unary Unary) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
 	switch unary.symbol {
 	case "-":
-		val, err := compileAndExpect(unary.expr, asm, block, scope, Int)
+		// -500 is the only way to write the smallest signed integer.
+		if literal, ok := unary.expr.node.(IntLiteral); ok && scope.signed && literal.value <= SignedOffset {
+			return constant(-literal.value, Int), nil
+		}
+		val, err := compileAndExpect(unary.expr, ir, block, scope, Int)
 		if err != nil {
-			return Value{}, err
+			return Operand{}, err
 		}
-		label := storeToTemp(val, asm, *block)
-		defer popTemp(val, asm)
-		(*block).emitInstruction("LDA", asm.getConstant(0))
-		(*block).emitInstruction("SUB", label)
-		return Value{Int, true, ""}, nil
+		dst := ir.newTemp(Int)
+		ir.emit(*block, IRInst{op: "sub", dst: dst, args: []Operand{constant(0, Int), val}, span: span})
+		return dst, nil
 	case "not":
-		ifTrue := asm.newUniqueBlock()
-		ifFalse := asm.newUniqueBlock()
-		exitBlock := asm.newUniqueBlock()
+		return compileConditionValue(ir, block, func(ifTrue, ifFalse *IRBlock) error {
+			return compileUnaryCondition(unary, ir, block, ifTrue, ifFalse, scope, span)
+		})
+	}
+	return Operand{}, unknownOperator(unary.symbol, span)
+}
 
-		ifFalse.emitInstruction("LDA", asm.getConstant(0))
-		ifTrue.emitInstruction("LDA", asm.getConstant(1))
-		ifTrue.emitInstruction("BRA", exitBlock.label)
-		ifFalse.emitInstruction("BRA", exitBlock.label)
+// compileConditionValue turns a condition into a bool by setting a temporary
+// to 1 or 0 on the way to a new block, which becomes the current block.
+func compileConditionValue(ir *IRProgram, block **IRBlock, compileCondition func(ifTrue, ifFalse *IRBlock) error) (Operand, error) {
+	ifTrue := ir.newUniqueBlock()
+	ifFalse := ir.newUniqueBlock()
+	exitBlock := ir.newUniqueBlock()
 
-		if err := compileUnaryCondition(unary, asm, block, ifTrue, ifFalse, scope, pos); err != nil {
-			return Value{}, err
-		}
-		*block = exitBlock
-		return Value{Bool, true, ""}, nil
+	dst := ir.newTemp(Bool)
+	ir.emitOp(ifTrue, "copy", dst, constant(1, Bool))
+	ir.emitOp(ifFalse, "copy", dst, constant(0, Bool))
+	ir.emitJump(ifTrue, exitBlock)
+	ir.emitJump(ifFalse, exitBlock)
+
+	if err := compileCondition(ifTrue, ifFalse); err != nil {
+		return Operand{}, err
 	}
-	panic("LOL")
+	*block = exitBlock
+	return dst, nil
 }
 
-func compileArithmetic(asm *Assembly, block **Block, scope *Scope, symbol string, left, right Expr, pos Position) (Value, error) {
-	rightVal, err := compileAndExpect(right, asm, block, scope, Int)
-	if err != nil {
-		return Value{}, err
+// hasCall reports whether evaluating the expression calls a function, which
+// can assign to any variable it sees.
+func hasCall(expr Expr) bool {
+	switch node := expr.node.(type) {
+	case Call:
+		return true
+	case Index:
+		return hasCall(node.index)
+	case Binary:
+		return hasCall(node.left) || hasCall(node.right)
+	case Unary:
+		return hasCall(node.expr)
+	}
+	return false
+}
+
+// keepValue copies a variable into a temporary if it is used after later is
+// evaluated and later calls a function, so that it keeps the value it had
+// when it was evaluated instead of one the function assigns.
+func keepValue(val Operand, later Expr, ir *IRProgram, block *IRBlock) Operand {
+	if val.kind != VarOperand || !hasCall(later) {
+		return val
 	}
-	rightLabel := storeToTemp(rightVal, asm, *block)
-	defer popTemp(rightVal, asm)
-	leftVal, err := compileAndExpect(left, asm, block, scope, Int)
+	dst := ir.newTemp(val.ty)
+	ir.emitOp(block, "copy", dst, val)
+	return dst
+}
+
+func compileArithmetic(ir *IRProgram, block **IRBlock, scope *Scope, symbol string, left, right Expr, span Span) (Operand, error) {
+	rightVal, err := compileAndExpect(right, ir, block, scope, Int)
 	if err != nil {
-		return Value{}, err
+		return Operand{}, err
 	}
-	loadToAcc(leftVal, *block)
-	switch symbol {
-	case "+":
-		(*block).emitInstruction("ADD", rightLabel)
-	case "-":
-		(*block).emitInstruction("SUB", rightLabel)
+	rightVal = keepValue(rightVal, left, ir, *block)
+	leftVal, err := compileAndExpect(left, ir, block, scope, Int)
+	if err != nil {
+		return Operand{}, err
 	}
-	return Value{Int, true, ""}, nil
+	dst := ir.newTemp(Int)
+	ir.emit(*block, IRInst{op: arithmeticOps[symbol], dst: dst, args: []Operand{leftVal, rightVal}, span: span})
+	return dst, nil
 }
 
-func (literal IntLiteral) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
-	return fmt.Errorf("int used as a condition at %s", pos)
+func (literal IntLiteral) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	return notCondition(span, Int)
 }
 
-func (literal BoolLiteral) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
+func (literal BoolLiteral) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
 	if literal.value {
-		(*block).emitInstruction("BRA", ifTrue.label)
+		ir.emitJump(*block, ifTrue)
 	} else {
-		(*block).emitInstruction("BRA", ifFalse.label)
+		ir.emitJump(*block, ifFalse)
 	}
 	return nil
 }
 
-func (input Input) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
-	return fmt.Errorf("cannot use input as condition at %s", pos)
+func (input Input) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	return notCondition(span, Int)
 }
 
-func (bin Binary) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
-	return compileBinaryCondition(bin, asm, block, ifTrue, ifFalse, scope)
+func (bin Binary) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	return compileBinaryCondition(bin, ir, block, ifTrue, ifFalse, scope, span)
 }
 
-func (unary Unary) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
-	return compileUnaryCondition(unary, asm, block, ifTrue, ifFalse, scope, pos)
+func (unary Unary) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	return compileUnaryCondition(unary, ir, block, ifTrue, ifFalse, scope, span)
 }
 
-func compileUnaryCondition(unary Unary, asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
+func compileUnaryCondition(unary Unary, ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
 	switch unary.symbol {
 	case "not":
-		return unary.expr.compileCondition(asm, block, ifFalse, ifTrue, scope)
+		return unary.expr.compileCondition(ir, block, ifFalse, ifTrue, scope)
 	case "-":
-		return fmt.Errorf("cannot use '-' operator in condition at %s", pos)
+		return notCondition(span, Int)
 	}
-	panic("invalid symbol")
+	return unknownOperator(unary.symbol, span)
 }
 
-func compileBinaryCondition(bin Binary, asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope) error {
+func compileBinaryCondition(bin Binary, ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
 	switch bin.symbol {
-	case ">=":
-		return compilePostiveBranch(bin.left, bin.right, asm, block, ifTrue, ifFalse, scope)
-	case "<":
-		return compilePostiveBranch(bin.left, bin.right, asm, block, ifFalse, ifTrue, scope)
-	case "<=":
-		return compilePostiveBranch(bin.right, bin.left, asm, block, ifTrue, ifFalse, scope)
-	case ">":
-		return compilePostiveBranch(bin.right, bin.left, asm, block, ifFalse, ifTrue, scope)
-	case "==":
-		return compileZeroBranch(bin.left, bin.right, asm, block, ifTrue, ifFalse, scope)
-	case "!=":
-		return compileZeroBranch(bin.left, bin.right, asm, block, ifFalse, ifTrue, scope)
+	case "+", "-", "*", "/", "%":
+		return notCondition(span, Int)
+	case ">=", "<", "==", "!=":
+		left, right, err := compileCompare(bin.left, bin.right, ir, block, scope)
+		if err != nil {
+			return err
+		}
+		ir.emitBranch(*block, bin.symbol, left, right, ifTrue, ifFalse)
+	case "<=", ">":
+		// These subtract the left side from the right, which is evaluated
+		// second.
+		right, left, err := compileCompare(bin.right, bin.left, ir, block, scope)
+		if err != nil {
+			return err
+		}
+		ir.emitBranch(*block, bin.symbol, left, right, ifTrue, ifFalse)
 	case "and":
-		nextCondition := asm.newUniqueBlock()
-		if err := bin.left.compileCondition(asm, block, nextCondition, ifFalse, scope); err != nil {
+		nextCondition := ir.newUniqueBlock()
+		if err := bin.left.compileCondition(ir, block, nextCondition, ifFalse, scope); err != nil {
 			return err
 		}
-		if err := bin.right.compileCondition(asm, &nextCondition, ifTrue, ifFalse, scope); err != nil {
+		if err := bin.right.compileCondition(ir, &nextCondition, ifTrue, ifFalse, scope); err != nil {
 			return err
 		}
 	case "or":
-		nextCondition := asm.newUniqueBlock()
-		if err := bin.left.compileCondition(asm, block, ifTrue, nextCondition, scope); err != nil {
+		nextCondition := ir.newUniqueBlock()
+		if err := bin.left.compileCondition(ir, block, ifTrue, nextCondition, scope); err != nil {
 			return err
 		}
-		if err := bin.right.compileCondition(asm, &nextCondition, ifTrue, ifFalse, scope); err != nil {
+		if err := bin.right.compileCondition(ir, &nextCondition, ifTrue, ifFalse, scope); err != nil {
 			return err
 		}
 	default:
-		panic("undefined symbol")
+		return unknownOperator(bin.symbol, span)
 	}
 	return nil
 }
 
-func compileCompare(left, right Expr, asm *Assembly, block **Block, scope *Scope) error {
-	rightVal, err := compileAndExpect(right, asm, block, scope, Int)
+// compileCompare evaluates both sides of a comparison, the right first.
+func compileCompare(left, right Expr, ir *IRProgram, block **IRBlock, scope *Scope) (Operand, Operand, error) {
+	rightVal, err := compileAndExpect(right, ir, block, scope, Int)
 	if err != nil {
-		return err
+		return Operand{}, Operand{}, err
 	}
-	rightLabel := storeToTemp(rightVal, asm, *block)
-	defer popTemp(rightVal, asm)
-	leftVal, err := compileAndExpect(left, asm, block, scope, Int)
+	rightVal = keepValue(rightVal, left, ir, *block)
+	leftVal, err := compileAndExpect(left, ir, block, scope, Int)
 	if err != nil {
-		return err
-	}
-	loadToAcc(leftVal, *block)
-	(*block).emitInstruction("SUB", rightLabel)
-	return nil
-}
-
-func compileZeroBranch(left, right Expr, asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope) error {
-	if err := compileCompare(left, right, asm, block, scope); err != nil {
-		return err
-	}
-	(*block).emitInstruction("BRP", ifTrue.label)
-	(*block).emitInstruction("BRA", ifFalse.label)
-	return nil
-}
-
-func compilePostiveBranch(left, right Expr, asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope) error {
-	if err := compileCompare(left, right, asm, block, scope); err != nil {
-		return err
-	}
-	(*block).emitInstruction("BRP", ifTrue.label)
-	(*block).emitInstruction("BRA", ifFalse.label)
-	return nil
-}
-
-func loadToAcc(val Value, block *Block) {
-	if !val.acc {
-		block.emitInstruction("LDA", val.label)
-	}
-}
-
-func storeToTemp(val Value, asm *Assembly, block *Block) string {
-	if val.acc {
-		label := asm.pushTemp()
-		block.emitInstruction("STA", label)
-		return label
-	}
-	return val.label
-}
-
-func popTemp(val Value, asm *Assembly) {
-	if !val.acc {
-		asm.popTemp()
+		return Operand{}, Operand{}, err
 	}
+	return leftVal, rightVal, nil
 }
 
-func compileAndExpect(expr Expr, asm *Assembly, block **Block, scope *Scope, ty Type) (Value, error) {
-	val, err := expr.compileValue(asm, block, scope)
+func compileAndExpect(expr Expr, ir *IRProgram, block **IRBlock, scope *Scope, ty Type) (Operand, error) {
+	val, err := expr.compileValue(ir, block, scope)
 	if err != nil {
-		return Value{}, err
+		return Operand{}, err
 	}
 	if val.ty != ty {
-		return Value{}, fmt.Errorf("expected a %s instead got %s at %s", ty, val.ty, expr.pos)
+		return Operand{}, newError("E010", expr.span(), fmt.Sprintf("expected %s instead got %s", ty.withArticle(), val.ty.withArticle())).
+			withLabel("this is " + val.ty.withArticle())
 	}
 	return val, nil
 }
 
-func (ident Ident) compileCondition(asm *Assembly, block **Block, ifTrue, ifFalse *Block, scope *Scope, pos Position) error {
-	label, ty, prs := scope.get(ident.name)
+func (ident Ident) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	decl, prs := scope.use(ident.name, span)
 	if !prs {
-		return fmt.Errorf("undefined variable '%s' at %s", ident.name, pos)
+		return undefinedVariable(ident.name, span)
 	}
-	if ty == Int {
-		return fmt.Errorf("variable '%s' at %s has type %s but is being used in condition so should be bool", ident.name, pos, ty)
+	if decl.kind != Bool {
+		return notCondition(span, decl.kind)
 	}
-	(*block).emitInstruction("LDA", label)
-	(*block).emitInstruction("BRZ", ifFalse.label)
-	(*block).emitInstruction("BRA", ifTrue.label)
+	ir.emitIf(*block, variable(decl.label, decl.kind), ifTrue, ifFalse)
 	return nil
 }
 
-func (assign Assign) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
-	label, ty, prs := scope.get(assign.name)
+func (assign Assign) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	name := Span{span.pos, len(assign.name)}
+	target, prs := scope.use(assign.name, name)
 	if !prs {
-		return append(errors, fmt.Errorf("cannot assign to undefined variable '%s' at %s", assign.name, pos))
+		return append(errors, undefinedVariable(assign.name, name))
+	}
+	if target.kind.isArray() {
+		return append(errors, newError("E012", name, fmt.Sprintf("cannot assign to array '%s' without an index", assign.name)).
+			withLabel("this is an array").
+			withHelp(fmt.Sprintf("use '%s[index] = value' to set one of its elements", assign.name)))
 	}
-	value, err := compileAndExpect(assign.expr, asm, block, scope, ty)
+	value, err := compileAndExpect(assign.expr, ir, block, scope, target.kind)
 	if err != nil {
 		return append(errors, err)
 	}
-	loadToAcc(value, *block)
-	(*block).emitInstruction("STA", label)
+	ir.emitOp(*block, "copy", variable(target.label, target.kind), value)
 	return errors
 }
 
-func (decl Declare) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
-	value := Value{1, true, ""}
+func (decl Declare) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	if decl.size > 0 {
+		label := ir.uniqueLabel(decl.name)
+		scope.declare(decl.name, label, decl.ty.arrayOf(), decl.size, Span{span.pos, len(decl.name)})
+		ir.createVariable(label, decl.ty.arrayOf(), ArrayBlock, decl.size)
+		return errors
+	}
+
+	value := Operand{}
 	ty := Undefined
 	if decl.expr.node != nil {
 		var err error
-		value, err = decl.expr.compileValue(asm, block, scope)
+		value, err = decl.expr.compileValue(ir, block, scope)
 		if err != nil {
 			return append(errors, err)
 		}
 		if decl.ty != value.ty && decl.ty != Undefined {
-			err := fmt.Errorf("expression at %s has type %s but declaration at %s has type %s", decl.expr.pos, value.ty, pos, decl.ty)
+			err := newError("E010", decl.expr.span(), fmt.Sprintf("expected %s instead got %s", decl.ty.withArticle(), value.ty.withArticle())).
+				withLabel("this is "+value.ty.withArticle()).
+				withNote(Span{span.pos, len(decl.name)}, fmt.Sprintf("declared as %s here", decl.ty.withArticle()))
 			return append(errors, err)
 		}
 		ty = value.ty
@@ -322,97 +380,350 @@ func (decl Declare) compile(asm *Assembly, block **Block, scope *Scope, pos Posi
 		ty = decl.ty
 	}
 
-	label := scope.declare(decl.name, ty)
-	asm.createVariable(label, 0)
+	label := ir.uniqueLabel(decl.name)
+	scope.declare(decl.name, label, ty, 0, Span{span.pos, len(decl.name)})
+	if scope.currentDepth > 0 {
+		ir.createVariable(label, ty, LocalBlock, 0)
+	} else {
+		ir.createVariable(label, ty, VariableBlock, 0)
+	}
 
 	if decl.expr.node != nil {
-		loadToAcc(value, *block)
-		(*block).emitInstruction("STA", label)
+		ir.emitOp(*block, "copy", variable(label, ty), value)
 	}
 	return errors
 }
 
-func (statement If) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
-	ifTrue := asm.newUniqueBlock()
-	ifFalse := asm.newUniqueBlock()
-	if err := statement.cond.compileCondition(asm, block, ifTrue, ifFalse, scope); err != nil {
-		return append(errors, err)
-	}
-	errors = statement.ifTrue.compile(asm, &ifTrue, scope, errors)
-	if len(errors) > 0 {
-		return errors
+// compile compiles the bodies even when the condition has errors, so that
+// the errors in them are reported too.
+func (statement If) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	ifTrue := ir.newUniqueBlock()
+	ifFalse := ir.newUniqueBlock()
+	if err := statement.cond.compileCondition(ir, block, ifTrue, ifFalse, scope); err != nil {
+		errors = append(errors, err)
 	}
+	errors = statement.ifTrue.compile(ir, &ifTrue, scope, errors)
 	if statement.ifFalse.node == nil {
-		ifTrue.emitInstruction("BRA", ifFalse.label)
+		ir.emitJump(ifTrue, ifFalse)
 		*block = ifFalse
-		return nil
-	}
-	exitBlock := asm.newUniqueBlock()
-	errors = statement.ifFalse.compile(asm, &ifFalse, scope, errors)
-	if len(errors) > 0 {
 		return errors
 	}
-	ifTrue.emitInstruction("BRA", exitBlock.label)
-	ifFalse.emitInstruction("BRA", exitBlock.label)
+	exitBlock := ir.newUniqueBlock()
+	errors = statement.ifFalse.compile(ir, &ifFalse, scope, errors)
+	ir.emitJump(ifTrue, exitBlock)
+	ir.emitJump(ifFalse, exitBlock)
 	*block = exitBlock
-	return nil
+	return errors
 }
 
-func (statement While) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
-	condBlock := asm.newUniqueBlock()
-	loopBlock := asm.newUniqueBlock()
-	exitBlock := asm.newUniqueBlock()
+// compile compiles the body even when the condition has errors, as If does.
+func (statement While) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	condBlock := ir.newUniqueBlock()
+	loopBlock := ir.newUniqueBlock()
+	exitBlock := ir.newUniqueBlock()
 
-	(*block).emitInstruction("BRA", condBlock.label)
-	if err := statement.cond.compileCondition(asm, &condBlock, loopBlock, exitBlock, scope); err != nil {
-		return append(errors, err)
+	ir.emitJump(*block, condBlock)
+	if err := statement.cond.compileCondition(ir, &condBlock, loopBlock, exitBlock, scope); err != nil {
+		errors = append(errors, err)
 	}
 
-	errors = statement.loop.compile(asm, &loopBlock, scope, errors)
-	loopBlock.emitInstruction("BRA", condBlock.label)
+	errors = statement.loop.compile(ir, &loopBlock, scope, errors)
+	ir.emitJump(loopBlock, condBlock)
 
 	*block = exitBlock
 	return errors
 }
 
-func (blockScope BlockScope) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
+func (blockScope BlockScope) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
 	scope.pushScope()
-	errors = compileStatements(blockScope.statements, asm, block, scope, errors)
+	errors = compileStatements(blockScope.statements, ir, block, scope, errors)
 	scope.popScope()
 	return errors
 }
 
-func (output Output) compile(asm *Assembly, block **Block, scope *Scope, pos Position, errors []error) []error {
-	val, err := compileAndExpect(output.expr, asm, block, scope, Int)
+func (output Output) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	val, err := compileAndExpect(output.expr, ir, block, scope, Int)
 	if err != nil {
 		return append(errors, err)
 	}
-	loadToAcc(val, *block)
-	(*block).emitInstruction("OUT", "")
+	ir.emitOp(*block, "out", Operand{}, val)
 	return errors
 }
 
-func compileStatements(statements []Statement, asm *Assembly, block **Block, scope *Scope, errors []error) []error {
+func compileStatements(statements []Statement, ir *IRProgram, block **IRBlock, scope *Scope, errors []error) []error {
 	for _, statement := range statements {
-		errors = statement.compile(asm, block, scope, errors)
+		errors = statement.compile(ir, block, scope, errors)
 	}
 	return errors
 }
 
-func Compile(statements []Statement) (string, []error) {
-	asm := InitAssembly()
-	block := asm.newBlock("start")
+// BuildIR checks the types of the program and translates it into the IR.
+func BuildIR(statements []Statement, signed bool) (IRProgram, []error) {
+	ir, _, errors := buildIR(statements, signed)
+	return ir, errors
+}
+
+// buildIR is BuildIR, also returning the top level scope with the references
+// to every variable and function.
+func buildIR(statements []Statement, signed bool) (IRProgram, Scope, []error) {
+	ir := InitIR()
+	block := ir.newFunction(nil, "start")
 	scope := InitScope()
+	scope.signed = signed
 	errors := []error{}
 
-	errors = compileStatements(statements, &asm, &block, &scope, errors)
-	block.emitInstruction("HLT", "")
+	for i, statement := range statements {
+		ir.origin = i
+		errors = statement.compile(&ir, &block, &scope, errors)
+	}
+	ir.origin = -1
+	ir.emitOp(block, "halt", Operand{})
+	ir.coalesceCopies()
+	return ir, scope, errors
+}
+
+func Compile(statements []Statement, options Options) (Assembly, []error) {
+	asm, _, errors := compile(statements, options)
+	return asm, errors
+}
 
+// compile is Compile, also returning the top level scope with the references
+// to every variable and function.
+func compile(statements []Statement, options Options) (Assembly, Scope, []error) {
+	asm := InitAssembly()
+	asm.options = options
+	for _, statement := range statements {
+		asm.statementUsage = append(asm.statementUsage, StatementUsage{statement.pos, statement.length, MemoryUsage{}})
+	}
+
+	ir, scope, errors := buildIR(statements, options.signed)
 	if len(errors) > 0 {
-		return "", errors
+		return asm, scope, errors
+	}
+	asm.lower(&ir)
+	asm.emitRuntime()
+	asm.optimize()
+
+	if usage := asm.usage(); usage.total() > MailboxCount {
+		err := newError("E022", Span{}, fmt.Sprintf("program needs %d mailboxes but only %d are available (%s)", usage.total(), MailboxCount, usage)).
+			withHelp("the -memory flag shows how many mailboxes each statement uses")
+		errors = append(errors, err)
+	}
+
+	return asm, scope, errors
+}
+
+// optimize runs the passes turned on in the options. The peephole optimizer
+// runs again after the other passes as they tend to leave new patterns
+// behind, such as a store and load of two values that now share a mailbox.
+func (asm *Assembly) optimize() {
+	if asm.options.peephole {
+		asm.peepholeSaved += asm.peephole()
+	}
+	if asm.options.layout {
+		before := asm.usage().total()
+		asm.removeUnreachable()
+		asm.layout()
+		asm.layoutSaved = before - asm.usage().total()
+	}
+	if asm.options.share {
+		asm.sharingSaved = asm.shareMailboxes()
+	}
+	if asm.options.peephole && (asm.options.layout || asm.options.share) {
+		asm.peepholeSaved += asm.peephole()
+	}
+}
+
+// compile gives the function its own entry block and parameter mailboxes. The
+// function is only added to the scope once its body has been compiled, so it
+// can't call itself.
+func (function Function) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	if scope.currentDepth > 0 {
+		return append(errors, newError("E017", span, fmt.Sprintf("function '%s' must be declared at the top level", function.name)).
+			withHelp("move it out of the block it is in"))
+	}
+	if previous, prs := scope.functions[function.name]; prs {
+		return append(errors, newError("E018", span, fmt.Sprintf("function '%s' is already declared", function.name)).
+			withNote(previous.span, "first declared here"))
+	}
+	sig := &Signature{
+		span:  span,
+		name:  Span{function.pos, len(function.name)},
+		ret:   function.ret,
+		entry: ir.uniqueLabel(function.name),
+		exit:  ir.uniqueLabel(function.name + "_exit"),
+	}
+	caller := ir.function
+	entry := ir.newFunction(sig, sig.entry)
+
+	scope.pushScope()
+	for _, param := range function.params {
+		label := ir.uniqueLabel(function.name + "_" + param.name)
+		scope.declare(param.name, label, param.ty, 0, Span{param.pos, len(param.name)})
+		ir.createVariable(label, param.ty, LocalBlock, 0)
+		sig.params = append(sig.params, param.ty)
+		sig.labels = append(sig.labels, label)
+	}
+
+	scope.function = sig
+	errors = function.body.compile(ir, &entry, scope, errors)
+	scope.function = nil
+	scope.popScope()
+
+	if function.ret != Undefined {
+		ir.emitOp(entry, "ret", Operand{}, constant(0, function.ret))
+	} else {
+		ir.emitOp(entry, "ret", Operand{})
+	}
+	ir.function = caller
+
+	scope.functions[function.name] = sig
+	scope.references = append(scope.references, Reference{sig.name, nil, sig})
+	return errors
+}
+
+// compileValue evaluates every argument before the call, which copies them
+// into the parameter mailboxes, since an argument may call the same function.
+func (call Call) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
+	sig, prs := scope.functions[call.name]
+	if !prs {
+		return Operand{}, newError("E015", span, fmt.Sprintf("undefined function '%s'", call.name)).
+			withHelp("functions must be declared before they are called")
+	}
+	scope.references = append(scope.references, Reference{Span{span.pos, len(call.name)}, nil, sig})
+	if len(call.args) != len(sig.params) {
+		return Operand{}, newError("E016", span, fmt.Sprintf("function '%s' takes %d arguments but %d were given", call.name, len(sig.params), len(call.args))).
+			withNote(sig.span, "declared here")
+	}
+	args := []Operand{}
+	for i, arg := range call.args {
+		val, err := compileAndExpect(arg, ir, block, scope, sig.params[i])
+		if err != nil {
+			return Operand{}, err
+		}
+		for _, later := range call.args[i+1:] {
+			val = keepValue(val, later, ir, *block)
+		}
+		args = append(args, val)
+	}
+	dst := Operand{ty: Undefined}
+	if sig.ret != Undefined {
+		dst = ir.newTemp(sig.ret)
+	}
+	ir.emit(*block, IRInst{op: "call", dst: dst, args: args, name: sig.entry})
+	return dst, nil
+}
+
+func (call Call) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	val, err := call.compileValue(ir, block, scope, span)
+	if err != nil {
+		return err
+	}
+	if val.ty != Bool {
+		return notCondition(span, val.ty)
+	}
+	ir.emitIf(*block, val, ifTrue, ifFalse)
+	return nil
+}
+
+func (stmt CallStatement) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	if _, err := stmt.call.compileValue(ir, block, scope); err != nil {
+		return append(errors, err)
 	}
+	return errors
+}
+
+func (ret Return) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	if scope.function == nil {
+		return append(errors, newError("E019", span, "return outside of a function"))
+	}
+	if ret.expr.node == nil {
+		if scope.function.ret != Undefined {
+			return append(errors, newError("E020", span, "return must return "+scope.function.ret.withArticle()).
+				withNote(scope.function.span, "the function returns "+scope.function.ret.withArticle()))
+		}
+		ir.emitOp(*block, "ret", Operand{})
+	} else {
+		if scope.function.ret == Undefined {
+			return append(errors, newError("E020", ret.expr.span(), "return with a value in a function that doesn't return one").
+				withNote(scope.function.span, "the function has no return type"))
+		}
+		val, err := compileAndExpect(ret.expr, ir, block, scope, scope.function.ret)
+		if err != nil {
+			return append(errors, err)
+		}
+		ir.emitOp(*block, "ret", Operand{}, val)
+	}
+	*block = ir.newUniqueBlock()
+	return errors
+}
+
+func compileAndExpectArray(name string, scope *Scope, span Span) (*Variable, error) {
+	variable, prs := scope.use(name, span)
+	if !prs {
+		return nil, undefinedVariable(name, span)
+	}
+	if !variable.kind.isArray() {
+		return nil, newError("E013", span, fmt.Sprintf("variable '%s' has type %s so cannot be indexed", name, variable.kind)).
+			withLabel("this is " + variable.kind.withArticle())
+	}
+	return variable, nil
+}
+
+func undefinedVariable(name string, span Span) Diagnostic {
+	return newError("E011", span, fmt.Sprintf("undefined variable '%s'", name)).
+		withHelp(fmt.Sprintf("variables must be declared before they are used, such as with '%s := 0'", name))
+}
+
+func notCondition(span Span, ty Type) Diagnostic {
+	diag := newError("E014", span, fmt.Sprintf("%s used as a condition", ty)).
+		withLabel(fmt.Sprintf("this is %s but conditions must be bool", ty.withArticle()))
+	if ty == Int {
+		diag = diag.withHelp("compare it with a value instead, such as 'x != 0'")
+	}
+	return diag
+}
 
-	builder := strings.Builder{}
-	asm.assemble(&builder)
-	return builder.String(), []error{}
+func (index Index) compileValue(ir *IRProgram, block **IRBlock, scope *Scope, span Span) (Operand, error) {
+	array, err := compileAndExpectArray(index.name, scope, Span{span.pos, len(index.name)})
+	if err != nil {
+		return Operand{}, err
+	}
+	indexVal, err := compileAndExpect(index.index, ir, block, scope, Int)
+	if err != nil {
+		return Operand{}, err
+	}
+	dst := ir.newTemp(array.kind.elem())
+	ir.emit(*block, IRInst{op: "load", dst: dst, args: []Operand{indexVal}, name: array.label})
+	return dst, nil
+}
+
+func (index Index) compileCondition(ir *IRProgram, block **IRBlock, ifTrue, ifFalse *IRBlock, scope *Scope, span Span) error {
+	val, err := index.compileValue(ir, block, scope, span)
+	if err != nil {
+		return err
+	}
+	if val.ty != Bool {
+		return notCondition(span, val.ty)
+	}
+	ir.emitIf(*block, val, ifTrue, ifFalse)
+	return nil
+}
+
+func (assign AssignIndex) compile(ir *IRProgram, block **IRBlock, scope *Scope, span Span, errors []error) []error {
+	array, err := compileAndExpectArray(assign.name, scope, Span{span.pos, len(assign.name)})
+	if err != nil {
+		return append(errors, err)
+	}
+	indexVal, err := compileAndExpect(assign.index, ir, block, scope, Int)
+	if err != nil {
+		return append(errors, err)
+	}
+	indexVal = keepValue(indexVal, assign.expr, ir, *block)
+	value, err := compileAndExpect(assign.expr, ir, block, scope, array.kind.elem())
+	if err != nil {
+		return append(errors, err)
+	}
+	ir.emit(*block, IRInst{op: "store", args: []Operand{indexVal, value}, name: array.label})
+	return errors
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// runOptions are the option sets runtime tests compile with, from no
+// optimization to all of it.
+var runOptions = []Options{{}, {peephole: true, layout: true, share: true}}
+
+// compileAndRun compiles a program with the options and runs it on the
+// simulator with the input, returning what it output.
+func compileAndRun(t *testing.T, source string, options Options, input []int) []int {
+	t.Helper()
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		t.Fatalf("parse: %s", diagnostics[0])
+	}
+	asm, errors := Compile(Fold(statements, options.signed), options)
+	if len(errors) > 0 {
+		t.Fatalf("compile: %s", errors[0])
+	}
+	image, errors := asm.link()
+	if len(errors) > 0 {
+		t.Fatalf("link: %s", errors[0])
+	}
+	machine := InitMachine(image.memory, input)
+	if err := machine.run(100000); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	return machine.output
+}
+
+func TestDivide(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		inputs [][]int
+		want   [][]int
+	}{
+		{
+			// Without layout, the routine's blocks stay in the order they
+			// are created, so a constant created partway through must not
+			// end up where the loop falls through to its exit.
+			"divide and modulo",
+			"a := in\nb := in\nout a / b\nout a % b\n",
+			[][]int{{17, 5}, {4, 9}, {999, 1}, {7, 0}},
+			[][]int{{3, 2}, {0, 4}, {999, 0}, {0, 7}},
+		},
+		{
+			"multiply",
+			"out in * in\n",
+			[][]int{{17, 5}, {0, 9}, {3, 0}},
+			[][]int{{85}, {0}, {0}},
+		},
+	}
+	for _, test := range tests {
+		for _, options := range runOptions {
+			for i, input := range test.inputs {
+				got := compileAndRun(t, test.source, options, input)
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("%s optimized %t on %v: got %v, want %v", test.name, options.peephole, input, got, test.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		inputs [][]int
+		want   [][]int
+	}{
+		{
+			// The return stub is patched by each call, so each returns
+			// to its own call site.
+			"procedure called from two places",
+			"func f(x: int) {\n    out x + 1\n}\nf(in)\nout 7\nf(in)\n",
+			[][]int{{1, 5}},
+			[][]int{{2, 7, 6}},
+		},
+		{
+			"returned value",
+			"func sub(a: int, b: int) int {\n    return a - b\n}\nout sub(in, in)\nout sub(9, 2) + 1\n",
+			[][]int{{8, 3}},
+			[][]int{{5, 8}},
+		},
+		{
+			"call in a loop",
+			"func double(x: int) int {\n    return x + x\n}\ni := 0\nwhile i < 3 {\n    out double(i)\n    i = i + 1\n}\n",
+			[][]int{{}},
+			[][]int{{0, 2, 4}},
+		},
+		{
+			"call from another function",
+			"func inc(x: int) int {\n    return x + 1\n}\nfunc twice(x: int) int {\n    return inc(inc(x))\n}\nout twice(in)\nout inc(0)\n",
+			[][]int{{4}},
+			[][]int{{6, 1}},
+		},
+		{
+			"return from inside a loop",
+			"func first(limit: int) int {\n    i := 0\n    while true {\n        if i * i > limit {\n            return i\n        }\n        i = i + 1\n    }\n    return 0\n}\nout first(in)\n",
+			[][]int{{10}, {0}},
+			[][]int{{4}, {1}},
+		},
+		{
+			"return without a value",
+			"func f(x: int) {\n    if x > 2 {\n        return\n    }\n    out x\n}\nf(in)\nf(in)\nout 9\n",
+			[][]int{{1, 5}, {6, 2}},
+			[][]int{{1, 9}, {2, 9}},
+		},
+		{
+			"assigning a parameter",
+			"func f(x: int) int {\n    x = x + 1\n    return x\n}\na := in\nout f(a)\nout a\n",
+			[][]int{{3}},
+			[][]int{{4, 3}},
+		},
+		{
+			"bool parameter and result",
+			"func pick(c: bool, a: int, b: int) int {\n    if c {\n        return a\n    }\n    return b\n}\nfunc small(x: int) bool {\n    return x < 10\n}\nx := in\nout pick(small(x), 1, 2)\n",
+			[][]int{{3}, {30}},
+			[][]int{{1}, {2}},
+		},
+		{
+			// The right operand and earlier arguments are read before the
+			// call assigns the variable.
+			"variable assigned by a later call",
+			"a := in\nfunc f() int {\n    a = 5\n    return 0\n}\nfunc first(x: int, y: int) int {\n    return x\n}\nout f() + a\na = 1\nout first(a, f())\nout a\n",
+			[][]int{{1}},
+			[][]int{{1, 1, 5}},
+		},
+		{
+			"index assigned by a later call",
+			"xs: [int; 2]\ni := 0\nfunc f() int {\n    i = 1\n    return 7\n}\nxs[i] = f()\nout xs[0]\nout xs[1]\n",
+			[][]int{{}},
+			[][]int{{7, 0}},
+		},
+	}
+	for _, test := range tests {
+		for _, options := range runOptions {
+			for i, input := range test.inputs {
+				got := compileAndRun(t, test.source, options, input)
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("%s optimized %t on %v: got %v, want %v", test.name, options.peephole, input, got, test.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// errors lists the code and line of each error.
+		errors []string
+	}{
+		{
+			"condition and bodies of an if",
+			"if b > 1 {\n    out c\n} else {\n    out d\n}\n",
+			[]string{"E011 1", "E011 2", "E011 4"},
+		},
+		{
+			"condition and body of a while",
+			"while e {\n    out f\n}\nout g\n",
+			[]string{"E011 1", "E011 2", "E011 4"},
+		},
+		{
+			"else after an earlier error",
+			"out x\nif true {\n    out 1\n} else {\n    out y\n}\n",
+			[]string{"E011 1", "E011 5"},
+		},
+		{
+			"condition that isn't a bool",
+			"a := 1\nif a {\n    out true\n}\n",
+			[]string{"E014 2", "E010 3"},
+		},
+		{
+			"body inside a function",
+			"func f(x: int) int {\n    while x {\n        return z\n    }\n    return 0\n}\n",
+			[]string{"E014 2", "E011 3"},
+		},
+		{
+			"undefined function",
+			"out g(1)\n",
+			[]string{"E015 1"},
+		},
+		{
+			"wrong number of arguments",
+			"func f(x: int) int {\n    return x\n}\nout f(1, 2)\nout f()\n",
+			[]string{"E016 4", "E016 5"},
+		},
+		{
+			"argument of the wrong type",
+			"func f(x: bool) int {\n    return 1\n}\nout f(2)\nb := f(true) and true\n",
+			[]string{"E010 4", "E014 5"},
+		},
+		{
+			"function declared twice",
+			"func f() {}\nfunc f() {}\n",
+			[]string{"E018 2"},
+		},
+		{
+			"function inside a block",
+			"if in > 1 {\n    func f() {}\n}\n",
+			[]string{"E017 2"},
+		},
+		{
+			"return outside of a function",
+			"return 1\n",
+			[]string{"E019 1"},
+		},
+		{
+			"mismatched returns",
+			"func f() int {\n    return\n}\nfunc g() {\n    return 1\n}\n",
+			[]string{"E020 2", "E020 5"},
+		},
+		{
+			"array without an index",
+			"xs: [int; 3]\nout xs\nxs = 1\n",
+			[]string{"E012 2", "E012 3"},
+		},
+		{
+			"indexing an int and with a bool",
+			"a := 1\nout a[0]\nxs: [bool; 2]\nout xs[true]\nxs[0] = 1\n",
+			[]string{"E013 2", "E010 4", "E010 5"},
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		_, errs := Compile(statements, Options{})
+		var errors []string
+		for _, err := range errs {
+			diag := err.(Diagnostic)
+			errors = append(errors, fmt.Sprintf("%s %d", diag.code, diag.primary.span.pos.line))
+		}
+		if !reflect.DeepEqual(errors, test.errors) {
+			t.Errorf("%s: got errors %v, want %v", test.name, errors, test.errors)
+		}
+	}
+}
+
+func TestArrays(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		inputs [][]int
+		want   [][]int
+	}{
+		{
+			"store and load",
+			"xs: [int; 4]\nxs[in] = in\nxs[3] = 8\nout xs[in]\nout xs[3]\n",
+			[][]int{{1, 5, 1}, {2, 5, 0}},
+			[][]int{{5, 8}, {0, 8}},
+		},
+		{
+			// Each access patches the same instruction, so the second
+			// must not reuse the address of the first.
+			"loads from two indexes",
+			"xs: [int; 3]\nxs[0] = 4\nxs[2] = 6\nout xs[0] + xs[2]\nout xs[in]\n",
+			[][]int{{2}},
+			[][]int{{10, 6}},
+		},
+		{
+			"reversing the input",
+			"xs: [int; 4]\ni := 0\nwhile i < 4 {\n    xs[i] = in\n    i = i + 1\n}\nwhile i > 0 {\n    i = i - 1\n    out xs[i]\n}\n",
+			[][]int{{1, 2, 3, 4}},
+			[][]int{{4, 3, 2, 1}},
+		},
+		{
+			"swapping two elements",
+			"xs: [int; 3]\nxs[0] = 1\nxs[1] = 2\nxs[2] = 3\na := in\nb := in\nt := xs[a]\nxs[a] = xs[b]\nxs[b] = t\nout xs[0]\nout xs[1]\nout xs[2]\n",
+			[][]int{{0, 2}, {1, 1}},
+			[][]int{{3, 2, 1}, {1, 2, 3}},
+		},
+		{
+			"array of bools",
+			"bs: [bool; 2]\nbs[1] = in > 5\nif bs[1] and not bs[0] {\n    out 1\n} else {\n    out 0\n}\n",
+			[][]int{{6}, {2}},
+			[][]int{{1}, {0}},
+		},
+		{
+			"array used in a function",
+			"xs: [int; 3]\nfunc set(i: int, v: int) {\n    xs[i] = v\n}\nset(1, in)\nout xs[1]\n",
+			[][]int{{42}},
+			[][]int{{42}},
+		},
+	}
+	for _, test := range tests {
+		for _, options := range runOptions {
+			for i, input := range test.inputs {
+				got := compileAndRun(t, test.source, options, input)
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("%s optimized %t on %v: got %v, want %v", test.name, options.peephole, input, got, test.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestBoundsCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		input  []int
+		// want is the output, ending with 999 and the index if the program
+		// halts in the trap.
+		want []int
+	}{
+		{"load in range", "xs: [int; 3]\nxs[2] = 5\nout xs[in]\n", []int{2}, []int{5}},
+		{"load past the end", "xs: [int; 3]\nout 1\nout xs[in]\nout 2\n", []int{3}, []int{1, 999, 3}},
+		{"store in range", "xs: [int; 3]\nxs[in] = 4\nout xs[0]\n", []int{0}, []int{4}},
+		{"store past the end", "xs: [int; 3]\nxs[in] = 4\nout 2\n", []int{7}, []int{999, 7}},
+	}
+	for _, test := range tests {
+		for _, options := range runOptions {
+			options.boundsCheck = true
+			got := compileAndRun(t, test.source, options, test.input)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s optimized %t: got %v, want %v", test.name, options.peephole, got, test.want)
+			}
+		}
+	}
+}
+
+func TestSigned(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// inputs and want are signed, and are converted to and from ten's
+		// complement around running the program.
+		inputs [][]int
+		want   [][]int
+	}{
+		{
+			"multiply",
+			"out in * in\n",
+			[][]int{{-7, 2}, {7, -2}, {-7, -2}, {0, -3}, {-20, 25}, {-500, -1}},
+			[][]int{{-14}, {-14}, {14}, {0}, {-500}, {-500}},
+		},
+		{
+			// Division rounds towards zero and the remainder takes the
+			// sign of the dividend.
+			"divide",
+			"a := in\nb := in\nout a / b\nout a % b\n",
+			[][]int{{-7, 2}, {7, -2}, {-7, -2}, {7, 2}, {499, 1}, {-500, -1}},
+			[][]int{{-3, -1}, {-3, 1}, {3, -1}, {3, 1}, {499, 0}, {-500, 0}},
+		},
+		{
+			"divide by zero",
+			"a := in\nb := in\nout a / b\nout a % b\n",
+			[][]int{{-7, 0}, {7, 0}},
+			[][]int{{0, -7}, {0, 7}},
+		},
+		{
+			"compare",
+			"a := in\nb := in\nif a < b { out 1 } else { out 0 }\nif a <= b { out 1 } else { out 0 }\nif a > b { out 1 } else { out 0 }\nif a >= b { out 1 } else { out 0 }\nif a == b { out 1 } else { out 0 }\n",
+			[][]int{{-1, 1}, {1, -1}, {-3, -3}, {-500, 499}, {499, -500}},
+			[][]int{{1, 1, 0, 0, 0}, {0, 0, 1, 1, 0}, {0, 1, 0, 1, 1}, {1, 1, 0, 0, 0}, {0, 0, 1, 1, 0}},
+		},
+		{
+			"negate, add and subtract",
+			"a := in\nb := in\nout -a\nout a + b\nout a - b\n",
+			[][]int{{-7, 2}, {499, 1}, {-500, 1}, {-500, -1}},
+			[][]int{{7, -5, -9}, {-499, -500, 498}, {-500, -499, 499}, {-500, 499, -499}},
+		},
+	}
+	// The signed division routine only fits in the mailboxes once layout
+	// has removed unreachable blocks and the branches it doesn't need.
+	options := []Options{{signed: true, layout: true}, {signed: true, peephole: true, layout: true, share: true}}
+	for _, test := range tests {
+		for _, options := range options {
+			for i, input := range test.inputs {
+				raw := []int{}
+				for _, value := range input {
+					raw = append(raw, (value+1000)%1000)
+				}
+				got := []int{}
+				for _, value := range compileAndRun(t, test.source, options, raw) {
+					if value >= SignedOffset {
+						value -= 1000
+					}
+					got = append(got, value)
+				}
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("%s optimized %t on %v: got %v, want %v", test.name, options.peephole, input, got, test.want[i])
+				}
+			}
+		}
+	}
+}
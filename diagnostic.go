@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	ErrorSeverity   Severity = iota
+	WarningSeverity Severity = iota
+)
+
+func (severity Severity) String() string {
+	if severity == WarningSeverity {
+		return "warning"
+	}
+	return "error"
+}
+
+// Span is a range of the source, which is empty for problems with the program
+// as a whole.
+type Span struct {
+	pos    Position
+	length int
+}
+
+func (expr Expr) span() Span {
+	return Span{expr.pos, expr.length}
+}
+
+func (statement Statement) span() Span {
+	return Span{statement.pos, statement.length}
+}
+
+func (span Span) empty() bool {
+	return span.pos.line == 0
+}
+
+// Label points out part of the source that explains a diagnostic.
+type Label struct {
+	span Span
+	text string
+}
+
+// Diagnostic is a problem found in the program. The primary label marks where
+// it is and the others point to related code, such as an earlier declaration.
+type Diagnostic struct {
+	severity Severity
+	code     string
+	msg      string
+	primary  Label
+	labels   []Label
+	help     string
+}
+
+func newError(code string, span Span, msg string) Diagnostic {
+	return Diagnostic{ErrorSeverity, code, msg, Label{span, ""}, nil, ""}
+}
+
+func (diag Diagnostic) withLabel(text string) Diagnostic {
+	diag.primary.text = text
+	return diag
+}
+
+func (diag Diagnostic) withNote(span Span, text string) Diagnostic {
+	diag.labels = append(diag.labels, Label{span, text})
+	return diag
+}
+
+func (diag Diagnostic) withHelp(help string) Diagnostic {
+	diag.help = help
+	return diag
+}
+
+func (diag Diagnostic) Error() string {
+	if diag.primary.span.empty() {
+		return diag.msg
+	}
+	return fmt.Sprintf("%s at %s", diag.msg, diag.primary.span.pos)
+}
+
+// render writes the diagnostic along with the lines of source it refers to,
+// with the primary span underlined by carets and the others by dashes.
+func (diag Diagnostic) render(w io.Writer, path, source string) {
+	fmt.Fprintf(w, "%s[%s]: %s\n", diag.severity, diag.code, diag.msg)
+	if diag.primary.span.empty() {
+		if diag.help != "" {
+			fmt.Fprintf(w, "  = help: %s\n", diag.help)
+		}
+		fmt.Fprintln(w)
+		return
+	}
+
+	pos := diag.primary.span.pos
+	lines := strings.Split(source, "\n")
+	type underline struct {
+		label Label
+		mark  string
+	}
+	underlines := []underline{{diag.primary, "^"}}
+	for _, label := range diag.labels {
+		underlines = append(underlines, underline{label, "-"})
+	}
+	sort.SliceStable(underlines, func(i, j int) bool {
+		return underlines[i].label.span.pos.index < underlines[j].label.span.pos.index
+	})
+	width := len(fmt.Sprint(underlines[len(underlines)-1].label.span.pos.line))
+	gutter := strings.Repeat(" ", width)
+
+	fmt.Fprintf(w, "%s--> %s:%d:%d\n", gutter, path, pos.line, pos.column)
+	fmt.Fprintf(w, "%s |\n", gutter)
+	previous := 0
+	for _, u := range underlines {
+		span := u.label.span
+		if span.pos.line < 1 || span.pos.line > len(lines) {
+			continue
+		}
+		line := strings.TrimRight(lines[span.pos.line-1], "\r")
+		if span.pos.line != previous {
+			if previous != 0 && span.pos.line > previous+1 {
+				fmt.Fprintf(w, "%s |\n", gutter)
+			}
+			fmt.Fprintf(w, "%*d | %s\n", width, span.pos.line, line)
+			previous = span.pos.line
+		}
+		fmt.Fprintf(w, "%s | %s\n", gutter, strings.TrimRight(underlineText(line, span, u.mark)+" "+u.label.text, " "))
+	}
+	if diag.help != "" {
+		fmt.Fprintf(w, "%s |\n", gutter)
+		fmt.Fprintf(w, "%s = help: %s\n", gutter, diag.help)
+	}
+	fmt.Fprintln(w)
+}
+
+// end returns the position just after the span, counting columns in runes as
+// the lexer does.
+func (span Span) end(source string) Position {
+	pos := span.pos
+	last := pos.index + span.length
+	if last > len(source) {
+		last = len(source)
+	}
+	for _, r := range source[pos.index:last] {
+		if r == '\n' {
+			pos.line++
+			pos.column = 1
+		} else {
+			pos.column++
+		}
+	}
+	pos.index += span.length
+	return pos
+}
+
+// jsonPosition is a line and column in the JSON diagnostics, both counted from
+// 1.
+type jsonPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type jsonLabel struct {
+	Start   *jsonPosition `json:"start,omitempty"`
+	End     *jsonPosition `json:"end,omitempty"`
+	Message string        `json:"message"`
+}
+
+type jsonDiagnostic struct {
+	File     string        `json:"file"`
+	Severity string        `json:"severity"`
+	Code     string        `json:"code"`
+	Message  string        `json:"message"`
+	Start    *jsonPosition `json:"start,omitempty"`
+	End      *jsonPosition `json:"end,omitempty"`
+	Labels   []jsonLabel   `json:"labels,omitempty"`
+	Help     string        `json:"help,omitempty"`
+}
+
+// jsonSpan gives the start and the end, just after the last character, of a
+// span, or nils for an empty span.
+func jsonSpan(span Span, source string) (*jsonPosition, *jsonPosition) {
+	if span.empty() {
+		return nil, nil
+	}
+	end := span.end(source)
+	return &jsonPosition{span.pos.line, span.pos.column}, &jsonPosition{end.line, end.column}
+}
+
+// writeDiagnosticsJSON writes the errors as a JSON list. Errors that aren't
+// diagnostics, such as those from linking, have no code or position.
+func writeDiagnosticsJSON(w io.Writer, errors []error, path, source string) error {
+	diags := []jsonDiagnostic{}
+	for _, err := range errors {
+		diag, ok := err.(Diagnostic)
+		if !ok {
+			diags = append(diags, jsonDiagnostic{File: path, Severity: ErrorSeverity.String(), Message: err.Error()})
+			continue
+		}
+		out := jsonDiagnostic{File: path, Severity: diag.severity.String(), Code: diag.code, Message: diag.msg, Help: diag.help}
+		out.Start, out.End = jsonSpan(diag.primary.span, source)
+		for _, label := range diag.labels {
+			start, end := jsonSpan(label.span, source)
+			out.Labels = append(out.Labels, jsonLabel{start, end, label.text})
+		}
+		diags = append(diags, out)
+	}
+	encoded, err := json.MarshalIndent(diags, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", encoded)
+	return err
+}
+
+// underlineText lines up marks under the span, keeping tabs so that they
+// take up the same width as in the line above. Spans that go past the end of
+// the line are cut off there, and empty ones get a single mark.
+func underlineText(line string, span Span, mark string) string {
+	runes := []rune(line)
+	start := span.pos.column - 1
+	if start > len(runes) {
+		start = len(runes)
+	}
+	builder := strings.Builder{}
+	for _, r := range runes[:start] {
+		if r == '\t' {
+			builder.WriteRune('\t')
+		} else {
+			builder.WriteRune(' ')
+		}
+	}
+	// The length of a span is in bytes, so count the runes it covers.
+	length := 0
+	for i := range string(runes[start:]) {
+		if i >= span.length {
+			break
+		}
+		length++
+	}
+	if length == 0 {
+		length = 1
+	}
+	builder.WriteString(strings.Repeat(mark, length))
+	return builder.String()
+}
+
+// explanations describes each error code for `lmcc explain`.
+var explanations = map[string]string{
+	"E001": `unexpected character
+
+The source contains a character that isn't part of the language, such as '$'
+or '&'. Names are made of letters and digits, and the only symbols are the
+operators + - * / % == != < <= > >= = and the punctuation ( ) [ ] { } , : ;`,
+
+	"E002": `unterminated block comment
+
+A comment starting with /* has no matching */, so it runs to the end of the
+file. Close it, or use // for a comment that ends with the line.`,
+
+	"E003": `expected a symbol
+
+A piece of punctuation is missing, such as the ']' after an index, the ')'
+closing a parenthesised expression, the '}' at the end of a block or the ','
+between arguments. For example
+
+    out xs[1
+
+should be
+
+    out xs[1]`,
+
+	"E004": `expected a value
+
+An expression is missing where one is needed, such as after an operator or
+an '=', or the expression starts with something that can't begin one.
+
+    x := 3 +
+
+needs something to add, such as
+
+    x := 3 + 1`,
+
+	"E005": `expected a statement
+
+A statement can't start here. Statements are declarations (x := 1 or
+x: int), assignments (x = 2 or xs[i] = 2), calls, if, while, out, return,
+func and blocks in braces.`,
+
+	"E006": `unmatched closing bracket
+
+There is a '}' or ')' with nothing open for it to close, which usually means
+there is one too many or an opening bracket is missing earlier on.`,
+
+	"E007": `invalid type
+
+Types are written as int or bool. Arrays are declared with the element type
+and length, as in
+
+    xs: [int; 10]`,
+
+	"E008": `invalid array length
+
+An array declaration needs a length that is a positive integer literal, as
+in
+
+    xs: [int; 10]
+
+The length can't be more than 100, as each element takes a mailbox.`,
+
+	"E009": `invalid function declaration
+
+A function is declared with its name, parameters with their types and an
+optional return type before its body:
+
+    func max(a: int, b: int) int {
+        if a > b {
+            return a
+        }
+        return b
+    }`,
+
+	"E010": `mismatched types
+
+A value has a different type to the one that is needed, such as a bool in
+arithmetic, an int assigned to a bool variable or an argument of the wrong
+type. Integers and bools can't be converted into each other, but a bool can
+be made from an int with a comparison:
+
+    big := x > 100`,
+
+	"E011": `undefined variable
+
+A variable is used that hasn't been declared, or was declared in a block that
+has already ended. Variables are declared with a value or a type before they
+are used:
+
+    x := 0
+    y: bool`,
+
+	"E012": `array used without an index
+
+An array holds several values, so it can only be read or assigned one element
+at a time:
+
+    xs[0] = 5
+    out xs[0]`,
+
+	"E013": `indexing a variable that isn't an array
+
+Only arrays can be indexed. Arrays are declared with their element type and
+length:
+
+    xs: [int; 10]`,
+
+	"E014": `condition isn't a bool
+
+The conditions of if and while, and the operands of and, or and not, must be
+bools. An int can be turned into one by comparing it:
+
+    while n != 0 {
+        n = n - 1
+    }`,
+
+	"E015": `undefined function
+
+A function is called that hasn't been declared. Functions must be declared at
+the top level before the code that calls them, and can't call themselves.`,
+
+	"E016": `wrong number of arguments
+
+A function is called with more or fewer arguments than it has parameters.`,
+
+	"E017": `function declared inside a block
+
+Functions can only be declared at the top level of the program, not inside
+a block, an if, a while or another function.`,
+
+	"E018": `function declared twice
+
+Two functions have the same name. Each function needs a name of its own.`,
+
+	"E019": `return outside of a function
+
+return can only be used inside a function. The main program ends when it
+reaches the end of the file.`,
+
+	"E020": `mismatched return
+
+A return gives a value in a function without a return type, or leaves the
+value out in a function that has one. The return type is written after the
+parameters:
+
+    func double(x: int) int {
+        return x * 2
+    }`,
+
+	"E021": `integer too big
+
+Integers go from 0 to 999 so that they fit in the three digits of a
+mailbox. With -signed, they go from -500 to 499 instead, to leave room for
+their sign. Literals outside that range are errors.`,
+
+	"E022": `program too big
+
+The compiled program needs more than the 100 mailboxes of the Little Man
+Computer for its code, variables, constants and temporaries. The -memory
+flag shows what each statement uses, which helps to find the parts worth
+simplifying, and leaving the optimizations turned on saves mailboxes.`,
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// checkDiagnosticsJSON writes the errors as JSON and compares them with want,
+// ignoring the indentation.
+func checkDiagnosticsJSON(t *testing.T, name string, errs []error, source, want string) {
+	t.Helper()
+	out := bytes.Buffer{}
+	if err := writeDiagnosticsJSON(&out, errs, "a.txt", source); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	got := bytes.Buffer{}
+	if err := json.Compact(&got, out.Bytes()); err != nil {
+		t.Fatalf("%s: %s in %s", name, err, out.String())
+	}
+	if got.String() != want {
+		t.Errorf("%s: got\n%s\nwant\n%s", name, got.String(), want)
+	}
+}
+
+func TestDiagnosticsJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"no errors", "out 1\n", `[]`},
+		{
+			"parse error",
+			"xs: [int; 3\n",
+			`[{"file":"a.txt","severity":"error","code":"E003","message":"expected a ']'",` +
+				`"start":{"line":1,"column":12},"end":{"line":1,"column":12}}]`,
+		},
+		{
+			// Columns count runes, so the end is two columns after the
+			// start of a two rune name even though é is two bytes.
+			"multi-byte runes",
+			"/* é */ out xé\nout yy\n",
+			`[{"file":"a.txt","severity":"error","code":"E011","message":"undefined variable 'xé'",` +
+				`"start":{"line":1,"column":13},"end":{"line":1,"column":15},` +
+				`"help":"variables must be declared before they are used, such as with 'xé := 0'"},` +
+				`{"file":"a.txt","severity":"error","code":"E011","message":"undefined variable 'yy'",` +
+				`"start":{"line":2,"column":5},"end":{"line":2,"column":7},` +
+				`"help":"variables must be declared before they are used, such as with 'yy := 0'"}]`,
+		},
+		{
+			"labels",
+			"func f() {}\nfunc f() {}\n",
+			`[{"file":"a.txt","severity":"error","code":"E018","message":"function 'f' is already declared",` +
+				`"start":{"line":2,"column":1},"end":{"line":2,"column":12},` +
+				`"labels":[{"start":{"line":1,"column":1},"end":{"line":1,"column":12},"message":"first declared here"}]}]`,
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		var errs []error
+		for _, diag := range diagnostics {
+			errs = append(errs, diag)
+		}
+		if len(diagnostics) == 0 {
+			_, errs = Compile(statements, Options{})
+		}
+		checkDiagnosticsJSON(t, test.name, errs, test.source, test.want)
+	}
+}
+
+func TestDiagnosticsJSONWithoutPosition(t *testing.T) {
+	errs := []error{
+		newError("E022", Span{}, "program needs 120 mailboxes"),
+		errors.New("undefined label 'x'"),
+	}
+	want := `[{"file":"a.txt","severity":"error","code":"E022","message":"program needs 120 mailboxes"},` +
+		`{"file":"a.txt","severity":"error","code":"","message":"undefined label 'x'"}]`
+	checkDiagnosticsJSON(t, "without position", errs, "out 1\n", want)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// Trace is what a run of a program output and how it ended.
+type Trace struct {
+	output []int
+	ending string
+}
+
+func (trace Trace) String() string {
+	values := []string{}
+	for _, value := range trace.output {
+		values = append(values, fmt.Sprint(value))
+	}
+	if len(values) == 0 {
+		return fmt.Sprintf("no output (%s)", trace.ending)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(values, ", "), trace.ending)
+}
+
+// Mismatch is an input the compiled program and the interpreter disagree on.
+type Mismatch struct {
+	input       []int
+	compiled    Trace
+	interpreted Trace
+}
+
+// DiffTester runs a compiled program on the simulator and its source on the
+// interpreter, and compares what they output. Integers are given and output
+// as the interpreter sees them, so they are negative in signed mode.
+type DiffTester struct {
+	statements []Statement
+	memory     [MailboxCount]int
+	signed     bool
+	steps      int
+}
+
+// machineStepsPerStatement is how many instructions the simulator is allowed
+// for each statement the interpreter may execute, as a single statement can
+// run a multiplication or division loop hundreds of times.
+const machineStepsPerStatement = 1000
+
+// compare runs both on the input. A run is inconclusive, and not a mismatch,
+// when the interpreter doesn't finish or stops on an error that the compiled
+// program doesn't check for, such as an index out of range.
+func (tester *DiffTester) compare(input []int) (*Mismatch, bool) {
+	interpreted := Trace{}
+	output, err := Interpret(tester.statements, append([]int{}, input...), tester.signed, tester.steps)
+	interpreted.output = output
+	if _, ok := err.(Diagnostic); ok {
+		interpreted.ending = err.Error()
+	} else if err != nil && !errors.Is(err, errNoInput) {
+		return nil, false
+	} else {
+		interpreted.ending = ending(err)
+	}
+
+	raw := []int{}
+	for _, value := range input {
+		raw = append(raw, wrap(value))
+	}
+	machine := InitMachine(tester.memory, raw)
+	err = machine.run(tester.steps * machineStepsPerStatement)
+	compiled := Trace{[]int{}, ending(err)}
+	for _, value := range machine.output {
+		if tester.signed && value >= SignedOffset {
+			value -= 1000
+		}
+		compiled.output = append(compiled.output, value)
+	}
+
+	if compiled.String() != interpreted.String() {
+		return &Mismatch{input, compiled, interpreted}, true
+	}
+	return nil, true
+}
+
+// ending describes how a run ended, where running out of input is the same on
+// both.
+func ending(err error) string {
+	switch {
+	case err == nil:
+		return "halted"
+	case errors.Is(err, errNoInput):
+		return "ran out of input"
+	default:
+		return err.Error()
+	}
+}
+
+// generateInputs makes count values, favouring those at the ends of the
+// range and small ones as they are the most likely to find a mistake.
+func generateInputs(rng *rand.Rand, count int, signed bool) []int {
+	low, high := 0, 999
+	if signed {
+		low, high = -SignedOffset, SignedOffset-1
+	}
+	input := []int{}
+	for i := 0; i < count; i++ {
+		var value int
+		switch rng.Intn(4) {
+		case 0:
+			edges := []int{low, low + 1, 0, 1, high - 1, high}
+			value = edges[rng.Intn(len(edges))]
+		case 1:
+			value = rng.Intn(20)
+			if signed && rng.Intn(2) == 0 {
+				value = -value
+			}
+		default:
+			value = low + rng.Intn(high-low+1)
+		}
+		input = append(input, value)
+	}
+	return input
+}
+
+func formatInput(input []int) string {
+	values := []string{}
+	for _, value := range input {
+		values = append(values, fmt.Sprint(value))
+	}
+	return strings.Join(values, ",")
+}
+
+// difftestCommand compiles each file and checks that it outputs the same as
+// the interpreter on many inputs, reporting the first input they disagree on.
+func difftestCommand(args []string) {
+	flags := flag.NewFlagSet("difftest", flag.ExitOnError)
+	vectors := flags.Int("vectors", 100, "the number of inputs to try on each program")
+	length := flags.Int("inputs", 10, "the number of values in each input")
+	seed := flags.Int64("seed", 1, "the seed for generating inputs")
+	steps := flags.Int("steps", 10000, "the number of statements the interpreter executes before a run is given up on")
+	signed := flags.Bool("signed", false, "whether integers go from -500 to 499 instead of 0 to 999")
+	fold := flags.Bool("fold", true, "whether to fold constant expressions before compiling")
+	peephole := flags.Bool("peephole", true, "whether to run the peephole optimizer")
+	layout := flags.Bool("layout", true, "whether to remove unreachable blocks and reorder blocks to avoid branches")
+	share := flags.Bool("share", true, "whether to share mailboxes between temporaries and local variables whose lifetimes don't overlap")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Println("no source file")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		source := string(data)
+		statements, parseErrors := Parse(source)
+		if len(parseErrors) > 0 {
+			for _, diag := range parseErrors {
+				diag.render(os.Stdout, path, source)
+			}
+			failed = true
+			continue
+		}
+		ast := statements
+		if *fold {
+			ast = Fold(ast, *signed)
+		}
+		asm, errors := Compile(ast, Options{peephole: *peephole, layout: *layout, share: *share, signed: *signed})
+		image := Image{}
+		if len(errors) == 0 {
+			image, errors = asm.link()
+		}
+		if len(errors) > 0 {
+			printErrors(errors, path, source, "human")
+			failed = true
+			continue
+		}
+
+		tester := DiffTester{statements, image.memory, *signed, *steps}
+		rng := rand.New(rand.NewSource(*seed))
+		inconclusive := 0
+		var mismatch *Mismatch
+		for i := 0; i < *vectors && mismatch == nil; i++ {
+			var conclusive bool
+			mismatch, conclusive = tester.compare(generateInputs(rng, *length, *signed))
+			if !conclusive {
+				inconclusive++
+			}
+		}
+		if mismatch != nil {
+			fmt.Printf("%s: mismatch with input %s\n", path, formatInput(mismatch.input))
+			fmt.Printf("  compiled:    %s\n", mismatch.compiled)
+			fmt.Printf("  interpreter: %s\n", mismatch.interpreted)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok, %d inputs agree", path, *vectors-inconclusive)
+		if inconclusive > 0 {
+			fmt.Printf(" and %d were inconclusive", inconclusive)
+		}
+		fmt.Println()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
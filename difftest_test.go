@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDiffTest(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// code is the error both the compiler and the interpreter give, or
+		// "" if the program compiles.
+		code string
+	}{
+		{
+			"variable after a call that assigns it",
+			"a := 0\nfunc f() int {\n    a = 5\n    return 1\n}\nout f() + a\na = in\nif f() >= a {\n    out 1\n}\n",
+			"",
+		},
+		{
+			"argument after a call that assigns it",
+			"a := in\nfunc f() int {\n    a = 5\n    return 1\n}\nfunc g(x: int, y: int) int {\n    return x - y\n}\nout g(a, f())\n",
+			"",
+		},
+		{
+			"index after a call that assigns it",
+			"a := 0\nxs: [int; 6]\nfunc f() int {\n    a = 3\n    return 9\n}\nxs[a] = f()\nout xs[0]\nout xs[3]\n",
+			"",
+		},
+		{
+			"uninitialized declaration in a loop",
+			"i := 0\nwhile i < 3 {\n    x: int\n    out x\n    x = 7\n    i = i + 1\n}\n",
+			"",
+		},
+		{
+			"uninitialized declaration in a function",
+			"func f() int {\n    x: int\n    out x\n    x = in\n    return x\n}\nout f()\nout f()\n",
+			"",
+		},
+		{
+			"array declared in a loop",
+			"i := 0\nwhile i < 3 {\n    xs: [int; 2]\n    out xs[1]\n    xs[1] = xs[1] + 5\n    i = i + 1\n}\n",
+			"",
+		},
+		{
+			"declaration as the body of an if",
+			"a := in\nif a > 3\n    x: int\nout x\n",
+			"",
+		},
+		{
+			"declaration as the body of an else",
+			"a := in\nif a > 3\n    out a\nelse\n    x := 4\nx := 1\nout x\n",
+			"",
+		},
+		{
+			"function as the body of an if that folds",
+			"if true\n    func f() {}\nout 1\n",
+			"",
+		},
+		{
+			"function as the body of an if that doesn't run",
+			"a := in\nif a > 3\n    func f() {}\nf()\nout a\n",
+			"",
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		asm, errors := Compile(Fold(statements, false), Options{peephole: true, layout: true, share: true})
+		if test.code != "" {
+			if len(errors) == 0 || errors[0].(Diagnostic).code != test.code {
+				t.Errorf("%s: compiling gave %v, want %s", test.name, errors, test.code)
+			}
+			_, err := Interpret(statements, []int{5}, false, 1000)
+			if diag, ok := err.(Diagnostic); !ok || diag.code != test.code {
+				t.Errorf("%s: interpreting gave %v, want %s", test.name, err, test.code)
+			}
+			continue
+		}
+		if len(errors) > 0 {
+			t.Fatalf("%s: %s", test.name, errors[0])
+		}
+		image, errors := asm.link()
+		if len(errors) > 0 {
+			t.Fatalf("%s: %s", test.name, errors[0])
+		}
+		tester := DiffTester{statements, image.memory, false, 1000}
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 20; i++ {
+			mismatch, conclusive := tester.compare(generateInputs(rng, 3, false))
+			if mismatch != nil {
+				t.Errorf("%s: on %v compiled output %s but the interpreter %s", test.name, mismatch.input, mismatch.compiled, mismatch.interpreted)
+				break
+			}
+			if !conclusive {
+				t.Errorf("%s: run was inconclusive", test.name)
+				break
+			}
+		}
+	}
+}
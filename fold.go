@@ -0,0 +1,370 @@
+package main
+
+// Fold evaluates constant subexpressions, simplifies identities such as
+// `x + 0` and `not not b`, and removes the branches of if and while
+// statements whose conditions are constant. Types are tracked with a Scope
+// in the same way as Compile, so an identity is only simplified when it
+// wouldn't hide a type error. In signed mode integers go from -500 to 499.
+func Fold(statements []Statement, signed bool) []Statement {
+	scope := InitScope()
+	scope.signed = signed
+	return foldStatements(statements, &scope)
+}
+
+func foldStatements(statements []Statement, scope *Scope) []Statement {
+	folded := []Statement{}
+	for _, statement := range statements {
+		folded = append(folded, foldStatement(statement, scope))
+	}
+	return folded
+}
+
+func emptyStatement(statement Statement) Statement {
+	return Statement{statement.pos, statement.length, BlockScope{[]Statement{}}, statement.comments}
+}
+
+// replaceStatement swaps a statement for one of its branches, keeping the
+// comments attached to the original.
+func replaceStatement(statement, branch Statement) Statement {
+	if branch.node == nil {
+		return emptyStatement(statement)
+	}
+	branch.comments = append(statement.comments, branch.comments...)
+	return branch
+}
+
+// isBareDeclaration reports whether removing a branch would remove a
+// declaration of a variable or function from the enclosing scope, as the
+// branches of if and while statements don't get a scope of their own.
+func isBareDeclaration(statement Statement) bool {
+	switch statement.node.(type) {
+	case Declare, Function:
+		return true
+	}
+	return false
+}
+
+func foldStatement(statement Statement, scope *Scope) Statement {
+	switch node := statement.node.(type) {
+	case Declare:
+		if node.expr.node != nil {
+			node.expr = foldExpr(node.expr, scope)
+		}
+		ty := node.ty
+		if node.size > 0 {
+			ty = node.ty.arrayOf()
+		} else if node.expr.node != nil && ty == Undefined {
+			ty = typeOf(node.expr, scope)
+		}
+		scope.declare(node.name, "", ty, node.size, Span{})
+		statement.node = node
+	case Assign:
+		node.expr = foldExpr(node.expr, scope)
+		statement.node = node
+	case AssignIndex:
+		node.index = foldExpr(node.index, scope)
+		node.expr = foldExpr(node.expr, scope)
+		statement.node = node
+	case BlockScope:
+		scope.pushScope()
+		node.statements = foldStatements(node.statements, scope)
+		scope.popScope()
+		statement.node = node
+	case If:
+		node.cond = foldExpr(node.cond, scope)
+		if literal, ok := node.cond.node.(BoolLiteral); ok {
+			if literal.value && !isBareDeclaration(node.ifFalse) {
+				return replaceStatement(statement, foldStatement(node.ifTrue, scope))
+			}
+			if !literal.value && !isBareDeclaration(node.ifTrue) {
+				if node.ifFalse.node == nil {
+					return emptyStatement(statement)
+				}
+				return replaceStatement(statement, foldStatement(node.ifFalse, scope))
+			}
+		}
+		node.ifTrue = foldStatement(node.ifTrue, scope)
+		if node.ifFalse.node != nil {
+			node.ifFalse = foldStatement(node.ifFalse, scope)
+		}
+		statement.node = node
+	case While:
+		node.cond = foldExpr(node.cond, scope)
+		if literal, ok := node.cond.node.(BoolLiteral); ok && !literal.value && !isBareDeclaration(node.loop) {
+			return emptyStatement(statement)
+		}
+		node.loop = foldStatement(node.loop, scope)
+		statement.node = node
+	case Output:
+		node.expr = foldExpr(node.expr, scope)
+		statement.node = node
+	case Function:
+		scope.pushScope()
+		params := []Type{}
+		for _, param := range node.params {
+			scope.declare(param.name, "", param.ty, 0, Span{})
+			params = append(params, param.ty)
+		}
+		node.body = foldStatement(node.body, scope)
+		scope.popScope()
+		scope.functions[node.name] = &Signature{params: params, ret: node.ret}
+		statement.node = node
+	case CallStatement:
+		node.call = foldExpr(node.call, scope)
+		statement.node = node
+	case Return:
+		if node.expr.node != nil {
+			node.expr = foldExpr(node.expr, scope)
+		}
+		statement.node = node
+	}
+	return statement
+}
+
+// typeOf works out the type of an expression without compiling it, returning
+// Undefined when it can't be known or the expression wouldn't type check, so
+// that folding never removes an operand Compile would report an error for.
+func typeOf(expr Expr, scope *Scope) Type {
+	switch node := expr.node.(type) {
+	case IntLiteral, Input:
+		return Int
+	case BoolLiteral:
+		return Bool
+	case Ident:
+		if _, ty, prs := scope.get(node.name); prs {
+			return ty
+		}
+	case Index:
+		if _, ty, prs := scope.get(node.name); prs && ty.isArray() && typeOf(node.index, scope) == Int {
+			return ty.elem()
+		}
+	case Call:
+		if sig, prs := scope.functions[node.name]; prs {
+			return sig.ret
+		}
+	case Binary:
+		left, right := typeOf(node.left, scope), typeOf(node.right, scope)
+		switch node.symbol {
+		case "+", "-", "*", "/", "%":
+			if left == Int && right == Int {
+				return Int
+			}
+		case "==", "!=", "<", "<=", ">", ">=":
+			if left == Int && right == Int {
+				return Bool
+			}
+		case "and", "or":
+			if left == Bool && right == Bool {
+				return Bool
+			}
+		}
+	case Unary:
+		inner := typeOf(node.expr, scope)
+		if node.symbol == "-" && inner == Int {
+			return Int
+		}
+		if node.symbol == "not" && inner == Bool {
+			return Bool
+		}
+	}
+	return Undefined
+}
+
+// isPure reports whether evaluating the expression has no effects, so it can
+// be removed without changing what the program does. Indexing, addition,
+// subtraction and negation can halt in the traps of -bounds-check and
+// -check-overflow, so they are never pure.
+func isPure(expr Expr) bool {
+	switch node := expr.node.(type) {
+	case Input, Call, Index:
+		return false
+	case Binary:
+		if node.symbol == "+" || node.symbol == "-" {
+			return false
+		}
+		return isPure(node.left) && isPure(node.right)
+	case Unary:
+		if node.symbol == "-" {
+			return false
+		}
+		return isPure(node.expr)
+	}
+	return true
+}
+
+func isIntLiteral(expr Expr, value int) bool {
+	literal, ok := expr.node.(IntLiteral)
+	return ok && literal.value == value
+}
+
+func foldExpr(expr Expr, scope *Scope) Expr {
+	switch node := expr.node.(type) {
+	case Index:
+		node.index = foldExpr(node.index, scope)
+		expr.node = node
+	case Call:
+		args := []Expr{}
+		for _, arg := range node.args {
+			args = append(args, foldExpr(arg, scope))
+		}
+		node.args = args
+		expr.node = node
+	case Unary:
+		node.expr = foldExpr(node.expr, scope)
+		expr.node = node
+		return foldUnary(expr, node, scope)
+	case Binary:
+		node.left = foldExpr(node.left, scope)
+		node.right = foldExpr(node.right, scope)
+		expr.node = node
+		return foldBinary(expr, node, scope)
+	}
+	return expr
+}
+
+func foldUnary(expr Expr, unary Unary, scope *Scope) Expr {
+	switch inner := unary.expr.node.(type) {
+	case IntLiteral:
+		if unary.symbol == "-" && (inner.value == 0 || (scope.signed && inner.value <= SignedOffset)) {
+			return Expr{expr.pos, expr.length, IntLiteral{-inner.value}}
+		}
+	case BoolLiteral:
+		if unary.symbol == "not" {
+			return Expr{expr.pos, expr.length, BoolLiteral{!inner.value}}
+		}
+	case Unary:
+		if unary.symbol == "not" && inner.symbol == "not" && typeOf(inner.expr, scope) == Bool {
+			return inner.expr
+		}
+	}
+	return expr
+}
+
+func foldBinary(expr Expr, bin Binary, scope *Scope) Expr {
+	left, leftIsInt := bin.left.node.(IntLiteral)
+	right, rightIsInt := bin.right.node.(IntLiteral)
+	if leftIsInt && rightIsInt {
+		if node, ok := evaluateBinary(bin.symbol, left.value, right.value, scope.signed); ok {
+			return Expr{expr.pos, expr.length, node}
+		}
+		return expr
+	}
+
+	leftBool, leftIsBool := bin.left.node.(BoolLiteral)
+	rightBool, rightIsBool := bin.right.node.(BoolLiteral)
+	isInt := func(e Expr) bool { return typeOf(e, scope) == Int }
+	isBool := func(e Expr) bool { return typeOf(e, scope) == Bool }
+	zero := Expr{expr.pos, expr.length, IntLiteral{0}}
+
+	switch bin.symbol {
+	case "+":
+		if isIntLiteral(bin.right, 0) && isInt(bin.left) {
+			return bin.left
+		}
+		if isIntLiteral(bin.left, 0) && isInt(bin.right) {
+			return bin.right
+		}
+	case "-":
+		if isIntLiteral(bin.right, 0) && isInt(bin.left) {
+			return bin.left
+		}
+	case "*":
+		if isIntLiteral(bin.right, 1) && isInt(bin.left) {
+			return bin.left
+		}
+		if isIntLiteral(bin.left, 1) && isInt(bin.right) {
+			return bin.right
+		}
+		if (isIntLiteral(bin.right, 0) && isInt(bin.left) && isPure(bin.left)) ||
+			(isIntLiteral(bin.left, 0) && isInt(bin.right) && isPure(bin.right)) {
+			return zero
+		}
+	case "/":
+		if isIntLiteral(bin.right, 1) && isInt(bin.left) {
+			return bin.left
+		}
+	case "%":
+		if isIntLiteral(bin.right, 1) && isInt(bin.left) && isPure(bin.left) {
+			return zero
+		}
+	case "and":
+		// The right side is only evaluated when the left is true.
+		if leftIsBool && isBool(bin.right) {
+			if leftBool.value {
+				return bin.right
+			}
+			return bin.left
+		}
+		if rightIsBool && rightBool.value && isBool(bin.left) {
+			return bin.left
+		}
+		if rightIsBool && !rightBool.value && isBool(bin.left) && isPure(bin.left) {
+			return bin.right
+		}
+	case "or":
+		if leftIsBool && isBool(bin.right) {
+			if leftBool.value {
+				return bin.left
+			}
+			return bin.right
+		}
+		if rightIsBool && !rightBool.value && isBool(bin.left) {
+			return bin.left
+		}
+		if rightIsBool && rightBool.value && isBool(bin.left) && isPure(bin.left) {
+			return bin.right
+		}
+	}
+	return expr
+}
+
+// evaluateBinary computes an operator applied to two integer literals. It
+// fails when either literal or the result is outside the range 0 to 999, or
+// -500 to 499 in signed mode, leaving whatever the machine does to happen at
+// runtime. Division truncates towards zero and the remainder takes the sign
+// of the dividend, as it does at runtime.
+func evaluateBinary(symbol string, left, right int, signed bool) (ExprNode, bool) {
+	min, max := 0, 999
+	if signed {
+		min, max = -SignedOffset, SignedOffset-1
+	}
+	if left < min || left > max || right < min || right > max {
+		return nil, false
+	}
+	value := 0
+	switch symbol {
+	case "+":
+		value = left + right
+	case "-":
+		value = left - right
+	case "*":
+		value = left * right
+	case "/":
+		if right != 0 {
+			value = left / right
+		}
+	case "%":
+		value = left
+		if right != 0 {
+			value = left % right
+		}
+	case "==":
+		return BoolLiteral{left == right}, true
+	case "!=":
+		return BoolLiteral{left != right}, true
+	case "<":
+		return BoolLiteral{left < right}, true
+	case "<=":
+		return BoolLiteral{left <= right}, true
+	case ">":
+		return BoolLiteral{left > right}, true
+	case ">=":
+		return BoolLiteral{left >= right}, true
+	default:
+		return nil, false
+	}
+	if value < min || value > max {
+		return nil, false
+	}
+	return IntLiteral{value}, true
+}
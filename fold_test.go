@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// foldSource folds a program and pretty prints the result.
+func foldSource(t *testing.T, source string, signed bool) string {
+	t.Helper()
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		t.Fatalf("parse: %s", diagnostics[0])
+	}
+	builder := strings.Builder{}
+	for _, statement := range Fold(statements, signed) {
+		statement.prettyPrint(&builder, "")
+	}
+	return builder.String()
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		signed bool
+		want   string
+	}{
+		{
+			"constant arithmetic",
+			"out 2 + 3 * 4\nout 7 / 2\nout 7 % 2\nout 7 / 0\nout 7 % 0\n",
+			false,
+			"out 14\nout 3\nout 1\nout 0\nout 7\n",
+		},
+		{
+			"results out of range",
+			"out 999 + 1\nout 1 - 2\nout 500 * 2\n",
+			false,
+			"out (999 + 1)\nout (1 - 2)\nout (500 * 2)\n",
+		},
+		{
+			"signed arithmetic",
+			"out -5 * 2\nout -7 / 2\nout -7 % 2\nout -500\nout 250 + 250\n",
+			true,
+			"out -10\nout -3\nout -1\nout -500\nout (250 + 250)\n",
+		},
+		{
+			"comparisons",
+			"a := 1 < 2\nb := 2 != 2\nc := 3 >= 4\nd := not 1 == 1\n",
+			false,
+			"a := true\nb := false\nc := false\nd := false\n",
+		},
+		{
+			"arithmetic identities",
+			"a := in\nout a + 0\nout 0 + a\nout a - 0\nout a * 1\nout 1 * a\nout a / 1\n",
+			false,
+			"a := in\nout a\nout a\nout a\nout a\nout a\nout a\n",
+		},
+		{
+			"products with zero and remainders of one",
+			"a := in\nout a * 0\nout 0 * a\nout a % 1\nout a * 2 * 0\n",
+			false,
+			"a := in\nout 0\nout 0\nout 0\nout 0\n",
+		},
+		{
+			// Each of these operands has an effect, or can halt in the
+			// trap of -bounds-check or -check-overflow.
+			"operands with effects",
+			"xs: [int; 3]\na := in\nout in * 0\nout xs[a] * 0\nout xs[0] % 1\nout -a * 0\nb := false and a + 1 > 2\nc := a - 1 < 2 or true\n",
+			false,
+			"xs : [int; 3]\na := in\nout (in * 0)\nout (xs[a] * 0)\nout (xs[0] % 1)\nout ((- a) * 0)\nb := false\nc := (((a - 1) < 2) or true)\n",
+		},
+		{
+			"bool identities",
+			"a := in > 1\nb := true and a\nc := false and a\nd := a and true\ne := a and false\nf := true or a\ng := false or a\nh := a or false\ni := a or true\nj := not not a\n",
+			false,
+			"a := (in > 1)\nb := a\nc := false\nd := a\ne := false\nf := true\ng := a\nh := a\ni := true\nj := a\n",
+		},
+		{
+			"bool operands with effects",
+			"a := in > 1 and false\nb := in > 1 or true\nc := false and in > 1\n",
+			false,
+			"a := ((in > 1) and false)\nb := ((in > 1) or true)\nc := false\n",
+		},
+		{
+			// Removing an operand that doesn't type check would hide the
+			// error Compile reports for it.
+			"operands that don't type check",
+			"a := true\nout a + 0\nout a * 2 % 1\nb := false and 1 == true\nc := true or 1\nd := not not 1\nout xs[0] * 0\nout e * 0\n",
+			false,
+			"a := true\nout (a + 0)\nout ((a * 2) % 1)\nb := (false and (1 == true))\nc := (true or 1)\nd := (not (not 1))\nout (xs[0] * 0)\nout (e * 0)\n",
+		},
+		{
+			"constant conditions",
+			"if 1 < 2 {\n    out 1\n} else {\n    out 2\n}\nif false {\n    out 3\n}\nwhile false {\n    out 4\n}\nif false\n    out 5\nelse\n    out 6\nout 7\n",
+			false,
+			"{\n    out 1\n}\n{\n}\n{\n}\nout 6\nout 7\n",
+		},
+		{
+			// A declaration in an unbraced branch is in the enclosing
+			// scope, so the branch can't be removed.
+			"declaration in a branch",
+			"if false\n    a := 1\nif true\n    out 1\nelse\n    func f() {}\nout 2\n",
+			false,
+			"if false\na := 1\n\nif true\nout 1\nelse\nfunc f()\n{\n}\n\n\nout 2\n",
+		},
+	}
+	for _, test := range tests {
+		if got := foldSource(t, test.source, test.signed); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestFoldKeepsBehaviour compiles programs with and without folding, with
+// every runtime check on, and checks that both give the same errors or the same
+// output on each input.
+func TestFoldKeepsBehaviour(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		inputs [][]int
+	}{
+		{"index out of range", "xs: [int; 3]\ni := in\nout xs[i] * 0\nout 7\n", [][]int{{1}, {50}}},
+		{"overflow", "a := in\nb := in\nout -a * 0\nc := false and a + b > 1\nd := a - b < 1 or true\nout 7\n", [][]int{{1, 2}, {900, 200}, {2, 1}, {0, 1}}},
+		{"input", "out in * 0\nout in\n", [][]int{{3, 4}}},
+		{"call", "func f() int {\n    out 1\n    return 2\n}\nout f() * 0\nb := f() > 1 or true\n", [][]int{{}}},
+		{"int plus a bool", "a := true\nout a + 0\n", nil},
+		{"comparing with a bool", "b := false and 1 == true\n", nil},
+		{"undefined variable", "out e % 1\n", nil},
+		{"function in a branch", "if false\n    func f() {}\nf()\n", nil},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		options := Options{boundsCheck: true, checkOverflow: true, peephole: true, layout: true, share: true}
+		results := [2][]string{}
+		for i, program := range [][]Statement{statements, Fold(statements, false)} {
+			asm, errors := Compile(program, options)
+			for _, err := range errors {
+				results[i] = append(results[i], err.Error())
+			}
+			if len(errors) > 0 {
+				continue
+			}
+			image, errors := asm.link()
+			if len(errors) > 0 {
+				t.Fatalf("%s: %s", test.name, errors[0])
+			}
+			for _, input := range test.inputs {
+				machine := InitMachine(image.memory, input)
+				if err := machine.run(10000); err != nil {
+					t.Fatalf("%s: %s", test.name, err)
+				}
+				results[i] = append(results[i], fmt.Sprint(machine.output, machine.trap(&asm, image)))
+			}
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("%s: got %v without folding and %v with it", test.name, results[0], results[1])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// precedences gives the level each binary operator is parsed at, with the
+// operators that bind tightest at the lowest level.
+var precedences = map[string]int{
+	"*": PRODUCT, "/": PRODUCT, "%": PRODUCT,
+	"+": SUM, "-": SUM,
+	"==": COMPARISON, "!=": COMPARISON, "<=": COMPARISON, ">=": COMPARISON, "<": COMPARISON, ">": COMPARISON,
+	"and": LOGIC, "or": LOGIC,
+}
+
+const formatIndent = "    "
+
+// Formatter writes a program back out as source in a canonical layout. The
+// comments aren't part of the AST, so they are written in the order they
+// appear as the statements around them are reached. line is the last line of
+// the source that has been written.
+type Formatter struct {
+	builder    strings.Builder
+	source     string
+	comments   []Comment
+	line       int
+	blockStart bool
+}
+
+// Format parses the source and returns it formatted, or the syntax errors
+// that stop it from being parsed.
+func Format(source string) (string, []Diagnostic) {
+	statements, errors := Parse(source)
+	if len(errors) > 0 {
+		return "", errors
+	}
+	_, comments, _ := Lex(source)
+	formatter := Formatter{source: source, comments: comments}
+	formatter.writeStatements(statements, "", len(source))
+	formatter.writeComments(len(source)+1, "")
+	return formatter.builder.String(), nil
+}
+
+func (formatter *Formatter) endLine(span Span) int {
+	return span.end(formatter.source).line
+}
+
+// commentText returns a comment as it was written, with the // or /* */.
+func (formatter *Formatter) commentText(comment Comment) string {
+	rest := formatter.source[comment.pos.index:]
+	if strings.HasPrefix(rest, "/*") {
+		if end := strings.Index(rest[2:], "*/"); end >= 0 {
+			return rest[:end+4]
+		}
+		return rest
+	}
+	if end := strings.IndexByte(rest, '\n'); end >= 0 {
+		rest = rest[:end]
+	}
+	return strings.TrimRight(rest, " \t\r")
+}
+
+// blankLine keeps a single blank line where the source has at least one
+// before line, except at the start of the file or a block.
+func (formatter *Formatter) blankLine(line int) {
+	if line > formatter.line+1 && formatter.builder.Len() > 0 && !formatter.blockStart {
+		formatter.builder.WriteString("\n")
+	}
+}
+
+// writeComments writes the comments before index on lines of their own.
+func (formatter *Formatter) writeComments(index int, indent string) {
+	for len(formatter.comments) > 0 && formatter.comments[0].pos.index < index {
+		comment := formatter.comments[0]
+		formatter.comments = formatter.comments[1:]
+		text := formatter.commentText(comment)
+		formatter.blankLine(comment.pos.line)
+		fmt.Fprintf(&formatter.builder, "%s%s\n", indent, text)
+		formatter.line = comment.pos.line + strings.Count(text, "\n")
+		formatter.blockStart = false
+	}
+}
+
+// writeTrailing ends the line with the comments before limit, which are
+// inside what was just written, and those after it on the same line that come
+// before end.
+func (formatter *Formatter) writeTrailing(limit, end int) {
+	for len(formatter.comments) > 0 {
+		comment := formatter.comments[0]
+		if comment.pos.index >= limit && (comment.pos.line != formatter.line || comment.pos.index >= end) {
+			break
+		}
+		formatter.comments = formatter.comments[1:]
+		text := formatter.commentText(comment)
+		fmt.Fprintf(&formatter.builder, " %s", text)
+		formatter.line = comment.pos.line + strings.Count(text, "\n")
+	}
+	formatter.builder.WriteString("\n")
+}
+
+// writeStatements writes the statements of a block whose closing brace, or
+// the end of the file, is at end.
+func (formatter *Formatter) writeStatements(statements []Statement, indent string, end int) {
+	for _, statement := range statements {
+		formatter.writeStatement(statement, indent, end)
+	}
+}
+
+func (formatter *Formatter) writeStatement(statement Statement, indent string, end int) {
+	formatter.writeComments(statement.pos.index, indent)
+	formatter.blankLine(statement.pos.line)
+	formatter.builder.WriteString(indent)
+	formatter.blockStart = false
+	formatter.writeStatementNode(statement, indent, end)
+}
+
+func (formatter *Formatter) writeStatementNode(statement Statement, indent string, end int) {
+	builder := &formatter.builder
+	switch node := statement.node.(type) {
+	case Declare:
+		switch {
+		case node.size > 0:
+			fmt.Fprintf(builder, "%s: [%s; %d]", node.name, node.ty, node.size)
+		case node.ty == Undefined && node.expr.node != nil:
+			fmt.Fprintf(builder, "%s := ", node.name)
+			formatter.writeExpr(node.expr, EXPR, EXPR)
+		default:
+			fmt.Fprintf(builder, "%s:", node.name)
+			if node.ty != Undefined {
+				fmt.Fprintf(builder, " %s", node.ty)
+			}
+			if node.expr.node != nil {
+				builder.WriteString(" = ")
+				formatter.writeExpr(node.expr, EXPR, EXPR)
+			}
+		}
+	case Assign:
+		fmt.Fprintf(builder, "%s = ", node.name)
+		formatter.writeExpr(node.expr, EXPR, EXPR)
+	case AssignIndex:
+		fmt.Fprintf(builder, "%s[", node.name)
+		formatter.writeExpr(node.index, EXPR, EXPR)
+		builder.WriteString("] = ")
+		formatter.writeExpr(node.expr, EXPR, EXPR)
+	case Output:
+		builder.WriteString("out ")
+		formatter.writeExpr(node.expr, EXPR, EXPR)
+	case CallStatement:
+		formatter.writeExpr(node.call, EXPR, EXPR)
+	case Return:
+		builder.WriteString("return")
+		if node.expr.node != nil {
+			builder.WriteString(" ")
+			formatter.writeExpr(node.expr, EXPR, EXPR)
+		}
+	case BlockScope:
+		formatter.writeBlock(statement, node.statements, indent)
+	case If:
+		builder.WriteString("if ")
+		formatter.writeExpr(node.cond, EXPR, EXPR)
+		if !formatter.writeBody(node.cond, node.ifTrue, indent, end) {
+			if node.ifFalse.node == nil {
+				return
+			}
+			builder.WriteString(indent + "else")
+		} else if node.ifFalse.node == nil {
+			break
+		} else {
+			builder.WriteString(" else")
+		}
+		if _, ok := node.ifFalse.node.(If); ok {
+			builder.WriteString(" ")
+			formatter.writeStatementNode(node.ifFalse, indent, end)
+			return
+		}
+		if !formatter.writeBody(Expr{}, node.ifFalse, indent, end) {
+			return
+		}
+	case While:
+		builder.WriteString("while ")
+		formatter.writeExpr(node.cond, EXPR, EXPR)
+		if !formatter.writeBody(node.cond, node.loop, indent, end) {
+			return
+		}
+	case Function:
+		fmt.Fprintf(builder, "func %s(", node.name)
+		for i, param := range node.params {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			fmt.Fprintf(builder, "%s: %s", param.name, param.ty)
+		}
+		builder.WriteString(")")
+		if node.ret != Undefined {
+			fmt.Fprintf(builder, " %s", node.ret)
+		}
+		builder.WriteString(" ")
+		formatter.writeBlock(node.body, node.body.node.(BlockScope).statements, indent)
+	}
+	formatter.line = formatter.endLine(statement.span())
+	formatter.writeTrailing(statement.pos.index+statement.length, end)
+}
+
+// writeBody writes the body of an if, else or while after its header. A
+// block goes on the same line and leaves the line open, returning true, but
+// any other statement goes on the next line, indented, and ends it.
+func (formatter *Formatter) writeBody(header Expr, body Statement, indent string, end int) bool {
+	if block, ok := body.node.(BlockScope); ok {
+		formatter.builder.WriteString(" ")
+		formatter.writeBlock(body, block.statements, indent)
+		return true
+	}
+	if header.node != nil {
+		formatter.line = formatter.endLine(header.span())
+	}
+	formatter.writeTrailing(header.pos.index+header.length, body.pos.index)
+	formatter.blockStart = true
+	formatter.writeStatement(body, indent+formatIndent, end)
+	return false
+}
+
+// writeBlock writes a block in braces, leaving the line open after the
+// closing brace.
+func (formatter *Formatter) writeBlock(block Statement, statements []Statement, indent string) {
+	closing := block.pos.index + block.length - 1
+	formatter.builder.WriteString("{")
+	if len(statements) == 0 && (len(formatter.comments) == 0 || formatter.comments[0].pos.index > closing) {
+		formatter.builder.WriteString("}")
+		return
+	}
+	formatter.line = block.pos.line
+	formatter.writeTrailing(block.pos.index+1, closing)
+	formatter.blockStart = true
+	formatter.writeStatements(statements, indent+formatIndent, closing)
+	formatter.writeComments(closing, indent+formatIndent)
+	formatter.builder.WriteString(indent + "}")
+}
+
+// writeExpr writes an expression that is parsed at the level prec, so that
+// only operators that bind more tightly than prec can appear outside of
+// parentheses, and is followed by an operator at the level next. Parentheses
+// are only added where the expression would otherwise be parsed differently.
+func (formatter *Formatter) writeExpr(expr Expr, prec, next int) {
+	builder := &formatter.builder
+	switch node := expr.node.(type) {
+	case IntLiteral:
+		fmt.Fprintf(builder, "%d", node.value)
+	case BoolLiteral:
+		fmt.Fprintf(builder, "%t", node.value)
+	case Input:
+		builder.WriteString("in")
+	case Ident:
+		builder.WriteString(node.name)
+	case Index:
+		fmt.Fprintf(builder, "%s[", node.name)
+		formatter.writeExpr(node.index, EXPR, EXPR)
+		builder.WriteString("]")
+	case Call:
+		fmt.Fprintf(builder, "%s(", node.name)
+		for i, arg := range node.args {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			formatter.writeExpr(arg, EXPR, EXPR)
+		}
+		builder.WriteString(")")
+	case Binary:
+		level := precedences[node.symbol]
+		parens := level >= prec
+		if parens {
+			builder.WriteString("(")
+			next = EXPR
+		}
+		// Operators of the same level are parsed from left to right.
+		formatter.writeExpr(node.left, level+1, level)
+		fmt.Fprintf(builder, " %s ", node.symbol)
+		formatter.writeExpr(node.right, level, next)
+		if parens {
+			builder.WriteString(")")
+		}
+	case Unary:
+		// The operand of - is a single value, as it binds tighter than any
+		// binary operator, and the operand of not takes in everything up to
+		// an and or an or.
+		level, symbol := PRODUCT, "-"
+		if node.symbol == "not" {
+			level, symbol = LOGIC, "not "
+		}
+		parens := next < level
+		if parens {
+			builder.WriteString("(")
+			next = EXPR
+		}
+		builder.WriteString(symbol)
+		formatter.writeExpr(node.expr, level, next)
+		if parens {
+			builder.WriteString(")")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"spaces and braces",
+			"a:=1+2*3\nif a>3 { out a } else { out (a-1) }\n",
+			"a := 1 + 2 * 3\nif a > 3 {\n    out a\n} else {\n    out a - 1\n}\n",
+		},
+		{
+			"parentheses that group",
+			"x := (1+2)*3 - (4-5)\ny := 1-(2-3)\nz := not (true and false) or true\n",
+			"x := (1 + 2) * 3 - (4 - 5)\ny := 1 - (2 - 3)\nz := not (true and false) or true\n",
+		},
+		{
+			"negation",
+			"out -a * b\nout -(a*b)\nout (-a) / 2\nout - - a\nout -(a+b)\n",
+			"out -a * b\nout -(a * b)\nout -a / 2\nout --a\nout -(a + b)\n",
+		},
+		{
+			"comments and blank lines",
+			"// top\n\n\n\na := 1 // trailing\n/* block */\nwhile a < 3 {\n  a = a + 1\n\n\n  out a\n}\n",
+			"// top\n\na := 1 // trailing\n/* block */\nwhile a < 3 {\n    a = a + 1\n\n    out a\n}\n",
+		},
+		{
+			"functions, arrays and bodies without braces",
+			"func f(x:int,y:int) int { return x+y }\nxs:[int;3]\nxs[0]=f(1,2)\nout xs[0]\n{ b := 2\n out b }\nif true\n  out 1\nelse if false\n  out 2\n",
+			"func f(x: int, y: int) int {\n    return x + y\n}\nxs: [int; 3]\nxs[0] = f(1, 2)\nout xs[0]\n{\n    b := 2\n    out b\n}\nif true\n    out 1\nelse if false\n    out 2\n",
+		},
+	}
+	for _, test := range tests {
+		got, errors := Format(test.source)
+		if len(errors) > 0 {
+			t.Errorf("%s: %s", test.name, errors[0])
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		checkFormatted(t, test.name, test.source, got)
+	}
+}
+
+func TestFormatExamples(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("examples", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, errors := Format(string(data))
+		if len(errors) > 0 {
+			t.Errorf("%s: %s", path, errors[0])
+			continue
+		}
+		checkFormatted(t, path, string(data), formatted)
+	}
+}
+
+func TestFormatSyntaxError(t *testing.T) {
+	if _, errors := Format("a := \n"); len(errors) == 0 {
+		t.Error("got no errors")
+	}
+}
+
+// checkFormatted checks that formatting the formatted source again changes
+// nothing, and that it compiles to the same program as the original.
+func checkFormatted(t *testing.T, name, source, formatted string) {
+	t.Helper()
+	again, errors := Format(formatted)
+	if len(errors) > 0 {
+		t.Errorf("%s: formatted source doesn't parse: %s", name, errors[0])
+		return
+	}
+	if again != formatted {
+		t.Errorf("%s: formatting twice gives %q, but once gives %q", name, again, formatted)
+	}
+	if compileText(source) != compileText(formatted) {
+		t.Errorf("%s: formatted source compiles differently", name)
+	}
+}
+
+// compileText returns the assembly a program compiles to, or the code of its
+// first error.
+func compileText(source string) string {
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		return diagnostics[0].code
+	}
+	asm, errors := Compile(Fold(statements, false), Options{peephole: true, layout: true, share: true})
+	if len(errors) > 0 {
+		if diag, ok := errors[0].(Diagnostic); ok {
+			return diag.code
+		}
+		return errors[0].Error()
+	}
+	builder := strings.Builder{}
+	asm.assemble(&builder)
+	return builder.String()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// generatedSeeds is how many programs from the generator the corpus is seeded
+// with, from each of its modes.
+const generatedSeeds = 5
+
+// addExamples seeds the corpus with the programs in examples/ and some from
+// the generator, or with them compiled to assembly, along with inputs that
+// once crashed or miscompiled.
+func addExamples(f *testing.F, assembly bool) {
+	paths, err := filepath.Glob(filepath.Join("examples", "*.txt"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	sources := []string{
+		"a := 1000\n",
+		"out 99999999999999999999\n",
+		"a := in\nif a + 1 {\n    out a\n}\n",
+		"xs: [int; 2000000000]\nout xs[0]\n",
+		"a := in\nb := in\nout a / b\n",
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		sources = append(sources, string(data))
+	}
+	for seed := int64(1); seed <= generatedSeeds; seed++ {
+		for _, signed := range []bool{false, true} {
+			source, err := Generate(seed, signed)
+			if err != nil {
+				f.Fatal(err)
+			}
+			sources = append(sources, source)
+		}
+	}
+	for _, source := range sources {
+		if !assembly {
+			f.Add(source)
+			continue
+		}
+		statements, diagnostics := Parse(source)
+		if len(diagnostics) > 0 {
+			continue
+		}
+		asm, errors := Compile(Fold(statements, false), Options{peephole: true, layout: true, share: true})
+		if len(errors) > 0 {
+			continue
+		}
+		builder := strings.Builder{}
+		asm.assemble(&builder)
+		f.Add(builder.String())
+	}
+}
+
+// FuzzParse checks that the parser doesn't panic and that every position in
+// the AST and the syntax errors is inside the source.
+func FuzzParse(f *testing.F) {
+	addExamples(f, false)
+	f.Fuzz(func(t *testing.T, source string) {
+		statements, diagnostics := Parse(source)
+		positions := InitPositionChecker(source)
+		for _, diag := range diagnostics {
+			if err := positions.checkDiagnostic(diag); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := positions.checkStatements(statements); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzCompile checks that programs without syntax errors compile without
+// panicking or giving positions outside the source, and that a program that
+// compiles links to valid LMC code, which reads back in as the same. The
+// program is run against the interpreter both as compiled and, when it fits
+// in the mailboxes, compiled without any optimizations.
+func FuzzCompile(f *testing.F) {
+	addExamples(f, false)
+	f.Fuzz(func(t *testing.T, source string) {
+		statements, diagnostics := Parse(source)
+		if len(diagnostics) > 0 {
+			return
+		}
+		positions := InitPositionChecker(source)
+		for _, signed := range []bool{false, true} {
+			asm, errors := Compile(Fold(statements, signed), Options{peephole: true, layout: true, share: true, signed: signed})
+			for _, err := range errors {
+				if diag, ok := err.(Diagnostic); ok {
+					if err := positions.checkDiagnostic(diag); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if len(errors) > 0 {
+				continue
+			}
+			image, errors := asm.link()
+			if len(errors) > 0 {
+				t.Fatalf("compiled program doesn't link: %s", errors[0])
+			}
+			if err := checkImage(image.memory); err != nil {
+				t.Fatal(err)
+			}
+			builder := strings.Builder{}
+			asm.assemble(&builder)
+			memory, err := assembleText(builder.String())
+			if err != nil {
+				t.Fatalf("compiled assembly doesn't assemble: %s", err)
+			}
+			if memory != image.memory {
+				t.Fatal("compiled assembly assembles differently to the program it was written from")
+			}
+			checkAgainstInterpreter(t, statements, memory, signed, "optimized")
+
+			asm, errors = Compile(statements, Options{signed: signed})
+			if len(errors) == 0 {
+				image, errors = asm.link()
+			}
+			if len(errors) > 0 {
+				continue
+			}
+			checkAgainstInterpreter(t, statements, image.memory, signed, "unoptimized")
+		}
+	})
+}
+
+// checkAgainstInterpreter runs a compiled program and the interpreter on the
+// same inputs, failing on the first that they output different values for.
+func checkAgainstInterpreter(t *testing.T, statements []Statement, memory [MailboxCount]int, signed bool, what string) {
+	t.Helper()
+	tester := DiffTester{statements, memory, signed, 200}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 3; i++ {
+		if mismatch, _ := tester.compare(generateInputs(rng, 5, signed)); mismatch != nil {
+			t.Fatalf("%s program on %v output %s but the interpreter %s", what, mismatch.input, mismatch.compiled, mismatch.interpreted)
+		}
+	}
+}
+
+// FuzzAssemble checks that assembly that assembles gives valid LMC code,
+// which the simulator can run.
+func FuzzAssemble(f *testing.F) {
+	addExamples(f, true)
+	f.Fuzz(func(t *testing.T, text string) {
+		memory, err := assembleText(text)
+		if err != nil {
+			return
+		}
+		if err := checkImage(memory); err != nil {
+			t.Fatal(err)
+		}
+		machine := InitMachine(memory, []int{0, 1, 999})
+		machine.run(1000)
+	})
+}
+
+// checkImage checks that every mailbox holds a value the LMC can store.
+func checkImage(memory [MailboxCount]int) error {
+	for address, word := range memory {
+		if word < 0 || word > 999 {
+			return fmt.Errorf("mailbox %d holds %d, which is out of range", address, word)
+		}
+	}
+	return nil
+}
+
+// PositionChecker checks that positions are inside a source, and that their
+// lines and columns agree with their indexes. positions holds the position of
+// the start of every rune and of the end of the source.
+type PositionChecker struct {
+	source    string
+	positions map[int]Position
+}
+
+func InitPositionChecker(source string) PositionChecker {
+	positions := map[int]Position{}
+	pos := Position{1, 1, 0}
+	for pos.index < len(source) {
+		positions[pos.index] = pos
+		r, size := utf8.DecodeRuneInString(source[pos.index:])
+		if r == '\n' {
+			pos.line++
+			pos.column = 1
+		} else {
+			pos.column++
+		}
+		pos.index += size
+	}
+	positions[pos.index] = pos
+	return PositionChecker{source, positions}
+}
+
+// checkSpan checks a span, where an empty span doesn't point into the source.
+func (checker PositionChecker) checkSpan(span Span, what string) error {
+	if span.empty() {
+		return nil
+	}
+	pos, prs := checker.positions[span.pos.index]
+	if !prs {
+		return fmt.Errorf("%s starts at index %d, which isn't the start of a character in a source of %d bytes", what, span.pos.index, len(checker.source))
+	}
+	if pos != span.pos {
+		return fmt.Errorf("%s is at %s, but index %d is at %s", what, span.pos, span.pos.index, pos)
+	}
+	if span.length < 0 || span.pos.index+span.length > len(checker.source) {
+		return fmt.Errorf("%s at %s is %d bytes long, which goes past the end of the source", what, span.pos, span.length)
+	}
+	return nil
+}
+
+func (checker PositionChecker) checkDiagnostic(diag Diagnostic) error {
+	what := fmt.Sprintf("error %s", diag.code)
+	if err := checker.checkSpan(diag.primary.span, what); err != nil {
+		return err
+	}
+	for _, label := range diag.labels {
+		if err := checker.checkSpan(label.span, what+" label"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (checker PositionChecker) checkStatements(statements []Statement) error {
+	for _, statement := range statements {
+		if err := checker.checkStatement(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (checker PositionChecker) checkStatement(statement Statement) error {
+	if err := checker.checkSpan(statement.span(), "statement"); err != nil {
+		return err
+	}
+	exprs := []Expr{}
+	children := []Statement{}
+	switch node := statement.node.(type) {
+	case Declare:
+		exprs = append(exprs, node.expr)
+	case Assign:
+		exprs = append(exprs, node.expr)
+	case AssignIndex:
+		exprs = append(exprs, node.index, node.expr)
+	case Output:
+		exprs = append(exprs, node.expr)
+	case CallStatement:
+		exprs = append(exprs, node.call)
+	case Return:
+		exprs = append(exprs, node.expr)
+	case BlockScope:
+		children = node.statements
+	case If:
+		exprs = append(exprs, node.cond)
+		children = append(children, node.ifTrue, node.ifFalse)
+	case While:
+		exprs = append(exprs, node.cond)
+		children = append(children, node.loop)
+	case Function:
+		if err := checker.checkSpan(Span{node.pos, len(node.name)}, "function name"); err != nil {
+			return err
+		}
+		for _, param := range node.params {
+			if err := checker.checkSpan(Span{param.pos, len(param.name)}, "parameter"); err != nil {
+				return err
+			}
+		}
+		children = append(children, node.body)
+	}
+	for _, expr := range exprs {
+		if err := checker.checkExpr(expr); err != nil {
+			return err
+		}
+	}
+	for _, child := range children {
+		if child.node == nil {
+			continue
+		}
+		if err := checker.checkStatement(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (checker PositionChecker) checkExpr(expr Expr) error {
+	if expr.node == nil {
+		return nil
+	}
+	if err := checker.checkSpan(expr.span(), "expression"); err != nil {
+		return err
+	}
+	switch node := expr.node.(type) {
+	case Index:
+		return checker.checkExpr(node.index)
+	case Binary:
+		if err := checker.checkExpr(node.left); err != nil {
+			return err
+		}
+		return checker.checkExpr(node.right)
+	case Unary:
+		return checker.checkExpr(node.expr)
+	case Call:
+		for _, arg := range node.args {
+			if err := checker.checkExpr(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Generator writes random programs for testing the compiler. Every program
+// type checks and finishes: each loop counts up to a small limit with a
+// counter that nothing else assigns, and arrays are only indexed in range.
+type Generator struct {
+	rng       *rand.Rand
+	signed    bool
+	builder   strings.Builder
+	indent    string
+	scopes    []map[string]GenVar
+	functions []GenFunction
+	function  *GenFunction
+	counters  int
+	budget    int
+}
+
+// GenVar is a variable the generator has declared. Loop counters are never
+// assigned by anything but their loop.
+type GenVar struct {
+	ty      Type
+	size    int
+	counter bool
+}
+
+// GenFunction is a function the generator has declared, which only later
+// functions and statements can call.
+type GenFunction struct {
+	name   string
+	params []Type
+	ret    Type
+}
+
+// varNames are the names of generated variables, which are few enough that
+// they are often declared again and shadow each other.
+var varNames = []string{"a", "b", "c", "d", "e", "f"}
+
+// Generate returns a random program that fits in the mailboxes, which is the
+// same for the same seed.
+func Generate(seed int64, signed bool) (string, error) {
+	rng := rand.New(rand.NewSource(seed))
+	budget := 12
+	var errors []error
+	for attempt := 0; attempt < 20; attempt++ {
+		gen := Generator{rng: rng, signed: signed, scopes: []map[string]GenVar{{}}, budget: budget}
+		gen.program()
+		source, parseErrors := Format(gen.builder.String())
+		if len(parseErrors) > 0 {
+			return "", fmt.Errorf("generated program doesn't parse: %s", parseErrors[0])
+		}
+		statements, _ := Parse(source)
+		_, errors = Compile(Fold(statements, signed), Options{peephole: true, layout: true, share: true, signed: signed})
+		if len(errors) == 0 {
+			return source, nil
+		}
+		if diag, ok := errors[0].(Diagnostic); !ok || diag.code != "E022" {
+			return "", fmt.Errorf("generated program doesn't compile: %s", errors[0])
+		}
+		if budget > 4 {
+			budget -= 2
+		}
+	}
+	return "", errors[0]
+}
+
+func (gen *Generator) chance(percent int) bool {
+	return gen.rng.Intn(100) < percent
+}
+
+func (gen *Generator) line(format string, args ...interface{}) {
+	fmt.Fprintf(&gen.builder, gen.indent+format+"\n", args...)
+}
+
+func (gen *Generator) pushScope() {
+	gen.scopes = append(gen.scopes, map[string]GenVar{})
+	gen.indent += formatIndent
+}
+
+func (gen *Generator) popScope() {
+	gen.scopes = gen.scopes[:len(gen.scopes)-1]
+	gen.indent = gen.indent[len(formatIndent):]
+}
+
+func (gen *Generator) declare(name string, variable GenVar) {
+	gen.scopes[len(gen.scopes)-1][name] = variable
+}
+
+// visible returns the names of the variables in scope that match, leaving out
+// those that are shadowed.
+func (gen *Generator) visible(match func(GenVar) bool) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for i := len(gen.scopes) - 1; i >= 0; i-- {
+		for _, name := range sortedNames(gen.scopes[i]) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if match(gen.scopes[i][name]) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// sortedNames lists the names in a scope in a fixed order, so that the same
+// seed always gives the same program.
+func sortedNames(scope map[string]GenVar) []string {
+	names := []string{}
+	for name := range scope {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (gen *Generator) lookup(name string) GenVar {
+	for i := len(gen.scopes) - 1; i >= 0; i-- {
+		if variable, prs := gen.scopes[i][name]; prs {
+			return variable
+		}
+	}
+	return GenVar{}
+}
+
+func (gen *Generator) pick(names []string) string {
+	return names[gen.rng.Intn(len(names))]
+}
+
+func (gen *Generator) randomType() Type {
+	if gen.chance(60) {
+		return Int
+	}
+	return Bool
+}
+
+// program writes the inputs, arrays and functions that the rest of the
+// program can use before the statements, and finishes with an out so that
+// every program outputs something.
+func (gen *Generator) program() {
+	for i := 0; i < 1+gen.rng.Intn(3); i++ {
+		gen.line("%s := in", varNames[i])
+		gen.declare(varNames[i], GenVar{Int, 0, false})
+	}
+	if gen.chance(40) {
+		ty, size := gen.randomType(), 2+gen.rng.Intn(4)
+		gen.line("xs: [%s; %d]", ty, size)
+		gen.declare("xs", GenVar{ty.arrayOf(), size, false})
+	}
+	for i := 0; i < gen.rng.Intn(3); i++ {
+		gen.functionDeclaration(fmt.Sprintf("f%d", i))
+	}
+	for gen.budget > 0 {
+		gen.statement(0)
+	}
+	gen.line("out %s", gen.expr(Int, 2))
+}
+
+func (gen *Generator) functionDeclaration(name string) {
+	function := GenFunction{name, nil, Undefined}
+	if gen.chance(70) {
+		function.ret = gen.randomType()
+	}
+	params := []string{}
+	paramVars := map[string]GenVar{}
+	for i := 0; i < gen.rng.Intn(3); i++ {
+		ty := gen.randomType()
+		function.params = append(function.params, ty)
+		paramName := varNames[len(varNames)-1-i]
+		params = append(params, fmt.Sprintf("%s: %s", paramName, ty))
+		paramVars[paramName] = GenVar{ty, 0, false}
+	}
+	header := fmt.Sprintf("func %s(%s)", name, strings.Join(params, ", "))
+	if function.ret != Undefined {
+		header += " " + function.ret.String()
+	}
+	gen.line("%s {", header)
+	gen.pushScope()
+	for paramName, variable := range paramVars {
+		gen.declare(paramName, variable)
+	}
+	gen.function = &function
+	for i := 0; i < 1+gen.rng.Intn(3); i++ {
+		gen.statement(1)
+	}
+	if function.ret != Undefined {
+		gen.line("return %s", gen.expr(function.ret, 2))
+	}
+	gen.function = nil
+	gen.popScope()
+	gen.line("}")
+	gen.functions = append(gen.functions, function)
+}
+
+func (gen *Generator) block(depth int) {
+	gen.pushScope()
+	for i := 0; i == 0 || i < 1+gen.rng.Intn(3) && gen.budget > 0; i++ {
+		gen.statement(depth)
+	}
+	gen.popScope()
+}
+
+func (gen *Generator) statement(depth int) {
+	gen.budget--
+	switch choice := gen.rng.Intn(100); {
+	case choice < 15 && depth < 3:
+		gen.body("if "+gen.expr(Bool, 2), depth+1)
+		for gen.chance(40) {
+			if gen.chance(50) {
+				gen.body("else", depth+1)
+				break
+			}
+			gen.body("else if "+gen.expr(Bool, 2), depth+1)
+		}
+	case choice < 27 && depth < 3:
+		counter := fmt.Sprintf("i%d", gen.counters)
+		gen.counters++
+		gen.line("%s := 0", counter)
+		gen.declare(counter, GenVar{Int, 0, true})
+		cond := fmt.Sprintf("%s < %d", counter, 1+gen.rng.Intn(4))
+		if gen.chance(40) {
+			cond = fmt.Sprintf("%s and (%s)", cond, gen.expr(Bool, 2))
+		}
+		gen.line("while %s {", cond)
+		gen.block(depth + 1)
+		gen.line(formatIndent+"%s = %s + 1", counter, counter)
+		gen.line("}")
+	case choice < 33 && depth < 3:
+		gen.line("{")
+		gen.block(depth + 1)
+		gen.line("}")
+	case choice < 36 && depth < 3:
+		ty, size := gen.randomType(), 2+gen.rng.Intn(3)
+		name := gen.pick([]string{"xs", "ys"})
+		gen.line("%s: [%s; %d]", name, ty, size)
+		gen.declare(name, GenVar{ty.arrayOf(), size, false})
+	case choice < 42 && gen.function != nil && gen.function.ret != Undefined:
+		gen.line("if %s", gen.expr(Bool, 2))
+		gen.line(formatIndent+"return %s", gen.expr(gen.function.ret, 2))
+	default:
+		gen.simpleStatement(true)
+	}
+}
+
+// body writes the header of an if, else or while followed by its body, which
+// is sometimes a single statement without braces. Only simple statements
+// other than declarations go without braces, so an else is never taken to
+// belong to an if inside the body, and a variable is never declared only when
+// a branch is taken.
+func (gen *Generator) body(header string, depth int) {
+	if gen.chance(30) {
+		gen.line("%s", header)
+		gen.budget--
+		gen.simpleStatement(false)
+		return
+	}
+	gen.line("%s {", header)
+	gen.block(depth)
+	gen.line("}")
+}
+
+// simpleStatement writes a statement without a body, which is only a
+// declaration if declare is set. Variables are sometimes declared without a
+// value.
+func (gen *Generator) simpleStatement(declare bool) {
+	assignable := gen.visible(func(v GenVar) bool { return !v.counter && !v.ty.isArray() })
+	arrays := gen.visible(func(v GenVar) bool { return v.ty.isArray() })
+	procedures := []GenFunction{}
+	for _, function := range gen.functions {
+		if function.ret == Undefined {
+			procedures = append(procedures, function)
+		}
+	}
+
+	switch choice := gen.rng.Intn(100); {
+	case choice < 30 && declare:
+		name, ty := gen.pick(varNames), gen.randomType()
+		switch {
+		case gen.chance(20):
+			gen.line("%s: %s", name, ty)
+		case gen.chance(30):
+			gen.line("%s: %s = %s", name, ty, gen.expr(ty, 2))
+		default:
+			gen.line("%s := %s", name, gen.expr(ty, 2))
+		}
+		gen.declare(name, GenVar{ty, 0, false})
+	case choice < 55 && len(assignable) > 0:
+		name := gen.pick(assignable)
+		gen.line("%s = %s", name, gen.expr(gen.lookup(name).ty, 2))
+	case choice < 65 && len(arrays) > 0:
+		name := gen.pick(arrays)
+		array := gen.lookup(name)
+		gen.line("%s[%s] = %s", name, gen.index(array.size), gen.expr(array.ty.elem(), 2))
+	case choice < 75 && len(procedures) > 0:
+		function := procedures[gen.rng.Intn(len(procedures))]
+		gen.line("%s", gen.call(function, 2))
+	default:
+		gen.line("out %s", gen.expr(Int, 2))
+	}
+}
+
+func (gen *Generator) literal() string {
+	if gen.chance(60) {
+		return fmt.Sprint(gen.rng.Intn(10))
+	}
+	if gen.signed {
+		return fmt.Sprint(gen.rng.Intn(SignedOffset))
+	}
+	return fmt.Sprint(gen.rng.Intn(1000))
+}
+
+// index returns an index into an array of the size. Any integer can be used
+// in unsigned mode as it is taken modulo the size, but a negative one would
+// stay negative in signed mode.
+func (gen *Generator) index(size int) string {
+	if !gen.signed && gen.chance(50) {
+		return fmt.Sprintf("(%s) %% %d", gen.expr(Int, 1), size)
+	}
+	return fmt.Sprint(gen.rng.Intn(size))
+}
+
+func (gen *Generator) call(function GenFunction, depth int) string {
+	args := []string{}
+	for _, param := range function.params {
+		args = append(args, gen.expr(param, depth-1))
+	}
+	return fmt.Sprintf("%s(%s)", function.name, strings.Join(args, ", "))
+}
+
+// expr returns an expression of the type with operators nested up to depth
+// deep. Every operand is in parentheses, which Format removes where they
+// aren't needed.
+func (gen *Generator) expr(ty Type, depth int) string {
+	scalars := gen.visible(func(v GenVar) bool { return v.ty == ty })
+	arrays := gen.visible(func(v GenVar) bool { return v.ty == ty.arrayOf() })
+	functions := []GenFunction{}
+	for _, function := range gen.functions {
+		if function.ret == ty {
+			functions = append(functions, function)
+		}
+	}
+
+	if depth <= 0 || gen.chance(25) {
+		switch {
+		case len(scalars) > 0 && gen.chance(60):
+			return gen.pick(scalars)
+		case ty == Int && gen.chance(3):
+			return "in"
+		case ty == Int:
+			return gen.literal()
+		default:
+			return fmt.Sprint(gen.chance(50))
+		}
+	}
+
+	switch choice := gen.rng.Intn(100); {
+	case choice < 8 && len(functions) > 0:
+		return gen.call(functions[gen.rng.Intn(len(functions))], depth)
+	case choice < 15 && len(arrays) > 0:
+		name := gen.pick(arrays)
+		return fmt.Sprintf("%s[%s]", name, gen.index(gen.lookup(name).size))
+	case ty == Int && choice < 25:
+		return fmt.Sprintf("-(%s)", gen.expr(Int, depth-1))
+	case ty == Int:
+		ops := []string{"+", "-", "+", "-", "*", "/", "%"}
+		return fmt.Sprintf("(%s) %s (%s)", gen.expr(Int, depth-1), gen.pick(ops), gen.expr(Int, depth-1))
+	case choice < 25:
+		return fmt.Sprintf("not (%s)", gen.expr(Bool, depth-1))
+	case choice < 50:
+		return fmt.Sprintf("(%s) %s (%s)", gen.expr(Bool, depth-1), gen.pick([]string{"and", "or"}), gen.expr(Bool, depth-1))
+	default:
+		ops := []string{"==", "!=", "<", ">", "<=", ">="}
+		return fmt.Sprintf("(%s) %s (%s)", gen.expr(Int, depth-1), gen.pick(ops), gen.expr(Int, depth-1))
+	}
+}
+
+// generateCommand prints a generated program, or writes several into a
+// directory named after their seeds.
+func generateCommand(args []string) {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	seed := flags.Int64("seed", 1, "the seed of the first program")
+	count := flags.Int("count", 1, "the number of programs to generate, with the seeds after the first")
+	dir := flags.String("dir", "", "the directory to write the programs to instead of printing them")
+	signed := flags.Bool("signed", false, "whether integers go from -500 to 499 instead of 0 to 999")
+	flags.Parse(args)
+	if *count > 1 && *dir == "" {
+		fmt.Println("-dir is needed to generate more than one program")
+		os.Exit(1)
+	}
+	if *dir != "" {
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	for i := 0; i < *count; i++ {
+		source, err := Generate(*seed+int64(i), *signed)
+		if err != nil {
+			fmt.Printf("seed %d: %s\n", *seed+int64(i), err)
+			os.Exit(1)
+		}
+		if *dir == "" {
+			fmt.Print(source)
+			continue
+		}
+		path := filepath.Join(*dir, fmt.Sprintf("gen%d.txt", *seed+int64(i)))
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestGenerateSameSeed(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		first, err := Generate(7, signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := Generate(7, signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second {
+			t.Errorf("signed %t: seed 7 gave\n%s\nthen\n%s", signed, first, second)
+		}
+		other, err := Generate(8, signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other == first {
+			t.Errorf("signed %t: seeds 7 and 8 gave the same program", signed)
+		}
+	}
+}
+
+// TestGeneratedPrograms checks what the generator promises of the programs
+// from the first seeds: they parse, compile to fit in the mailboxes and halt.
+func TestGeneratedPrograms(t *testing.T) {
+	input := []int{}
+	for i := 0; i < 100; i++ {
+		input = append(input, i%7)
+	}
+	for _, signed := range []bool{false, true} {
+		for seed := int64(1); seed <= 50; seed++ {
+			source, err := Generate(seed, signed)
+			if err != nil {
+				t.Fatalf("seed %d signed %t: %s", seed, signed, err)
+			}
+			statements, diagnostics := Parse(source)
+			if len(diagnostics) > 0 {
+				t.Fatalf("seed %d signed %t: %s\n%s", seed, signed, diagnostics[0], source)
+			}
+			asm, errors := Compile(Fold(statements, signed), Options{peephole: true, layout: true, share: true, signed: signed})
+			if len(errors) > 0 {
+				t.Fatalf("seed %d signed %t: %s\n%s", seed, signed, errors[0], source)
+			}
+			if total := asm.usage().total(); total > MailboxCount {
+				t.Fatalf("seed %d signed %t: uses %d mailboxes", seed, signed, total)
+			}
+			if _, err := Interpret(statements, append([]int{}, input...), signed, 100000); err != nil {
+				t.Fatalf("seed %d signed %t: %s\n%s", seed, signed, err, source)
+			}
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module lmcc
 
-go 1.15
+go 1.18
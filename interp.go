@@ -0,0 +1,477 @@
+package main
+
+import "fmt"
+
+// Value is an integer or bool computed by the interpreter. Integers are kept
+// in the range of the mode they run in, 0 to 999 or -500 to 499, and bools
+// are 0 or 1.
+type Value struct {
+	ty    Type
+	value int
+}
+
+// Closure is a function along with the variables and functions that were in
+// scope where it was declared, which are the only ones its body can use.
+type Closure struct {
+	function  Function
+	vars      map[string]*Variable
+	functions map[string]*Signature
+}
+
+// Interpreter runs a program from its AST, as a definition of what the
+// compiled program should do that doesn't depend on the compiler. Names are
+// looked up with a Scope in the same way as Compile, and each variable has
+// its own mailbox, named by its label, that is set when its declaration gives
+// it a value. The types are checked as the program runs, so errors in code
+// that is never reached aren't found.
+type Interpreter struct {
+	scope     *Scope
+	memory    map[string][]int
+	closures  map[string]*Closure
+	input     []int
+	output    []int
+	steps     int
+	maxSteps  int
+	returning bool
+	result    Value
+}
+
+// Interpret runs the program on the inputs, returning what it output. The
+// output so far is returned along with any error.
+func Interpret(statements []Statement, input []int, signed bool, maxSteps int) ([]int, error) {
+	scope := InitScope()
+	scope.signed = signed
+	interp := Interpreter{&scope, make(map[string][]int), make(map[string]*Closure), input, []int{}, 0, maxSteps, false, Value{}}
+	for _, statement := range statements {
+		if err := interp.exec(statement); err != nil {
+			return interp.output, err
+		}
+	}
+	return interp.output, nil
+}
+
+// wrap brings an integer back into range, as the additions and subtractions
+// of the LMC wrap around.
+func (interp *Interpreter) wrap(value int) Value {
+	if interp.scope.signed {
+		return Value{Int, wrap(value+SignedOffset) - SignedOffset}
+	}
+	return Value{Int, wrap(value)}
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Value{Bool, 1}
+	}
+	return Value{Bool, 0}
+}
+
+func (interp *Interpreter) step(pos Position) error {
+	interp.steps++
+	if interp.steps > interp.maxSteps {
+		return fmt.Errorf("%w within %d steps, stopping at %s", errNotHalted, interp.maxSteps, pos)
+	}
+	return nil
+}
+
+// declare gives a new variable a mailbox, returning its label. A variable
+// starts at zero, and keeps what it held when its declaration is reached
+// again, as the compiled program only writes to its mailbox when the
+// declaration gives it a value.
+func (interp *Interpreter) declare(name string, ty Type, size int, span Span) string {
+	label := fmt.Sprintf("%s_%d", name, span.pos.index)
+	interp.scope.declare(name, label, ty, size, span)
+	if _, prs := interp.memory[label]; !prs {
+		if size == 0 {
+			size = 1
+		}
+		interp.memory[label] = make([]int, size)
+	}
+	return label
+}
+
+func (interp *Interpreter) exec(statement Statement) error {
+	if err := interp.step(statement.pos); err != nil {
+		return err
+	}
+	span := statement.span()
+	scope := interp.scope
+	switch node := statement.node.(type) {
+	case Declare:
+		name := Span{statement.pos, len(node.name)}
+		if node.size > 0 {
+			interp.declare(node.name, node.ty.arrayOf(), node.size, name)
+			return nil
+		}
+		if node.expr.node == nil {
+			interp.declare(node.name, node.ty, 0, name)
+			return nil
+		}
+		value, err := interp.eval(node.expr)
+		if err != nil {
+			return err
+		}
+		if node.ty != value.ty && node.ty != Undefined {
+			return newError("E010", node.expr.span(), fmt.Sprintf("expected %s instead got %s", node.ty.withArticle(), value.ty.withArticle())).
+				withLabel("this is "+value.ty.withArticle()).
+				withNote(name, fmt.Sprintf("declared as %s here", node.ty.withArticle()))
+		}
+		label := interp.declare(node.name, value.ty, 0, name)
+		interp.memory[label][0] = value.value
+	case Assign:
+		name := Span{statement.pos, len(node.name)}
+		target, prs := scope.use(node.name, name)
+		if !prs {
+			return undefinedVariable(node.name, name)
+		}
+		if target.kind.isArray() {
+			return newError("E012", name, fmt.Sprintf("cannot assign to array '%s' without an index", node.name)).
+				withLabel("this is an array")
+		}
+		value, err := interp.evalAndExpect(node.expr, target.kind)
+		if err != nil {
+			return err
+		}
+		interp.memory[target.label][0] = value.value
+	case AssignIndex:
+		array, index, err := interp.element(node.name, node.index, Span{statement.pos, len(node.name)})
+		if err != nil {
+			return err
+		}
+		value, err := interp.evalAndExpect(node.expr, array.kind.elem())
+		if err != nil {
+			return err
+		}
+		interp.memory[array.label][index] = value.value
+	case BlockScope:
+		scope.pushScope()
+		defer scope.popScope()
+		for _, statement := range node.statements {
+			if err := interp.exec(statement); err != nil || interp.returning {
+				return err
+			}
+		}
+	case If:
+		cond, err := interp.evalCondition(node.cond)
+		if err != nil {
+			return err
+		}
+		if cond {
+			interp.skip(node.ifFalse)
+			return interp.exec(node.ifTrue)
+		}
+		interp.skip(node.ifTrue)
+		if node.ifFalse.node != nil {
+			return interp.exec(node.ifFalse)
+		}
+	case While:
+		for ran := false; ; ran = true {
+			cond, err := interp.evalCondition(node.cond)
+			if err != nil || !cond {
+				if !ran {
+					interp.skip(node.loop)
+				}
+				return err
+			}
+			if err := interp.exec(node.loop); err != nil || interp.returning {
+				return err
+			}
+		}
+	case Output:
+		value, err := interp.evalAndExpect(node.expr, Int)
+		if err != nil {
+			return err
+		}
+		interp.output = append(interp.output, value.value)
+	case Function:
+		return interp.declareFunction(node, span)
+	case CallStatement:
+		_, err := interp.eval(node.call)
+		return err
+	case Return:
+		return interp.execReturn(node, span)
+	}
+	return nil
+}
+
+// skip declares what the body of an if, else or while that doesn't run would
+// have declared. A body that isn't a block has no scope of its own, so Compile
+// puts a declaration there in the enclosing scope whether the body runs or
+// not, leaving a variable with whatever its mailbox held. Errors in the body
+// aren't reported, as with any code that doesn't run.
+func (interp *Interpreter) skip(body Statement) {
+	switch node := body.node.(type) {
+	case Declare:
+		ty := node.ty
+		if node.size > 0 {
+			ty = node.ty.arrayOf()
+		} else if ty == Undefined {
+			ty = typeOf(node.expr, interp.scope)
+		}
+		interp.declare(node.name, ty, node.size, Span{body.pos, len(node.name)})
+	case Function:
+		interp.declareFunction(node, body.span())
+	}
+}
+
+func (interp *Interpreter) declareFunction(function Function, span Span) error {
+	scope := interp.scope
+	if scope.currentDepth > 0 || scope.function != nil {
+		return newError("E017", span, fmt.Sprintf("function '%s' must be declared at the top level", function.name))
+	}
+	if previous, prs := scope.functions[function.name]; prs {
+		return newError("E018", span, fmt.Sprintf("function '%s' is already declared", function.name)).
+			withNote(previous.span, "first declared here")
+	}
+	closure := &Closure{function, make(map[string]*Variable), make(map[string]*Signature)}
+	for name, variable := range scope.hashmap {
+		closure.vars[name] = variable
+	}
+	for name, sig := range scope.functions {
+		closure.functions[name] = sig
+	}
+	sig := &Signature{span: span, name: Span{function.pos, len(function.name)}, ret: function.ret, entry: fmt.Sprintf("%s_%d", function.name, span.pos.index)}
+	for _, param := range function.params {
+		sig.params = append(sig.params, param.ty)
+	}
+	interp.closures[sig.entry] = closure
+	scope.functions[function.name] = sig
+	return nil
+}
+
+func (interp *Interpreter) execReturn(ret Return, span Span) error {
+	function := interp.scope.function
+	if function == nil {
+		return newError("E019", span, "return outside of a function")
+	}
+	if ret.expr.node == nil {
+		if function.ret != Undefined {
+			return newError("E020", span, "return must return "+function.ret.withArticle()).
+				withNote(function.span, "the function returns "+function.ret.withArticle())
+		}
+		interp.result = Value{Undefined, 0}
+	} else {
+		if function.ret == Undefined {
+			return newError("E020", ret.expr.span(), "return with a value in a function that doesn't return one").
+				withNote(function.span, "the function has no return type")
+		}
+		value, err := interp.evalAndExpect(ret.expr, function.ret)
+		if err != nil {
+			return err
+		}
+		interp.result = value
+	}
+	interp.returning = true
+	return nil
+}
+
+// call evaluates the arguments and runs the function's body in a scope of its
+// own. A function that ends without returning gives 0 or false.
+func (interp *Interpreter) call(call Call, span Span) (Value, error) {
+	sig, prs := interp.scope.functions[call.name]
+	if !prs {
+		return Value{}, newError("E015", span, fmt.Sprintf("undefined function '%s'", call.name))
+	}
+	if len(call.args) != len(sig.params) {
+		return Value{}, newError("E016", span, fmt.Sprintf("function '%s' takes %d arguments but %d were given", call.name, len(sig.params), len(call.args))).
+			withNote(sig.span, "declared here")
+	}
+	args := []Value{}
+	for i, arg := range call.args {
+		value, err := interp.evalAndExpect(arg, sig.params[i])
+		if err != nil {
+			return Value{}, err
+		}
+		args = append(args, value)
+	}
+
+	closure := interp.closures[sig.entry]
+	caller := interp.scope
+	scope := InitScope()
+	scope.signed = caller.signed
+	scope.function = sig
+	for name, variable := range closure.vars {
+		scope.hashmap[name] = variable
+	}
+	for name, function := range closure.functions {
+		scope.functions[name] = function
+	}
+	interp.scope = &scope
+	defer func() { interp.scope = caller }()
+
+	scope.pushScope()
+	for i, param := range closure.function.params {
+		label := interp.declare(param.name, param.ty, 0, Span{param.pos, len(param.name)})
+		interp.memory[label][0] = args[i].value
+	}
+	err := interp.exec(closure.function.body)
+	result := Value{sig.ret, 0}
+	if interp.returning {
+		result = interp.result
+		interp.returning = false
+	}
+	return result, err
+}
+
+// element evaluates the index of an element of an array.
+func (interp *Interpreter) element(name string, indexExpr Expr, span Span) (*Variable, int, error) {
+	array, prs := interp.scope.use(name, span)
+	if !prs {
+		return nil, 0, undefinedVariable(name, span)
+	}
+	if !array.kind.isArray() {
+		return nil, 0, newError("E013", span, fmt.Sprintf("variable '%s' has type %s so cannot be indexed", name, array.kind)).
+			withLabel("this is " + array.kind.withArticle())
+	}
+	index, err := interp.evalAndExpect(indexExpr, Int)
+	if err != nil {
+		return nil, 0, err
+	}
+	if index.value < 0 || index.value >= array.size {
+		return nil, 0, fmt.Errorf("index %d is out of range for '%s', which has %d elements, at %s", index.value, name, array.size, indexExpr.pos)
+	}
+	return array, index.value, nil
+}
+
+func (interp *Interpreter) evalAndExpect(expr Expr, ty Type) (Value, error) {
+	value, err := interp.eval(expr)
+	if err != nil {
+		return Value{}, err
+	}
+	if value.ty != ty {
+		return Value{}, newError("E010", expr.span(), fmt.Sprintf("expected %s instead got %s", ty.withArticle(), value.ty.withArticle())).
+			withLabel("this is " + value.ty.withArticle())
+	}
+	return value, nil
+}
+
+func (interp *Interpreter) evalCondition(expr Expr) (bool, error) {
+	value, err := interp.eval(expr)
+	if err != nil {
+		return false, err
+	}
+	if value.ty != Bool {
+		return false, notCondition(expr.span(), value.ty)
+	}
+	return value.value != 0, nil
+}
+
+// eval evaluates an expression. The operands of arithmetic and comparisons
+// are evaluated right to left except for <= and >, and the arguments of calls
+// left to right. The compiled program follows the same order, copying a
+// variable it has evaluated if a call in a later operand could assign it.
+func (interp *Interpreter) eval(expr Expr) (Value, error) {
+	span := expr.span()
+	switch node := expr.node.(type) {
+	case IntLiteral:
+		if err := checkIntLiteral(node, span, interp.scope.signed); err != nil {
+			return Value{}, err
+		}
+		return interp.wrap(node.value), nil
+	case BoolLiteral:
+		return boolValue(node.value), nil
+	case Input:
+		if len(interp.input) == 0 {
+			return Value{}, fmt.Errorf("input requested at %s but %w", expr.pos, errNoInput)
+		}
+		value := interp.input[0]
+		interp.input = interp.input[1:]
+		return interp.wrap(value), nil
+	case Ident:
+		variable, prs := interp.scope.use(node.name, span)
+		if !prs {
+			return Value{}, undefinedVariable(node.name, span)
+		}
+		if variable.kind.isArray() {
+			return Value{}, newError("E012", span, fmt.Sprintf("array '%s' must be indexed", node.name)).
+				withLabel("this is an array")
+		}
+		return Value{variable.kind, interp.memory[variable.label][0]}, nil
+	case Index:
+		array, index, err := interp.element(node.name, node.index, Span{expr.pos, len(node.name)})
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{array.kind.elem(), interp.memory[array.label][index]}, nil
+	case Call:
+		return interp.call(node, span)
+	case Unary:
+		if node.symbol == "not" {
+			cond, err := interp.evalCondition(node.expr)
+			return boolValue(!cond), err
+		}
+		if literal, ok := node.expr.node.(IntLiteral); ok && interp.scope.signed && literal.value <= SignedOffset {
+			return interp.wrap(-literal.value), nil
+		}
+		value, err := interp.evalAndExpect(node.expr, Int)
+		if err != nil {
+			return Value{}, err
+		}
+		return interp.wrap(-value.value), nil
+	case Binary:
+		return interp.evalBinary(node, span)
+	}
+	return Value{}, fmt.Errorf("unknown expression at %s", span.pos)
+}
+
+func (interp *Interpreter) evalBinary(bin Binary, span Span) (Value, error) {
+	switch bin.symbol {
+	case "and", "or":
+		left, err := interp.evalCondition(bin.left)
+		if err != nil || left == (bin.symbol == "or") {
+			return boolValue(left), err
+		}
+		right, err := interp.evalCondition(bin.right)
+		return boolValue(right), err
+	}
+
+	first, second := bin.right, bin.left
+	if bin.symbol == "<=" || bin.symbol == ">" {
+		first, second = bin.left, bin.right
+	}
+	firstValue, err := interp.evalAndExpect(first, Int)
+	if err != nil {
+		return Value{}, err
+	}
+	secondValue, err := interp.evalAndExpect(second, Int)
+	if err != nil {
+		return Value{}, err
+	}
+	a, b := secondValue.value, firstValue.value
+	if bin.symbol == "<=" || bin.symbol == ">" {
+		a, b = b, a
+	}
+
+	switch bin.symbol {
+	case "+":
+		return interp.wrap(a + b), nil
+	case "-":
+		return interp.wrap(a - b), nil
+	case "*":
+		return interp.wrap(a * b), nil
+	case "/":
+		// Dividing by zero gives 0, as it does in the runtime routine.
+		if b == 0 {
+			return interp.wrap(0), nil
+		}
+		return interp.wrap(a / b), nil
+	case "%":
+		if b == 0 {
+			return interp.wrap(a), nil
+		}
+		return interp.wrap(a % b), nil
+	case "==":
+		return boolValue(a == b), nil
+	case "!=":
+		return boolValue(a != b), nil
+	case "<":
+		return boolValue(a < b), nil
+	case ">":
+		return boolValue(a > b), nil
+	case "<=":
+		return boolValue(a <= b), nil
+	case ">=":
+		return boolValue(a >= b), nil
+	}
+	return Value{}, unknownOperator(bin.symbol, span)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterpret(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		signed bool
+		input  []int
+		want   []int
+		// err is the message of the error the program stops with, or ""
+		// if it halts.
+		err string
+	}{
+		{"wraps around", "a := in\nout a + 5\nout 3 - a\nout a * 200\n", false, []int{997}, []int{2, 6, 400}, ""},
+		{"signed wraps around", "a := in\nout a + 1\nout -a\nout a * 2\n", true, []int{499}, []int{-500, -499, -2}, ""},
+		{"divides towards zero", "a := in\nb := in\nout a / b\nout a % b\n", true, []int{-7, 2}, []int{-3, -1}, ""},
+		{"divides by zero", "a := in\nb := in\nout a / b\nout a % b\n", false, []int{7, 0}, []int{0, 7}, ""},
+		{"signed divides by zero", "a := in\nb := in\nout a / b\nout a % b\n", true, []int{-7, 0}, []int{0, -7}, ""},
+		{"right operand first", "out in - in\n", false, []int{1, 5}, []int{4}, ""},
+		{"short circuits", "func f() bool {\n    out 1\n    return true\n}\nif false and f() {\n    out 2\n}\nif true or f() {\n    out 3\n}\n", false, nil, []int{3}, ""},
+		{"runs out of input", "out 1\nout in\n", false, nil, []int{1}, "input requested at (2, 5) but no input is left"},
+		{"doesn't halt", "a := 0\nwhile true {\n    a = a + 1\n}\n", false, nil, []int{}, "program did not halt within 50 steps, stopping at (2, 12)"},
+		{"index past the end", "xs: [int; 3]\nout 1\nout xs[in]\n", false, []int{3}, []int{1}, "index 3 is out of range for 'xs', which has 3 elements, at (3, 8)"},
+		{"negative index", "xs: [int; 3]\nxs[in] = 1\n", true, []int{-1}, []int{}, "index -1 is out of range for 'xs', which has 3 elements, at (2, 4)"},
+		{"index in range", "xs: [int; 3]\nxs[in] = in\nout xs[2]\n", false, []int{2, 8}, []int{8}, ""},
+		{"type error that is reached", "out 1\nout true\n", false, nil, []int{1}, "E010"},
+		{"type error that isn't reached", "if false {\n    out true\n}\nout 2\n", false, nil, []int{2}, ""},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		output, err := Interpret(statements, test.input, test.signed, 50)
+		got := ""
+		if diag, ok := err.(Diagnostic); ok {
+			got = diag.code
+		} else if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("%s: got error %q, want %q", test.name, got, test.err)
+		}
+		if test.want != nil && !reflect.DeepEqual(output, test.want) {
+			t.Errorf("%s: got output %v, want %v", test.name, output, test.want)
+		}
+	}
+}
+
+func TestInterpretDeclarations(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []int
+	}{
+		{
+			"uninitialized variable keeps its value",
+			"i := 0\nwhile i < 2 {\n    x: int\n    out x\n    x = 5\n    i = i + 1\n}\n",
+			[]int{0, 5},
+		},
+		{
+			"array keeps its elements",
+			"i := 0\nwhile i < 2 {\n    xs: [int; 2]\n    out xs[0]\n    xs[0] = 5\n    i = i + 1\n}\n",
+			[]int{0, 5},
+		},
+		{
+			"declaration as an unbraced body",
+			"a := 1\nif true\n    a := 2\nout a\n",
+			[]int{2},
+		},
+		{
+			"declaration as an unbraced body that doesn't run",
+			"a := 1\nif false\n    a := 2\nout a\n",
+			[]int{0},
+		},
+		{
+			"function sees the variables declared before it",
+			"a := 1\nfunc f() int {\n    return a\n}\na := 2\nout f()\n",
+			[]int{1},
+		},
+		{
+			"function calling an earlier one",
+			"func double(n: int) int {\n    return n * 2\n}\nfunc quad(n: int) int {\n    return double(double(n))\n}\nout quad(5)\n",
+			[]int{20},
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		output, err := Interpret(statements, nil, false, 1000)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(output, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, output, test.want)
+		}
+	}
+}
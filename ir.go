@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// IRProgram is a three-address representation of the program that sits
+// between the AST and the LMC assembly. Values live in an unlimited supply of
+// virtual temporaries and control flow is made of explicit jumps and
+// conditional branches between blocks, leaving it to the lowering to decide
+// how these map onto the accumulator and mailboxes.
+type IRProgram struct {
+	functions    []*IRFunction
+	vars         []*IRVar
+	labels       map[string]bool
+	temps        int
+	currentBlock int
+	function     *IRFunction
+	origin       int
+}
+
+// IRFunction is the main program when sig is nil and a function otherwise.
+type IRFunction struct {
+	sig    *Signature
+	blocks []*IRBlock
+}
+
+type IRBlock struct {
+	label string
+	insts []IRInst
+}
+
+type IRVar struct {
+	label  string
+	ty     Type
+	kind   BlockKind
+	size   int
+	origin int
+}
+
+// IRInst is a single instruction. The operations are:
+//
+//	dst = copy a
+//	dst = add a, b (also sub, mul, div and mod)
+//	dst = in
+//	out a
+//	dst = load array, index
+//	store array, index, a
+//	dst = call function, args...
+//	jump target
+//	branch a cond b, ifTrue, ifFalse
+//	if a, ifTrue, ifFalse
+//	ret a
+//	halt
+//
+// origin is the index of the top level statement the instruction came from,
+// and span gives the source of an add or sub for overflow checks.
+type IRInst struct {
+	op      string
+	dst     Operand
+	args    []Operand
+	cond    string
+	targets []string
+	name    string
+	comment string
+	origin  int
+	span    Span
+}
+
+type OperandKind int
+
+const (
+	NoOperand    OperandKind = iota
+	TempOperand  OperandKind = iota
+	VarOperand   OperandKind = iota
+	ConstOperand OperandKind = iota
+)
+
+// Operand is a virtual temporary, a variable or a constant, along with the
+// type of the value it holds.
+type Operand struct {
+	kind  OperandKind
+	ty    Type
+	temp  int
+	label string
+	value int
+}
+
+func constant(value int, ty Type) Operand {
+	return Operand{kind: ConstOperand, ty: ty, value: value}
+}
+
+func variable(label string, ty Type) Operand {
+	return Operand{kind: VarOperand, ty: ty, label: label}
+}
+
+func InitIR() IRProgram {
+	ir := IRProgram{labels: make(map[string]bool), origin: -1}
+	for opcode := range opcodes {
+		ir.labels[opcode] = true
+	}
+	for _, label := range trapLabels {
+		ir.labels[label] = true
+	}
+	return ir
+}
+
+func (ir *IRProgram) uniqueLabel(base string) string {
+	label := base
+	for ir.labels[label] {
+		label += "_"
+	}
+	ir.labels[label] = true
+	return label
+}
+
+// newFunction starts a function whose first block is entry, making it the
+// function that new blocks are added to.
+func (ir *IRProgram) newFunction(sig *Signature, entry string) *IRBlock {
+	ir.function = &IRFunction{sig, nil}
+	ir.functions = append(ir.functions, ir.function)
+	return ir.newBlock(entry)
+}
+
+func (ir *IRProgram) newBlock(label string) *IRBlock {
+	ir.labels[label] = true
+	block := &IRBlock{label, []IRInst{}}
+	ir.function.blocks = append(ir.function.blocks, block)
+	return block
+}
+
+func (ir *IRProgram) newUniqueBlock() *IRBlock {
+	block := ir.newBlock(ir.uniqueLabel(fmt.Sprintf("b%d", ir.currentBlock)))
+	ir.currentBlock++
+	return block
+}
+
+func (ir *IRProgram) newTemp(ty Type) Operand {
+	ir.temps++
+	return Operand{kind: TempOperand, ty: ty, temp: ir.temps - 1}
+}
+
+func (ir *IRProgram) createVariable(label string, ty Type, kind BlockKind, size int) {
+	ir.vars = append(ir.vars, &IRVar{label, ty, kind, size, ir.origin})
+}
+
+func (ir *IRProgram) emit(block *IRBlock, inst IRInst) {
+	inst.origin = ir.origin
+	block.insts = append(block.insts, inst)
+}
+
+func (ir *IRProgram) emitOp(block *IRBlock, op string, dst Operand, args ...Operand) {
+	ir.emit(block, IRInst{op: op, dst: dst, args: args})
+}
+
+func (ir *IRProgram) emitJump(block *IRBlock, target *IRBlock) {
+	ir.emit(block, IRInst{op: "jump", targets: []string{target.label}})
+}
+
+func (ir *IRProgram) emitBranch(block *IRBlock, cond string, left, right Operand, ifTrue, ifFalse *IRBlock) {
+	ir.emit(block, IRInst{op: "branch", args: []Operand{left, right}, cond: cond, targets: []string{ifTrue.label, ifFalse.label}})
+}
+
+func (ir *IRProgram) emitIf(block *IRBlock, value Operand, ifTrue, ifFalse *IRBlock) {
+	ir.emit(block, IRInst{op: "if", args: []Operand{value}, targets: []string{ifTrue.label, ifFalse.label}})
+}
+
+func (op Operand) String() string {
+	switch op.kind {
+	case TempOperand:
+		return fmt.Sprintf("%%%d", op.temp)
+	case ConstOperand:
+		return fmt.Sprint(op.value)
+	default:
+		return op.label
+	}
+}
+
+func (inst IRInst) String() string {
+	operands := []string{}
+	if inst.name != "" {
+		operands = append(operands, inst.name)
+	}
+	for _, arg := range inst.args {
+		operands = append(operands, arg.String())
+	}
+	if inst.op == "branch" {
+		operands = []string{operands[0] + " " + inst.cond + " " + operands[1]}
+	}
+	operands = append(operands, inst.targets...)
+
+	text := inst.op
+	if len(operands) > 0 {
+		text += " " + strings.Join(operands, ", ")
+	}
+	switch inst.dst.kind {
+	case TempOperand:
+		text = fmt.Sprintf("%s: %s = %s", inst.dst, inst.dst.ty, text)
+	case VarOperand:
+		text = fmt.Sprintf("%s = %s", inst.dst, text)
+	}
+	return text
+}
+
+// write prints the variables followed by the blocks of the main program and
+// then of each function.
+func (ir *IRProgram) write(w io.Writer) {
+	for _, variable := range ir.vars {
+		switch variable.kind {
+		case ArrayBlock:
+			fmt.Fprintf(w, "array %s: %s[%d]\n", variable.label, variable.ty.elem(), variable.size)
+		case LocalBlock:
+			fmt.Fprintf(w, "local %s: %s\n", variable.label, variable.ty)
+		default:
+			fmt.Fprintf(w, "var %s: %s\n", variable.label, variable.ty)
+		}
+	}
+	for _, function := range ir.functions {
+		fmt.Fprintln(w)
+		if function.sig == nil {
+			fmt.Fprintln(w, "program")
+		} else if function.sig.ret == Undefined {
+			fmt.Fprintf(w, "function %s(%s)\n", function.sig.entry, strings.Join(function.sig.labels, ", "))
+		} else {
+			fmt.Fprintf(w, "function %s(%s): %s\n", function.sig.entry, strings.Join(function.sig.labels, ", "), function.sig.ret)
+		}
+		for _, block := range function.blocks {
+			fmt.Fprintf(w, "%s:\n", block.label)
+			for _, inst := range block.insts {
+				if inst.comment != "" {
+					fmt.Fprintf(w, "\t%s\t// %s\n", inst, inst.comment)
+				} else {
+					fmt.Fprintf(w, "\t%s\n", inst)
+				}
+			}
+		}
+	}
+}
+
+// mentions reports whether the instruction could read or write the variable,
+// which a call always might.
+func (inst IRInst) mentions(label string) bool {
+	if inst.op == "call" || inst.name == label || (inst.dst.kind == VarOperand && inst.dst.label == label) {
+		return true
+	}
+	for _, arg := range inst.args {
+		if arg.kind == VarOperand && arg.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+func noneMention(insts []IRInst, label string) bool {
+	for _, inst := range insts {
+		if inst.mentions(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// coalesceCopies removes copies of a temporary into a variable where the copy
+// is the only use of the temporary, by writing the variable instead wherever
+// the temporary is set. This is only done when nothing mentions the variable
+// between those places and the copy, which is the case for the results of
+// conditions, set on the way to the block that stores them.
+func (ir *IRProgram) coalesceCopies() {
+	for _, function := range ir.functions {
+		for function.coalesceCopy() {
+		}
+	}
+}
+
+type irLocation struct {
+	block *IRBlock
+	index int
+}
+
+func (function *IRFunction) coalesceCopy() bool {
+	uses := make(map[int]int)
+	defs := make(map[int][]irLocation)
+	for _, block := range function.blocks {
+		for i, inst := range block.insts {
+			for _, arg := range inst.args {
+				if arg.kind == TempOperand {
+					uses[arg.temp]++
+				}
+			}
+			if inst.dst.kind == TempOperand {
+				defs[inst.dst.temp] = append(defs[inst.dst.temp], irLocation{block, i})
+			}
+		}
+	}
+
+	for _, block := range function.blocks {
+		for i, inst := range block.insts {
+			if inst.op != "copy" || inst.dst.kind != VarOperand || inst.args[0].kind != TempOperand || uses[inst.args[0].temp] != 1 {
+				continue
+			}
+			locations := defs[inst.args[0].temp]
+			label := inst.dst.label
+			coalesce := len(locations) > 0
+			for _, def := range locations {
+				if def.block == block && def.index < i {
+					coalesce = coalesce && noneMention(block.insts[def.index+1:i], label)
+					continue
+				}
+				last := def.block.insts[len(def.block.insts)-1]
+				coalesce = coalesce && last.op == "jump" && last.targets[0] == block.label &&
+					noneMention(def.block.insts[def.index+1:], label) && noneMention(block.insts[:i], label)
+			}
+			if !coalesce {
+				continue
+			}
+			for _, def := range locations {
+				def.block.insts[def.index].dst = inst.dst
+			}
+			block.insts = append(block.insts[:i], block.insts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
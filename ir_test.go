@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIRWrite(t *testing.T) {
+	source := "xs: [int; 3]\nfunc inc(x: int) int {\n    return x + 1\n}\na := in\nif a > 2 {\n    xs[a - 3] = inc(a)\n} else {\n    out a\n}\nout xs[0]\n"
+	want := `array xs: int[3]
+local inc_x: int
+var a: int
+
+program
+start:
+	a = in
+	branch a > 2, b1, b2
+b1:
+	%2: int = sub a, 3
+	%3: int = call inc, a
+	store xs, %2, %3
+	jump b3
+b2:
+	out a
+	jump b3
+b3:
+	%4: int = load xs, 0
+	out %4
+	halt
+
+function inc(inc_x): int
+inc:
+	%0: int = add inc_x, 1
+	ret %0
+b0:
+	ret 0
+`
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+	ir, errors := BuildIR(statements, false)
+	if len(errors) > 0 {
+		t.Fatal(errors[0])
+	}
+	builder := strings.Builder{}
+	ir.write(&builder)
+	if got := builder.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+// fallsThrough reports whether execution can continue from the end of the
+// block into whichever block is laid out after it.
+func fallsThrough(block *Block) bool {
+	if len(block.insts) == 0 {
+		return true
+	}
+	opcode := block.insts[len(block.insts)-1].opcode
+	return opcode != "BRA" && opcode != "HLT"
+}
+
+// nextCode maps each code block that falls through to the code block after it.
+func (asm *Assembly) nextCode() map[*Block]*Block {
+	next := make(map[*Block]*Block)
+	var prev *Block
+	for _, block := range asm.blocks {
+		if isData(block) {
+			continue
+		}
+		if prev != nil && fallsThrough(prev) {
+			next[prev] = block
+		}
+		prev = block
+	}
+	return next
+}
+
+// removeUnreachable drops every block that can't be reached from the start
+// of the program. A block is reachable if a reachable block falls through to
+// it or mentions its label, which keeps the variables and constants that
+// reachable code uses along with anything a patched instruction may jump to.
+func (asm *Assembly) removeUnreachable() {
+	if len(asm.blocks) == 0 {
+		return
+	}
+	blocks := make(map[string]*Block)
+	for _, block := range asm.blocks {
+		blocks[block.label] = block
+	}
+	next := asm.nextCode()
+
+	reachable := map[*Block]bool{asm.blocks[0]: true}
+	worklist := []*Block{asm.blocks[0]}
+	visit := func(block *Block) {
+		if block != nil && !reachable[block] {
+			reachable[block] = true
+			worklist = append(worklist, block)
+		}
+	}
+	for len(worklist) > 0 {
+		block := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		for _, inst := range block.insts {
+			visit(blocks[inst.operand])
+		}
+		visit(next[block])
+	}
+
+	kept := []*Block{}
+	for _, block := range asm.blocks {
+		if reachable[block] {
+			kept = append(kept, block)
+		}
+	}
+	asm.blocks = kept
+}
+
+// layout reorders the code so that a block is followed by the block it
+// branches to wherever possible, letting it fall through instead of using a
+// BRA. Blocks that already fall through keep their successor, the start block
+// stays first and the data is moved after the code.
+func (asm *Assembly) layout() {
+	next := asm.nextCode()
+	glued := make(map[*Block]bool)
+	for _, successor := range next {
+		glued[successor] = true
+	}
+	code := []*Block{}
+	data := []*Block{}
+	blocks := make(map[string]*Block)
+	for _, block := range asm.blocks {
+		if isData(block) {
+			data = append(data, block)
+		} else {
+			code = append(code, block)
+			blocks[block.label] = block
+		}
+	}
+
+	placed := make(map[*Block]bool)
+	order := []*Block{}
+	for _, block := range code {
+		for block != nil && !placed[block] {
+			placed[block] = true
+			order = append(order, block)
+
+			if successor, prs := next[block]; prs {
+				if placed[successor] {
+					block.emitInstruction("BRA", successor.label)
+				}
+				block = successor
+				continue
+			}
+			if len(block.insts) == 0 {
+				break
+			}
+			last := block.insts[len(block.insts)-1]
+			target, prs := blocks[last.operand]
+			if last.opcode != "BRA" || !prs || placed[target] || glued[target] {
+				break
+			}
+			block.removeInstruction(len(block.insts) - 1)
+			block = target
+		}
+	}
+	asm.blocks = append(order, data...)
+	asm.removeEmptyBlocks()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			"block and variable only unreachable code uses",
+			"LDA x\nBRA b\na LDA y\nOUT\nb HLT\nx DAT\ny DAT\n",
+			"LDA x\nBRA b\nb HLT\nx DAT\n",
+		},
+		{
+			"fall through",
+			"LDA x\na OUT\nHLT\nx DAT\n",
+			"LDA x\na OUT\nHLT\nx DAT\n",
+		},
+		{
+			"label mentioned by a reachable block",
+			"LDA p\nHLT\nr OUT\nHLT\np BRA r\n",
+			"LDA p\nHLT\nr OUT\nHLT\np BRA r\n",
+		},
+	}
+	for _, test := range tests {
+		asm := parseBlocks(test.text)
+		asm.removeUnreachable()
+		if got := blockText(&asm); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			"jumped to blocks follow the jump",
+			"s BRA b\na OUT\nHLT\nb LDA x\nBRA a\nx DAT\n",
+			"b LDA x\na OUT\nHLT\nx DAT\n",
+		},
+		{
+			"falling through is kept",
+			"LDA x\nBRZ c\nb OUT\nBRA d\nc HLT\nd HLT\nx DAT\n",
+			"LDA x\nBRZ c\nb OUT\nd HLT\nc HLT\nx DAT\n",
+		},
+		{
+			"block entered from elsewhere keeps its place",
+			"BRA b\na OUT\nb HLT\n",
+			"BRA b\na OUT\nb HLT\n",
+		},
+		{
+			"data moves after the code",
+			"LDA x\nBRA b\nx DAT\nb OUT\nHLT\n",
+			"LDA x\nb OUT\nHLT\nx DAT\n",
+		},
+	}
+	for _, test := range tests {
+		asm := parseBlocks(test.text)
+		asm.layout()
+		if got := blockText(&asm); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLayoutOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		input  []int
+		want   []int
+	}{
+		{
+			"nested loops",
+			"i := 0\nwhile i < 3 {\n    j := 0\n    while j < i {\n        out j\n        j = j + 1\n    }\n    i = i + 1\n}\n",
+			[]int{},
+			[]int{0, 0, 1},
+		},
+		{
+			"function after unreachable code",
+			"func f(x: int) int {\n    if x > 2 {\n        return 1\n    }\n    return 0\n    out 5\n}\nout f(in)\nout f(in)\n",
+			[]int{3, 1},
+			[]int{1, 0},
+		},
+		{
+			"else if chain",
+			"a := in\nif a < 2 {\n    out 10\n} else if a < 3 {\n    out 20\n} else {\n    out 30\n}\n",
+			[]int{2},
+			[]int{20},
+		},
+		{
+			"else if chain on equal",
+			"a := in\nif a == 1 {\n    out 10\n} else if a == 2 {\n    out 20\n} else if a != 3 {\n    out 30\n} else {\n    out 40\n}\n",
+			[]int{2},
+			[]int{20},
+		},
+	}
+	for _, test := range tests {
+		for _, layout := range []bool{false, true} {
+			got := compileAndRun(t, test.source, Options{peephole: true, layout: layout, share: true}, test.input)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s with layout %t: got %v, want %v", test.name, layout, got, test.want)
+			}
+		}
+	}
+}
+
+func TestLayoutKeepsComments(t *testing.T) {
+	asm := parseBlocks("s BRA b\na OUT\nHLT\nb LDA x\nBRA a\nx DAT\n")
+	asm.blocks[2].insts[1].comment = "loop"
+	asm.layout()
+	if got := blockText(&asm); got != "b LDA x\na OUT\nHLT\nx DAT\n" {
+		t.Fatalf("got %q", got)
+	}
+	if got := asm.blocks[0].insts[0].comment; got != "loop" {
+		t.Errorf("got comment %q on the load, want %q", got, "loop")
+	}
+}
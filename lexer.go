@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	EOFToken     TokenKind = iota
+	IdentToken   TokenKind = iota
+	KeywordToken TokenKind = iota
+	IntToken     TokenKind = iota
+	SymbolToken  TokenKind = iota
+)
+
+// Token is a single word or symbol of the source, which runs from pos up to
+// but not including end.
+type Token struct {
+	kind TokenKind
+	text string
+	pos  Position
+	end  Position
+}
+
+func (token Token) span() Span {
+	return Span{token.pos, len(token.text)}
+}
+
+var keywords = map[string]bool{
+	"if":     true,
+	"else":   true,
+	"while":  true,
+	"func":   true,
+	"return": true,
+	"out":    true,
+	"in":     true,
+	"true":   true,
+	"false":  true,
+	"and":    true,
+	"or":     true,
+	"not":    true,
+}
+
+// symbols lists the operators and punctuation, with the longer symbols first
+// so that "<=" isn't read as "<" followed by "=".
+var symbols = []string{
+	"==", "!=", "<=", ">=",
+	"+", "-", "*", "/", "%", "<", ">", "=",
+	"(", ")", "[", "]", "{", "}", ",", ":", ";",
+}
+
+type Lexer struct {
+	pos      Position
+	source   string
+	tokens   []Token
+	comments []Comment
+	errors   []Diagnostic
+}
+
+// Lex splits the source into tokens, ending with an EOFToken. Comments are
+// returned separately, in the order they appear.
+func Lex(source string) ([]Token, []Comment, []Diagnostic) {
+	lexer := Lexer{Position{1, 1, 0}, source, nil, nil, []Diagnostic{}}
+	for {
+		lexer.skipSpaces()
+		if lexer.eof() {
+			break
+		}
+		lexer.lexToken()
+	}
+	lexer.tokens = append(lexer.tokens, Token{EOFToken, "", lexer.pos, lexer.pos})
+	return lexer.tokens, lexer.comments, lexer.errors
+}
+
+func (lexer *Lexer) peek() rune {
+	r, _ := utf8.DecodeRuneInString(lexer.source[lexer.pos.index:])
+	return r
+}
+
+func (lexer *Lexer) next() {
+	r, size := utf8.DecodeRuneInString(lexer.source[lexer.pos.index:])
+	if r == '\n' {
+		lexer.pos.line++
+		lexer.pos.column = 1
+	} else {
+		lexer.pos.column++
+	}
+	lexer.pos.index += size
+}
+
+func (lexer *Lexer) eof() bool {
+	return lexer.pos.index >= len(lexer.source)
+}
+
+func (lexer *Lexer) error(code string, span Span, msg string) {
+	lexer.errors = append(lexer.errors, newError(code, span, msg))
+}
+
+// skipSpaces skips whitespace along with `//` line comments and `/* */`
+// block comments, which are kept so they can be attached to a statement.
+func (lexer *Lexer) skipSpaces() {
+	for {
+		rest := lexer.source[lexer.pos.index:]
+		switch {
+		case unicode.IsSpace(lexer.peek()):
+			lexer.next()
+		case strings.HasPrefix(rest, "//"):
+			pos := lexer.pos
+			for !lexer.eof() && lexer.peek() != '\n' {
+				lexer.next()
+			}
+			text := lexer.source[pos.index+2 : lexer.pos.index]
+			lexer.comments = append(lexer.comments, Comment{pos, strings.TrimSpace(text)})
+		case strings.HasPrefix(rest, "/*"):
+			pos := lexer.pos
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				lexer.error("E002", Span{pos, 2}, "unterminated block comment")
+				end = len(rest)
+			} else {
+				end += 4
+			}
+			for lexer.pos.index < pos.index+end && !lexer.eof() {
+				lexer.next()
+			}
+			text := strings.TrimSuffix(lexer.source[pos.index+2:lexer.pos.index], "*/")
+			lexer.comments = append(lexer.comments, Comment{pos, strings.Join(strings.Fields(text), " ")})
+		default:
+			return
+		}
+	}
+}
+
+func (lexer *Lexer) lexToken() {
+	pos := lexer.pos
+	r := lexer.peek()
+	switch {
+	case unicode.IsDigit(r):
+		for unicode.IsDigit(lexer.peek()) {
+			lexer.next()
+		}
+		lexer.emit(IntToken, pos)
+	case unicode.IsLetter(r):
+		for unicode.IsLetter(lexer.peek()) || unicode.IsDigit(lexer.peek()) {
+			lexer.next()
+		}
+		if keywords[lexer.source[pos.index:lexer.pos.index]] {
+			lexer.emit(KeywordToken, pos)
+		} else {
+			lexer.emit(IdentToken, pos)
+		}
+	default:
+		for _, symbol := range symbols {
+			if strings.HasPrefix(lexer.source[pos.index:], symbol) {
+				for lexer.pos.index < pos.index+len(symbol) {
+					lexer.next()
+				}
+				lexer.emit(SymbolToken, pos)
+				return
+			}
+		}
+		lexer.next()
+		lexer.error("E001", Span{pos, lexer.pos.index - pos.index}, "unexpected character '"+string(r)+"'")
+	}
+}
+
+func (lexer *Lexer) emit(kind TokenKind, pos Position) {
+	lexer.tokens = append(lexer.tokens, Token{kind, lexer.source[pos.index:lexer.pos.index], pos, lexer.pos})
+}
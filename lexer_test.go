@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tokenText writes the tokens before the end of the source as their text,
+// with identifiers marked by $ and keywords by #.
+func tokenText(tokens []Token) string {
+	words := []string{}
+	for _, token := range tokens {
+		switch token.kind {
+		case IdentToken:
+			words = append(words, "$"+token.text)
+		case KeywordToken:
+			words = append(words, "#"+token.text)
+		case IntToken, SymbolToken:
+			words = append(words, token.text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"keywords", "if else while func return out in true false and or not", "#if #else #while #func #return #out #in #true #false #and #or #not"},
+		{"keywords inside identifiers", "iffy elsewhere whilst funcs returned outer input trueish falsey android order nothing", "$iffy $elsewhere $whilst $funcs $returned $outer $input $trueish $falsey $android $order $nothing"},
+		{"identifiers ending in a keyword", "xif myin notout", "$xif $myin $notout"},
+		{"digits in identifiers", "in2 if3x x10", "$in2 $if3x $x10"},
+		{"letters outside ascii", "été := 1", "$été : = 1"},
+		{"keyword next to a symbol", "if(x)out-1", "#if ( $x ) #out - 1"},
+		{"number then keyword", "3in", "3 #in"},
+		{"longest symbol first", "a<=b>=c==d!=e<f>g=h", "$a <= $b >= $c == $d != $e < $f > $g = $h"},
+		{"symbols", "+-*/%()[]{},:;", "+ - * / % ( ) [ ] { } , : ;"},
+		{"line comment", "a // if b\nout a", "$a #out $a"},
+		{"block comment between tokens", "a/* while */b", "$a $b"},
+		{"block comment over lines", "x /* a\nb */ := 1", "$x : = 1"},
+		{"comment at the end", "out 1 //", "#out 1"},
+		{"division isn't a comment", "a / b", "$a / $b"},
+	}
+	for _, test := range tests {
+		tokens, _, errors := Lex(test.source)
+		if len(errors) > 0 {
+			t.Errorf("%s: %s", test.name, errors[0])
+			continue
+		}
+		if got := tokenText(tokens); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if last := tokens[len(tokens)-1]; last.kind != EOFToken || last.pos.index != len(test.source) {
+			t.Errorf("%s: doesn't end with an EOFToken at the end of the source", test.name)
+		}
+	}
+}
+
+func TestLexComments(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []Comment
+	}{
+		{"// hello  \nout 1", []Comment{{Position{1, 1, 0}, "hello"}}},
+		{"out 1 /* two\n   lines */", []Comment{{Position{1, 7, 6}, "two lines"}}},
+		{"a//b\n//c", []Comment{{Position{1, 2, 1}, "b"}, {Position{2, 1, 5}, "c"}}},
+		{"/**/", []Comment{{Position{1, 1, 0}, ""}}},
+		{"/* a // b */ c", []Comment{{Position{1, 1, 0}, "a // b"}}},
+	}
+	for _, test := range tests {
+		_, comments, errors := Lex(test.source)
+		if len(errors) > 0 {
+			t.Errorf("%q: %s", test.source, errors[0])
+			continue
+		}
+		if !reflect.DeepEqual(comments, test.want) {
+			t.Errorf("%q: got %v, want %v", test.source, comments, test.want)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		code   string
+		pos    Position
+		want   string
+	}{
+		{"a := 1 /* never closed", "E002", Position{1, 8, 7}, "$a : = 1"},
+		{"a @ b", "E001", Position{1, 3, 2}, "$a $b"},
+		{"x\n  € := 1", "E001", Position{2, 3, 4}, "$x : = 1"},
+		{"a $ b # c", "E001", Position{1, 3, 2}, "$a $b $c"},
+	}
+	for _, test := range tests {
+		tokens, _, errors := Lex(test.source)
+		if len(errors) == 0 {
+			t.Errorf("%q: no errors", test.source)
+			continue
+		}
+		if errors[0].code != test.code || errors[0].primary.span.pos != test.pos {
+			t.Errorf("%q: got %s at %v, want %s at %v", test.source, errors[0].code, errors[0].primary.span.pos, test.code, test.pos)
+		}
+		if got := tokenText(tokens); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestLexPositions(t *testing.T) {
+	tokens, _, _ := Lex("a := 1\n  out a\n")
+	want := []struct {
+		text       string
+		start, end Position
+	}{
+		{"a", Position{1, 1, 0}, Position{1, 2, 1}},
+		{":", Position{1, 3, 2}, Position{1, 4, 3}},
+		{"=", Position{1, 4, 3}, Position{1, 5, 4}},
+		{"1", Position{1, 6, 5}, Position{1, 7, 6}},
+		{"out", Position{2, 3, 9}, Position{2, 6, 12}},
+		{"a", Position{2, 7, 13}, Position{2, 8, 14}},
+		{"", Position{3, 1, 15}, Position{3, 1, 15}},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens, want %d", len(tokens), len(want))
+	}
+	for i, token := range tokens {
+		if token.text != want[i].text || token.pos != want[i].start || token.end != want[i].end {
+			t.Errorf("token %d: got %q from %v to %v, want %q from %v to %v", i, token.text, token.pos, token.end, want[i].text, want[i].start, want[i].end)
+		}
+	}
+}
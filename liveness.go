@@ -0,0 +1,238 @@
+package main
+
+// Liveness records which of the shareable mailboxes may still be read at the
+// start of each code block.
+type Liveness struct {
+	asm        *Assembly
+	candidates map[string]bool
+	blocks     map[string]*Block
+	next       map[*Block]*Block
+	patched    map[string]bool
+	returns    []string
+	liveIn     map[*Block]map[string]bool
+}
+
+// isShareable reports whether a data block's mailbox can be given to another
+// value while it isn't live.
+func isShareable(block *Block) bool {
+	return block.kind == TempBlock || block.kind == LocalBlock
+}
+
+func (asm *Assembly) initLiveness() Liveness {
+	liveness := Liveness{
+		asm:        asm,
+		candidates: make(map[string]bool),
+		blocks:     make(map[string]*Block),
+		next:       asm.nextCode(),
+		patched:    make(map[string]bool),
+		liveIn:     make(map[*Block]map[string]bool),
+	}
+	for _, block := range asm.blocks {
+		liveness.blocks[block.label] = block
+		if isShareable(block) {
+			liveness.candidates[block.label] = true
+		}
+	}
+	for _, block := range asm.blocks {
+		for _, inst := range block.insts {
+			if !isData(block) && inst.opcode == "STA" {
+				liveness.patched[inst.operand] = true
+			}
+			if isData(block) {
+				// A mailbox mentioned by data may be accessed by patched
+				// instructions, while a branch held as data is the way
+				// back from a call.
+				delete(liveness.candidates, inst.operand)
+				if inst.opcode == "BRA" {
+					liveness.returns = append(liveness.returns, inst.operand)
+				}
+			}
+		}
+	}
+	return liveness
+}
+
+func (liveness *Liveness) in(label string) map[string]bool {
+	if block, prs := liveness.blocks[label]; prs {
+		return liveness.liveIn[block]
+	}
+	return nil
+}
+
+func union(dst, src map[string]bool) {
+	for label := range src {
+		dst[label] = true
+	}
+}
+
+// scan walks the block backwards from what is live at its end, calling def
+// for every store to a candidate with its index and the set that is live
+// after it, and returns what is live at its start.
+func (liveness *Liveness) scan(block *Block, def func(int, string, map[string]bool)) map[string]bool {
+	live := make(map[string]bool)
+	if next, prs := liveness.next[block]; prs {
+		union(live, liveness.liveIn[next])
+	}
+	for i := len(block.insts) - 1; i >= 0; i-- {
+		inst := block.insts[i]
+		switch inst.opcode {
+		case "BRA":
+			live = make(map[string]bool)
+			union(live, liveness.in(inst.operand))
+		case "BRZ", "BRP":
+			union(live, liveness.in(inst.operand))
+		case "HLT":
+			live = make(map[string]bool)
+			if i == 0 && liveness.patched[block.label] {
+				// The exit of a routine, which is overwritten with a branch
+				// back to one of its callers.
+				for _, label := range liveness.returns {
+					union(live, liveness.in(label))
+				}
+			}
+		case "STA":
+			if liveness.candidates[inst.operand] {
+				if def != nil {
+					def(i, inst.operand, live)
+				}
+				delete(live, inst.operand)
+			}
+		case "LDA", "ADD", "SUB":
+			if liveness.candidates[inst.operand] {
+				live[inst.operand] = true
+			}
+		}
+	}
+	return live
+}
+
+// solve repeats the backwards scan over every block until what is live at
+// the start of each block stops changing.
+func (liveness *Liveness) solve() {
+	for changed := true; changed; {
+		changed = false
+		for i := len(liveness.asm.blocks) - 1; i >= 0; i-- {
+			block := liveness.asm.blocks[i]
+			if isData(block) {
+				continue
+			}
+			live := liveness.scan(block, nil)
+			if len(live) != len(liveness.liveIn[block]) {
+				liveness.liveIn[block] = live
+				changed = true
+			}
+		}
+	}
+}
+
+// shareMailboxes gives temporaries and local variables whose lifetimes never
+// overlap the same mailbox, returning the number of mailboxes saved. Two
+// values interfere when one is stored to while the other is live, and the
+// interference graph is coloured greedily in the order the values appear.
+func (asm *Assembly) shareMailboxes() int {
+	before := asm.usage().total()
+	liveness := asm.initLiveness()
+	liveness.solve()
+
+	interferes := make(map[string]map[string]bool)
+	for label := range liveness.candidates {
+		interferes[label] = make(map[string]bool)
+	}
+	for _, block := range asm.blocks {
+		if isData(block) {
+			continue
+		}
+		liveness.scan(block, func(i int, label string, live map[string]bool) {
+			for other := range live {
+				if other == label {
+					continue
+				}
+				interferes[label][other] = true
+				interferes[other][label] = true
+			}
+		})
+	}
+
+	colours := []string{}
+	replacements := make(map[string]string)
+	for _, block := range asm.blocks {
+		if !liveness.candidates[block.label] {
+			continue
+		}
+		for _, colour := range colours {
+			shared := true
+			for label, replacement := range replacements {
+				if replacement == colour && interferes[block.label][label] {
+					shared = false
+					break
+				}
+			}
+			if shared && !interferes[block.label][colour] {
+				replacements[block.label] = colour
+				break
+			}
+		}
+		if _, prs := replacements[block.label]; !prs {
+			colours = append(colours, block.label)
+		}
+	}
+
+	kept := []*Block{}
+	for _, block := range asm.blocks {
+		if _, prs := replacements[block.label]; prs {
+			continue
+		}
+		for i, inst := range block.insts {
+			if replacement, prs := replacements[inst.operand]; prs {
+				block.insts[i].operand = replacement
+			}
+		}
+		kept = append(kept, block)
+	}
+	asm.blocks = kept
+	return before - asm.usage().total()
+}
+
+// removeDeadStores drops stores to temporaries and local variables that are
+// never read afterwards, then the mailboxes that nothing mentions any more.
+// Lowering stores every result in a temporary, so a lot of these are left
+// once the loads that followed them have been removed.
+func (asm *Assembly) removeDeadStores() bool {
+	liveness := asm.initLiveness()
+	liveness.solve()
+	changed := false
+	for _, block := range asm.blocks {
+		if isData(block) {
+			continue
+		}
+		// The scan goes backwards, so removing the dead stores in the order
+		// they are found leaves the indexes of the rest as they were.
+		dead := []int{}
+		liveness.scan(block, func(i int, label string, live map[string]bool) {
+			if !live[label] && !(i == 0 && liveness.patched[block.label]) {
+				dead = append(dead, i)
+			}
+		})
+		for _, i := range dead {
+			block.removeInstruction(i)
+			changed = true
+		}
+	}
+
+	mentioned := make(map[string]bool)
+	for _, block := range asm.blocks {
+		for _, inst := range block.insts {
+			mentioned[inst.operand] = true
+		}
+	}
+	kept := []*Block{}
+	for _, block := range asm.blocks {
+		if liveness.candidates[block.label] && !mentioned[block.label] {
+			changed = true
+			continue
+		}
+		kept = append(kept, block)
+	}
+	asm.blocks = kept
+	return changed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// parseTemps reads blocks as parseBlocks does, where data blocks with labels
+// starting with t are temporaries.
+func parseTemps(text string) Assembly {
+	asm := parseBlocks(text)
+	for _, block := range asm.blocks {
+		if isData(block) && block.label[0] == 't' {
+			block.kind = TempBlock
+		}
+	}
+	return asm
+}
+
+func TestShareMailboxes(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		want  string
+		saved int
+	}{
+		{
+			"lifetimes apart",
+			"INP\nSTA t1\nLDA t1\nOUT\nINP\nSTA t2\nLDA t2\nOUT\nHLT\nt1 DAT\nt2 DAT\n",
+			"INP\nSTA t1\nLDA t1\nOUT\nINP\nSTA t1\nLDA t1\nOUT\nHLT\nt1 DAT\n",
+			1,
+		},
+		{
+			"lifetimes overlap",
+			"INP\nSTA t1\nINP\nSTA t2\nLDA t1\nADD t2\nOUT\nHLT\nt1 DAT\nt2 DAT\n",
+			"INP\nSTA t1\nINP\nSTA t2\nLDA t1\nADD t2\nOUT\nHLT\nt1 DAT\nt2 DAT\n",
+			0,
+		},
+		{
+			"live around a loop",
+			"INP\nSTA t1\nl INP\nSTA t2\nLDA t2\nOUT\nLDA t1\nBRZ e\nBRA l\ne HLT\nt1 DAT\nt2 DAT\n",
+			"INP\nSTA t1\nl INP\nSTA t2\nLDA t2\nOUT\nLDA t1\nBRZ e\nBRA l\ne HLT\nt1 DAT\nt2 DAT\n",
+			0,
+		},
+		{
+			"global variables aren't shared",
+			"INP\nSTA v\nLDA v\nOUT\nINP\nSTA t1\nLDA t1\nOUT\nHLT\nv DAT\nt1 DAT\n",
+			"INP\nSTA v\nLDA v\nOUT\nINP\nSTA t1\nLDA t1\nOUT\nHLT\nv DAT\nt1 DAT\n",
+			0,
+		},
+	}
+	for _, test := range tests {
+		asm := parseTemps(test.text)
+		saved := asm.shareMailboxes()
+		if got := blockText(&asm); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if saved != test.saved {
+			t.Errorf("%s: saved %d mailboxes, want %d", test.name, saved, test.saved)
+		}
+	}
+}
+
+func TestRemoveDeadStores(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		changed bool
+	}{
+		{
+			"store never read",
+			"INP\nSTA t1\nINP\nSTA t2\nLDA t2\nOUT\nHLT\nt1 DAT\nt2 DAT\n",
+			"INP\nINP\nSTA t2\nLDA t2\nOUT\nHLT\nt2 DAT\n",
+			true,
+		},
+		{
+			"store overwritten before it is read",
+			"INP\nSTA t1\nINP\nSTA t1\nLDA t1\nOUT\nHLT\nt1 DAT\n",
+			"INP\nINP\nSTA t1\nLDA t1\nOUT\nHLT\nt1 DAT\n",
+			true,
+		},
+		{
+			"store read after a branch",
+			"INP\nSTA t1\nBRZ e\nHLT\ne LDA t1\nOUT\nHLT\nt1 DAT\n",
+			"INP\nSTA t1\nBRZ e\nHLT\ne LDA t1\nOUT\nHLT\nt1 DAT\n",
+			false,
+		},
+		{
+			"store to a global variable",
+			"INP\nSTA v\nHLT\nv DAT\n",
+			"INP\nSTA v\nHLT\nv DAT\n",
+			false,
+		},
+	}
+	for _, test := range tests {
+		asm := parseTemps(test.text)
+		changed := asm.removeDeadStores()
+		if got := blockText(&asm); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if changed != test.changed {
+			t.Errorf("%s: changed is %t, want %t", test.name, changed, test.changed)
+		}
+	}
+}
+
+func TestShareOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		input  []int
+		want   []int
+	}{
+		{
+			"locals of different blocks",
+			"a := in\nif a > 2 {\n    x := a + 1\n    out x\n} else {\n    y := a + 2\n    out y\n}\n{\n    z := a * 2\n    out z\n}\n",
+			[]int{3},
+			[]int{4, 6},
+		},
+		{
+			"locals live across a call",
+			"func f(x: int) int {\n    y := x + 1\n    return y * 2\n}\nfunc g(x: int) int {\n    z := x + 3\n    w := f(z)\n    return w + z\n}\nout g(in)\n",
+			[]int{1},
+			[]int{14},
+		},
+	}
+	for _, test := range tests {
+		for _, share := range []bool{false, true} {
+			got := compileAndRun(t, test.source, Options{peephole: true, layout: true, share: share}, test.input)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s with share %t: got %v, want %v", test.name, share, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SignedOffset is added to every integer in signed mode, so that -500 to 499
+// are held as 0 to 999. Comparing two of these by subtracting them works the
+// same as it does for unsigned integers, and the ten's complement used for
+// input and output is an ADD or SUB of the offset away.
+const SignedOffset = 500
+
+// Lowering translates the IR into LMC assembly an instruction at a time.
+// Every operation loads its operands into the accumulator and stores its
+// result in the mailbox of its temporary, leaving the peephole optimizer and
+// mailbox sharing to remove the loads, stores and mailboxes that turn out not
+// to be needed.
+type Lowering struct {
+	asm       *Assembly
+	temps     map[int]string
+	vars      map[string]*IRVar
+	functions map[string]*IRFunction
+	function  *IRFunction
+}
+
+func (asm *Assembly) lower(ir *IRProgram) {
+	for label := range ir.labels {
+		asm.labels[label] = true
+	}
+	asm.currentBlock = ir.currentBlock
+	lowering := Lowering{asm, make(map[int]string), make(map[string]*IRVar), make(map[string]*IRFunction), nil}
+
+	for _, variable := range ir.vars {
+		lowering.vars[variable.label] = variable
+	}
+	for _, function := range ir.functions {
+		if function.sig != nil {
+			lowering.functions[function.sig.entry] = function
+		}
+	}
+
+	for _, function := range ir.functions {
+		lowering.function = function
+		for _, irBlock := range function.blocks {
+			block := asm.newBlock(irBlock.label)
+			for _, inst := range irBlock.insts {
+				inst := inst
+				start, count := block, len(block.insts)
+				lowering.charge(inst.origin, func() {
+					lowering.lowerInstruction(&block, inst)
+				})
+				if asm.options.comments && inst.comment != "" && len(start.insts) > count {
+					start.insts[count].comment = inst.comment
+				}
+			}
+		}
+		if function.sig != nil {
+			asm.newBlock(function.sig.exit).emitInstruction("HLT", "")
+		}
+	}
+
+	// The variables come after the code, as the program starts at the first
+	// block.
+	for _, variable := range ir.vars {
+		variable := variable
+		value := 0
+		if asm.options.signed && (variable.ty == Int || variable.ty == IntArray) {
+			value = SignedOffset
+		}
+		lowering.charge(variable.origin, func() {
+			if variable.kind == ArrayBlock {
+				asm.createArray(variable.label, variable.size, value)
+			} else {
+				asm.createVariable(variable.label, value, variable.kind)
+			}
+		})
+	}
+}
+
+// charge adds the mailboxes used while lowering to the top level statement
+// they came from.
+func (lowering *Lowering) charge(origin int, lower func()) {
+	asm := lowering.asm
+	before := asm.usage()
+	lower()
+	if origin >= 0 && origin < len(asm.statementUsage) {
+		usage := &asm.statementUsage[origin].usage
+		*usage = usage.plus(asm.usage().minus(before))
+	}
+}
+
+// operand returns the label of the mailbox holding an operand, creating the
+// mailbox for a temporary or constant the first time it is needed.
+func (lowering *Lowering) operand(op Operand) string {
+	switch op.kind {
+	case TempOperand:
+		label, prs := lowering.temps[op.temp]
+		if !prs {
+			label = lowering.asm.uniqueLabel(fmt.Sprintf("temp%d", op.temp))
+			lowering.asm.createVariable(label, 0, TempBlock)
+			lowering.temps[op.temp] = label
+		}
+		return label
+	case ConstOperand:
+		if lowering.asm.options.signed && op.ty == Int {
+			return lowering.asm.getConstant(wrap(op.value + SignedOffset))
+		}
+		return lowering.asm.getConstant(op.value)
+	default:
+		return op.label
+	}
+}
+
+func wrap(value int) int {
+	return (value%1000 + 1000) % 1000
+}
+
+// loadRaw loads an operand as the number the machine works with, which for
+// an integer in signed mode is its ten's complement.
+func (lowering *Lowering) loadRaw(block *Block, op Operand) {
+	asm := lowering.asm
+	if !asm.options.signed || op.ty != Int {
+		block.emitInstruction("LDA", lowering.operand(op))
+	} else if op.kind == ConstOperand {
+		block.emitInstruction("LDA", asm.getConstant(wrap(op.value)))
+	} else {
+		block.emitInstruction("LDA", lowering.operand(op))
+		block.emitInstruction("SUB", asm.getConstant(SignedOffset))
+	}
+}
+
+// fromRaw turns the ten's complement integer in the accumulator back into the
+// signed representation.
+func (lowering *Lowering) fromRaw(block *Block) {
+	if lowering.asm.options.signed {
+		block.emitInstruction("ADD", lowering.asm.getConstant(SignedOffset))
+	}
+}
+
+func (lowering *Lowering) lowerInstruction(block **Block, inst IRInst) {
+	asm := lowering.asm
+	switch inst.op {
+	case "copy":
+		(*block).emitInstruction("LDA", lowering.operand(inst.args[0]))
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "add", "sub":
+		if asm.options.checkOverflow {
+			lowering.lowerCheckedArithmetic(block, inst)
+			break
+		}
+		(*block).emitInstruction("LDA", lowering.operand(inst.args[0]))
+		(*block).emitInstruction(strings.ToUpper(inst.op), lowering.operand(inst.args[1]))
+		if asm.options.signed {
+			// Both operands carry the offset, so the sum has it twice and
+			// the difference not at all.
+			if inst.op == "add" {
+				(*block).emitInstruction("SUB", asm.getConstant(SignedOffset))
+			} else {
+				(*block).emitInstruction("ADD", asm.getConstant(SignedOffset))
+			}
+		}
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "mul":
+		name := "mul"
+		if asm.options.signed {
+			name = "smul"
+		}
+		lowering.lowerRoutineCall(block, asm.useRoutine(name, 2, 1), inst.args)
+		lowering.fromRaw(*block)
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "div", "mod":
+		routine := asm.useRoutine("div", 2, 1)
+		if asm.options.signed {
+			routine = asm.useRoutine("sdiv", 2, 3)
+		}
+		lowering.lowerRoutineCall(block, routine, inst.args)
+		if inst.op == "mod" {
+			(*block).emitInstruction("LDA", routine.args[0])
+		}
+		lowering.fromRaw(*block)
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "in":
+		(*block).emitInstruction("INP", "")
+		lowering.fromRaw(*block)
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "out":
+		lowering.loadRaw(*block, inst.args[0])
+		(*block).emitInstruction("OUT", "")
+	case "load":
+		patched := lowering.lowerElementAddress(block, inst.name, "LDA", inst.args[0])
+		(*block).emitInstruction("BRA", patched.label)
+		*block = patched
+		(*block).emitInstruction("STA", lowering.operand(inst.dst))
+	case "store":
+		patched := lowering.lowerElementAddress(block, inst.name, "STA", inst.args[0])
+		(*block).emitInstruction("LDA", lowering.operand(inst.args[1]))
+		(*block).emitInstruction("BRA", patched.label)
+		*block = patched
+	case "call":
+		sig := lowering.functions[inst.name].sig
+		for i, arg := range inst.args {
+			(*block).emitInstruction("LDA", lowering.operand(arg))
+			(*block).emitInstruction("STA", sig.labels[i])
+		}
+		asm.emitCall(block, sig.entry, sig.exit)
+		if inst.dst.kind != NoOperand {
+			(*block).emitInstruction("STA", lowering.operand(inst.dst))
+		}
+	case "jump":
+		(*block).emitInstruction("BRA", inst.targets[0])
+	case "branch":
+		lowering.lowerBranch(*block, inst)
+	case "if":
+		(*block).emitInstruction("LDA", lowering.operand(inst.args[0]))
+		(*block).emitInstruction("BRZ", inst.targets[1])
+		(*block).emitInstruction("BRA", inst.targets[0])
+	case "ret":
+		if len(inst.args) > 0 {
+			(*block).emitInstruction("LDA", lowering.operand(inst.args[0]))
+		}
+		(*block).emitInstruction("BRA", lowering.function.sig.exit)
+	case "halt":
+		(*block).emitInstruction("HLT", "")
+	default:
+		panic("unknown IR operation " + inst.op)
+	}
+}
+
+// lowerCheckedArithmetic adds or subtracts, branching to an overflow trap
+// when the result is out of range. ADD never sets the negative flag, so an
+// addition that wraps around is caught by subtracting a from the result,
+// which underflows exactly when the result is smaller than a.
+func (lowering *Lowering) lowerCheckedArithmetic(block **Block, inst IRInst) {
+	asm := lowering.asm
+	a, b := lowering.operand(inst.args[0]), lowering.operand(inst.args[1])
+	trap := asm.overflowSite(inst.span)
+	done := asm.newUniqueBlock()
+
+	switch {
+	case !asm.options.signed && inst.op == "add":
+		(*block).emitInstruction("LDA", a)
+		(*block).emitInstruction("ADD", b)
+		(*block).emitInstruction("SUB", a)
+		(*block).emitInstruction("BRP", done.label)
+		(*block).emitInstruction("BRA", trap.label)
+		done.emitInstruction("ADD", a)
+	case !asm.options.signed:
+		(*block).emitInstruction("LDA", a)
+		(*block).emitInstruction("SUB", b)
+		(*block).emitInstruction("BRP", done.label)
+		(*block).emitInstruction("BRA", trap.label)
+	case inst.op == "add":
+		// The accumulator starts as b's value, which is added to a. When
+		// it is negative it holds that value plus 1000, so the addition
+		// has to wrap around for the result to be in range.
+		positive, negative := asm.newUniqueBlock(), asm.newUniqueBlock()
+		(*block).emitInstruction("LDA", b)
+		(*block).emitInstruction("SUB", asm.getConstant(SignedOffset))
+		(*block).emitInstruction("BRP", positive.label)
+		(*block).emitInstruction("BRA", negative.label)
+		positive.emitInstruction("ADD", a)
+		positive.emitInstruction("SUB", a)
+		positive.emitInstruction("BRP", done.label)
+		positive.emitInstruction("BRA", trap.label)
+		negative.emitInstruction("ADD", a)
+		negative.emitInstruction("SUB", a)
+		negative.emitInstruction("BRP", trap.label)
+		negative.emitInstruction("BRA", done.label)
+		done.emitInstruction("ADD", a)
+	default:
+		// The accumulator starts as a's value, which b is subtracted from.
+		// When it is positive the result is in range only if this
+		// underflows, and when it is negative it holds the value plus 1000
+		// and must not underflow.
+		positive, negative := asm.newUniqueBlock(), asm.newUniqueBlock()
+		(*block).emitInstruction("LDA", a)
+		(*block).emitInstruction("SUB", asm.getConstant(SignedOffset))
+		(*block).emitInstruction("BRP", positive.label)
+		(*block).emitInstruction("BRA", negative.label)
+		positive.emitInstruction("SUB", b)
+		positive.emitInstruction("BRP", trap.label)
+		positive.emitInstruction("BRA", done.label)
+		negative.emitInstruction("SUB", b)
+		negative.emitInstruction("BRP", done.label)
+		negative.emitInstruction("BRA", trap.label)
+	}
+	done.emitInstruction("STA", lowering.operand(inst.dst))
+	*block = done
+}
+
+// lowerRoutineCall passes the operands as the arguments to a runtime routine,
+// which leaves its result in the accumulator. Routines work on ten's
+// complement integers in signed mode.
+func (lowering *Lowering) lowerRoutineCall(block **Block, routine *Routine, args []Operand) {
+	for i, arg := range args {
+		lowering.loadRaw(*block, arg)
+		(*block).emitInstruction("STA", routine.args[i])
+	}
+	lowering.asm.emitCall(block, routine.entry, routine.exit)
+}
+
+// lowerBranch subtracts one side of the comparison from the other, as BRP is
+// the only way to compare two values. The difference is only zero when they
+// are equal, as it wraps around to between 1 and 999 when it underflows, so
+// == and != branch on BRZ instead.
+func (lowering *Lowering) lowerBranch(block *Block, inst IRInst) {
+	left, right := lowering.operand(inst.args[0]), lowering.operand(inst.args[1])
+	ifTrue, ifFalse := inst.targets[0], inst.targets[1]
+	branch := "BRP"
+	switch inst.cond {
+	case "==":
+		branch = "BRZ"
+	case "!=":
+		branch = "BRZ"
+		ifTrue, ifFalse = ifFalse, ifTrue
+	case "<":
+		ifTrue, ifFalse = ifFalse, ifTrue
+	case "<=":
+		left, right = right, left
+	case ">":
+		left, right = right, left
+		ifTrue, ifFalse = ifFalse, ifTrue
+	}
+	block.emitInstruction("LDA", left)
+	block.emitInstruction("SUB", right)
+	block.emitInstruction(branch, ifTrue)
+	block.emitInstruction("BRA", ifFalse)
+}
+
+// lowerElementAddress emits code that writes an instruction accessing element
+// index of the array into a new block, which the caller must branch to once
+// the accumulator is ready. The LMC can't address memory indirectly, so the
+// array's base instruction is added to the index and stored over the first
+// instruction of that block.
+func (lowering *Lowering) lowerElementAddress(block **Block, label, opcode string, index Operand) *Block {
+	asm := lowering.asm
+	lowering.loadRaw(*block, index)
+	if asm.options.boundsCheck {
+		trap := asm.boundsTrap()
+		(*block).emitInstruction("STA", trap.index)
+		(*block).emitInstruction("SUB", asm.getConstant(lowering.vars[label].size))
+		(*block).emitInstruction("BRP", trap.label)
+		(*block).emitInstruction("LDA", trap.index)
+	}
+	patched := asm.newUniqueBlock()
+	(*block).emitInstruction("ADD", asm.getInstructionConstant(opcode, label))
+	(*block).emitInstruction("STA", patched.label)
+	patched.emitInstruction(opcode, label)
+	return patched
+}
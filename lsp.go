@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Server answers Language Server Protocol requests about the open documents,
+// which it parses and compiles whenever they change.
+type Server struct {
+	out       io.Writer
+	signed    bool
+	documents map[string]*Document
+	shutdown  bool
+}
+
+// Document is the latest version of an open source file. The statements and
+// references are only kept while it parses, as positions in a version that
+// doesn't parse can't be matched up with an earlier one.
+type Document struct {
+	source     string
+	statements []Statement
+	references []Reference
+}
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+type lspRelated struct {
+	Location lspLocation `json:"location"`
+	Message  string      `json:"message"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange     `json:"range"`
+	Severity int          `json:"severity"`
+	Code     string       `json:"code,omitempty"`
+	Source   string       `json:"source"`
+	Message  string       `json:"message"`
+	Related  []lspRelated `json:"relatedInformation,omitempty"`
+}
+
+type lspSymbol struct {
+	Name           string      `json:"name"`
+	Detail         string      `json:"detail,omitempty"`
+	Kind           int         `json:"kind"`
+	Range          lspRange    `json:"range"`
+	SelectionRange lspRange    `json:"selectionRange"`
+	Children       []lspSymbol `json:"children,omitempty"`
+}
+
+// The kinds of symbol and severities of diagnostics used from the protocol.
+const (
+	lspFunctionSymbol = 12
+	lspVariableSymbol = 13
+	lspArraySymbol    = 18
+
+	lspError   = 1
+	lspWarning = 2
+)
+
+func lspCommand(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	signed := flags.Bool("signed", false, "whether integers go from -500 to 499 instead of 0 to 999")
+	flags.Parse(args)
+
+	server := InitServer(os.Stdout, *signed)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		body, err := readMessage(reader)
+		if err == io.EOF {
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		msg := lspMessage{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if msg.Method == "exit" {
+			if server.shutdown {
+				os.Exit(0)
+			}
+			os.Exit(1)
+		}
+		server.handle(msg)
+	}
+}
+
+func InitServer(out io.Writer, signed bool) Server {
+	return Server{out, signed, make(map[string]*Document), false}
+}
+
+// readMessage reads the body of a message, which follows headers giving its
+// length.
+func readMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length '%s'", parts[1])
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without a Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(reader, body)
+	return body, err
+}
+
+func (server *Server) send(msg interface{}) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(server.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (server *Server) reply(id *json.RawMessage, result interface{}) {
+	server.send(struct {
+		JSONRPC string           `json:"jsonrpc"`
+		ID      *json.RawMessage `json:"id"`
+		Result  interface{}      `json:"result"`
+	}{"2.0", id, result})
+}
+
+func (server *Server) replyError(id *json.RawMessage, code int, msg string) {
+	type lspError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	server.send(struct {
+		JSONRPC string           `json:"jsonrpc"`
+		ID      *json.RawMessage `json:"id"`
+		Error   lspError         `json:"error"`
+	}{"2.0", id, lspError{code, msg}})
+}
+
+func (server *Server) notify(method string, params interface{}) {
+	server.send(struct {
+		JSONRPC string      `json:"jsonrpc"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params"`
+	}{"2.0", method, params})
+}
+
+// handle answers a request, or acts on a notification, which has no ID.
+// Notifications the server doesn't know about are ignored.
+func (server *Server) handle(msg lspMessage) {
+	var params struct {
+		lspPositionParams
+		ContentChanges []lspTextDocument `json:"contentChanges"`
+	}
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			if msg.ID != nil {
+				server.replyError(msg.ID, -32602, err.Error())
+			}
+			return
+		}
+	}
+	uri := params.TextDocument.URI
+
+	switch msg.Method {
+	case "initialize":
+		server.reply(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1,
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "lmcc"},
+		})
+	case "shutdown":
+		server.shutdown = true
+		server.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		server.update(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		// Only whole documents are synced, so the last change is all of it.
+		if len(params.ContentChanges) > 0 {
+			server.update(uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		delete(server.documents, uri)
+		server.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+	case "textDocument/hover":
+		server.reply(msg.ID, server.hover(uri, params.Position))
+	case "textDocument/definition":
+		server.reply(msg.ID, server.definition(uri, params.Position))
+	case "textDocument/documentSymbol":
+		symbols := []lspSymbol{}
+		if doc, prs := server.documents[uri]; prs {
+			symbols = doc.symbols(doc.statements)
+		}
+		server.reply(msg.ID, symbols)
+	default:
+		if msg.ID != nil {
+			server.replyError(msg.ID, -32601, "unknown method "+msg.Method)
+		}
+	}
+}
+
+// update parses and compiles a new version of a document, and publishes its
+// errors.
+func (server *Server) update(uri, source string) {
+	doc := &Document{source: source}
+	errors := []error{}
+	statements, parseErrors := Parse(source)
+	for _, diag := range parseErrors {
+		errors = append(errors, diag)
+	}
+	if len(parseErrors) == 0 {
+		var scope Scope
+		_, scope, errors = compile(Fold(statements, server.signed), Options{peephole: true, layout: true, share: true, signed: server.signed})
+		doc.statements = statements
+		doc.references = scope.references
+	}
+	server.documents[uri] = doc
+
+	diagnostics := []lspDiagnostic{}
+	for _, err := range errors {
+		diagnostics = append(diagnostics, doc.diagnostic(uri, err))
+	}
+	server.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diagnostics})
+}
+
+func (doc *Document) diagnostic(uri string, err error) lspDiagnostic {
+	diag, ok := err.(Diagnostic)
+	if !ok {
+		return lspDiagnostic{Severity: lspError, Source: "lmcc", Message: err.Error()}
+	}
+	severity := lspError
+	if diag.severity == WarningSeverity {
+		severity = lspWarning
+	}
+	msg := diag.msg
+	if diag.help != "" {
+		msg += "\nhelp: " + diag.help
+	}
+	related := []lspRelated{}
+	for _, label := range diag.labels {
+		related = append(related, lspRelated{lspLocation{uri, doc.lspRange(label.span)}, label.text})
+	}
+	return lspDiagnostic{doc.lspRange(diag.primary.span), severity, diag.code, "lmcc", msg, related}
+}
+
+// reference finds the variable or function named at the position.
+func (doc *Document) reference(pos lspPosition) (Reference, bool) {
+	index := doc.index(pos)
+	for _, ref := range doc.references {
+		if ref.span.pos.index <= index && index <= ref.span.pos.index+ref.span.length {
+			return ref, true
+		}
+	}
+	return Reference{}, false
+}
+
+func (server *Server) hover(uri string, pos lspPosition) interface{} {
+	doc, prs := server.documents[uri]
+	if !prs {
+		return nil
+	}
+	ref, prs := doc.reference(pos)
+	if !prs {
+		return nil
+	}
+	var text string
+	if ref.variable != nil {
+		text = fmt.Sprintf("```\n%s: %s\n```\nstored in the mailbox labelled `%s`", ref.variable.name, variableType(ref.variable), ref.variable.label)
+	} else {
+		text = fmt.Sprintf("```\nfunc %s\n```\nstarts at the label `%s`", doc.signature(ref.function), ref.function.entry)
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range":    doc.lspRange(ref.span),
+	}
+}
+
+func (server *Server) definition(uri string, pos lspPosition) interface{} {
+	doc, prs := server.documents[uri]
+	if !prs {
+		return nil
+	}
+	ref, prs := doc.reference(pos)
+	if !prs {
+		return nil
+	}
+	if ref.variable != nil {
+		return lspLocation{uri, doc.lspRange(ref.variable.span)}
+	}
+	return lspLocation{uri, doc.lspRange(ref.function.name)}
+}
+
+// variableType writes the type of a variable as it is declared.
+func variableType(variable *Variable) string {
+	if variable.kind.isArray() {
+		return fmt.Sprintf("[%s; %d]", variable.kind.elem(), variable.size)
+	}
+	return variable.kind.String()
+}
+
+// signature writes the name, parameter types and return type of a function.
+func (doc *Document) signature(sig *Signature) string {
+	params := []string{}
+	for _, param := range sig.params {
+		params = append(params, param.String())
+	}
+	text := fmt.Sprintf("%s(%s)", doc.text(sig.name), strings.Join(params, ", "))
+	if sig.ret != Undefined {
+		text += " " + sig.ret.String()
+	}
+	return text
+}
+
+// symbols lists the variables and functions declared by the statements, with
+// the variables declared in a function as its children.
+func (doc *Document) symbols(statements []Statement) []lspSymbol {
+	symbols := []lspSymbol{}
+	for _, statement := range statements {
+		switch node := statement.node.(type) {
+		case Declare:
+			name := Span{statement.pos, len(node.name)}
+			kind := lspVariableSymbol
+			if node.size > 0 {
+				kind = lspArraySymbol
+			}
+			detail := ""
+			if ref, prs := doc.declaration(name); prs {
+				detail = variableType(ref.variable)
+			}
+			symbols = append(symbols, lspSymbol{node.name, detail, kind, doc.lspRange(statement.span()), doc.lspRange(name), nil})
+		case BlockScope:
+			symbols = append(symbols, doc.symbols(node.statements)...)
+		case If:
+			symbols = append(symbols, doc.symbols([]Statement{node.ifTrue, node.ifFalse})...)
+		case While:
+			symbols = append(symbols, doc.symbols([]Statement{node.loop})...)
+		case Function:
+			name := Span{node.pos, len(node.name)}
+			children := []lspSymbol{}
+			for _, param := range node.params {
+				span := doc.lspRange(Span{param.pos, len(param.name)})
+				children = append(children, lspSymbol{param.name, param.ty.String(), lspVariableSymbol, span, span, nil})
+			}
+			children = append(children, doc.symbols([]Statement{node.body})...)
+			detail := ""
+			if ref, prs := doc.declaration(name); prs {
+				detail = "func " + doc.signature(ref.function)
+			}
+			symbols = append(symbols, lspSymbol{node.name, detail, lspFunctionSymbol, doc.lspRange(statement.span()), doc.lspRange(name), children})
+		}
+	}
+	return symbols
+}
+
+// declaration finds the reference made by declaring the name at span, which
+// is missing when the program stopped compiling before it.
+func (doc *Document) declaration(span Span) (Reference, bool) {
+	for _, ref := range doc.references {
+		if ref.span == span {
+			return ref, true
+		}
+	}
+	return Reference{}, false
+}
+
+func (doc *Document) text(span Span) string {
+	start, end := doc.clamp(span.pos.index), doc.clamp(span.pos.index+span.length)
+	return doc.source[start:end]
+}
+
+func (doc *Document) clamp(index int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > len(doc.source) {
+		return len(doc.source)
+	}
+	return index
+}
+
+// lspRange converts a span into lines and UTF-16 characters counted from 0,
+// as the protocol uses. Empty spans are put at the start of the document.
+func (doc *Document) lspRange(span Span) lspRange {
+	if span.empty() {
+		return lspRange{}
+	}
+	return lspRange{doc.lspPosition(span.pos.index), doc.lspPosition(span.pos.index + span.length)}
+}
+
+func (doc *Document) lspPosition(index int) lspPosition {
+	before := doc.source[:doc.clamp(index)]
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return lspPosition{strings.Count(before, "\n"), len(utf16.Encode([]rune(before[lineStart:])))}
+}
+
+// index converts a position from the protocol into an index into the source.
+func (doc *Document) index(pos lspPosition) int {
+	index := 0
+	for line := 0; line < pos.Line; line++ {
+		next := strings.IndexByte(doc.source[index:], '\n')
+		if next < 0 {
+			return len(doc.source)
+		}
+		index += next + 1
+	}
+	for i, r := range doc.source[index:] {
+		if pos.Character <= 0 || r == '\n' {
+			return index + i
+		}
+		pos.Character -= len(utf16.Encode([]rune{r}))
+	}
+	return len(doc.source)
+}
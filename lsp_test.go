@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestServerDefinition(t *testing.T) {
+	server := InitServer(ioutil.Discard, false)
+	uri := "file:///test.txt"
+	server.update(uri, "abc := 1\nout abc\n")
+	want := lspLocation{uri, lspRange{lspPosition{0, 0}, lspPosition{0, 3}}}
+	if got := server.definition(uri, lspPosition{1, 5}); got != want {
+		t.Errorf("got definition %v, want %v", got, want)
+	}
+
+	// Positions in a version that doesn't parse can't be matched up with
+	// the last version that did, so there are no results until it parses.
+	server.update(uri, "\n\n\nabc := 1\nout abc\nz := \n")
+	if got := server.definition(uri, lspPosition{4, 5}); got != nil {
+		t.Errorf("after an edit that doesn't parse: got definition %v, want none", got)
+	}
+	if got := server.hover(uri, lspPosition{4, 5}); got != nil {
+		t.Errorf("after an edit that doesn't parse: got hover %v, want none", got)
+	}
+
+	server.update(uri, "\nabc := 1\nout abc\n")
+	want = lspLocation{uri, lspRange{lspPosition{1, 0}, lspPosition{1, 3}}}
+	if got := server.definition(uri, lspPosition{2, 5}); got != want {
+		t.Errorf("after an edit that parses: got definition %v, want %v", got, want)
+	}
+}
+
+// LSPTest drives a server with JSON-RPC messages and reads back what it
+// writes.
+type LSPTest struct {
+	t      *testing.T
+	out    bytes.Buffer
+	server Server
+}
+
+func InitLSPTest(t *testing.T) *LSPTest {
+	test := &LSPTest{t: t}
+	test.server = InitServer(&test.out, false)
+	return test
+}
+
+// send handles a message and checks that the server writes the messages in
+// want, which are compared as JSON values.
+func (test *LSPTest) send(name, msg string, want ...string) {
+	test.t.Helper()
+	parsed := lspMessage{}
+	if err := json.Unmarshal([]byte(msg), &parsed); err != nil {
+		test.t.Fatalf("%s: %s", name, err)
+	}
+	test.server.handle(parsed)
+
+	got := []interface{}{}
+	reader := bufio.NewReader(&test.out)
+	for reader.Buffered() > 0 || test.out.Len() > 0 {
+		body, err := readMessage(reader)
+		if err != nil {
+			test.t.Fatalf("%s: %s", name, err)
+		}
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			test.t.Fatalf("%s: %s", name, err)
+		}
+		got = append(got, value)
+	}
+	test.out.Reset()
+
+	if len(got) != len(want) {
+		test.t.Errorf("%s: got %d messages, want %d: %v", name, len(got), len(want), got)
+		return
+	}
+	for i := range want {
+		var value interface{}
+		if err := json.Unmarshal([]byte(want[i]), &value); err != nil {
+			test.t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(got[i], value) {
+			gotJSON, _ := json.Marshal(got[i])
+			test.t.Errorf("%s: got %s, want %s", name, gotJSON, want[i])
+		}
+	}
+}
+
+// open sends a didOpen notification for the source.
+func (test *LSPTest) open(uri, source string, want ...string) {
+	test.t.Helper()
+	text, _ := json.Marshal(source)
+	test.send("open", `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"`+uri+`","text":`+string(text)+`}}}`, want...)
+}
+
+func TestServerDiagnostics(t *testing.T) {
+	test := InitLSPTest(t)
+	// The emoji takes two UTF-16 characters and é one, while they take four
+	// and two bytes.
+	test.open("file:///a.txt", "/* é\U0001F600 */ out x\nfunc f() {}\nfunc f() {}\n",
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.txt","diagnostics":[
+			{"range":{"start":{"line":0,"character":14},"end":{"line":0,"character":15}},"severity":1,"code":"E011","source":"lmcc",
+				"message":"undefined variable 'x'\nhelp: variables must be declared before they are used, such as with 'x := 0'"},
+			{"range":{"start":{"line":2,"character":0},"end":{"line":2,"character":11}},"severity":1,"code":"E018","source":"lmcc",
+				"message":"function 'f' is already declared",
+				"relatedInformation":[{"location":{"uri":"file:///a.txt","range":{"start":{"line":1,"character":0},"end":{"line":1,"character":11}}},"message":"first declared here"}]}
+		]}}`)
+
+	test.send("syntax error",
+		`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.txt"},"contentChanges":[{"text":"out 1\nout 1 +\n"}]}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.txt","diagnostics":[
+			{"range":{"start":{"line":1,"character":7},"end":{"line":1,"character":7}},"severity":1,"code":"E004","source":"lmcc","message":"expected a value"}
+		]}}`)
+
+	test.send("fixed",
+		`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.txt"},"contentChanges":[{"text":"out 1\n"}]}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.txt","diagnostics":[]}}`)
+
+	// Closing clears the diagnostics and forgets the document.
+	test.open("file:///b.txt", "out y\n", `{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///b.txt","diagnostics":[
+		{"range":{"start":{"line":0,"character":4},"end":{"line":0,"character":5}},"severity":1,"code":"E011","source":"lmcc",
+			"message":"undefined variable 'y'\nhelp: variables must be declared before they are used, such as with 'y := 0'"}
+	]}}`)
+	test.send("close",
+		`{"jsonrpc":"2.0","method":"textDocument/didClose","params":{"textDocument":{"uri":"file:///b.txt"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///b.txt","diagnostics":[]}}`)
+	test.send("hover after closing",
+		`{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///b.txt"},"position":{"line":0,"character":4}}}`,
+		`{"jsonrpc":"2.0","id":1,"result":null}`)
+	test.send("symbols after closing",
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/documentSymbol","params":{"textDocument":{"uri":"file:///b.txt"}}}`,
+		`{"jsonrpc":"2.0","id":2,"result":[]}`)
+}
+
+func TestServerHover(t *testing.T) {
+	test := InitLSPTest(t)
+	test.open("file:///a.txt", "/* é\U0001F600 */ abc := 1\nxs: [int; 3]\nfunc g(a: int, b: bool) int {\n    return a\n}\nout g(abc, true) + xs[0]\n",
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.txt","diagnostics":[]}}`)
+	tests := []struct {
+		name     string
+		position string
+		want     string
+	}{
+		{
+			"variable after characters outside the BMP",
+			`{"line":0,"character":11}`,
+			`{"contents":{"kind":"markdown","value":"` + "```\\nabc: int\\n```" + `\nstored in the mailbox labelled ` + "`abc`" + `"},"range":{"start":{"line":0,"character":10},"end":{"line":0,"character":13}}}`,
+		},
+		{
+			"array",
+			`{"line":5,"character":20}`,
+			`{"contents":{"kind":"markdown","value":"` + "```\\nxs: [int; 3]\\n```" + `\nstored in the mailbox labelled ` + "`xs`" + `"},"range":{"start":{"line":5,"character":19},"end":{"line":5,"character":21}}}`,
+		},
+		{
+			"parameter",
+			`{"line":3,"character":11}`,
+			`{"contents":{"kind":"markdown","value":"` + "```\\na: int\\n```" + `\nstored in the mailbox labelled ` + "`g_a`" + `"},"range":{"start":{"line":3,"character":11},"end":{"line":3,"character":12}}}`,
+		},
+		{
+			"function",
+			`{"line":5,"character":4}`,
+			`{"contents":{"kind":"markdown","value":"` + "```\\nfunc g(int, bool) int\\n```" + `\nstarts at the label ` + "`g`" + `"},"range":{"start":{"line":5,"character":4},"end":{"line":5,"character":5}}}`,
+		},
+		{"keyword", `{"line":5,"character":1}`, `null`},
+		{"past the end of a line", `{"line":1,"character":40}`, `null`},
+	}
+	for i, hover := range tests {
+		id := string(rune('1' + i))
+		test.send(hover.name,
+			`{"jsonrpc":"2.0","id":`+id+`,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.txt"},"position":`+hover.position+`}}`,
+			`{"jsonrpc":"2.0","id":`+id+`,"result":`+hover.want+`}`)
+	}
+}
+
+func TestServerDocumentSymbol(t *testing.T) {
+	test := InitLSPTest(t)
+	test.open("file:///a.txt", "xs: [int; 3]\nfunc g(a: int, b: bool) int {\n    c := a\n    if b {\n        ys: [bool; 2]\n    }\n    return c\n}\nout g(1, true)\n",
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.txt","diagnostics":[]}}`)
+	test.send("symbols",
+		`{"jsonrpc":"2.0","id":1,"method":"textDocument/documentSymbol","params":{"textDocument":{"uri":"file:///a.txt"}}}`,
+		`{"jsonrpc":"2.0","id":1,"result":[
+			{"name":"xs","detail":"[int; 3]","kind":18,
+				"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":12}},
+				"selectionRange":{"start":{"line":0,"character":0},"end":{"line":0,"character":2}}},
+			{"name":"g","detail":"func g(int, bool) int","kind":12,
+				"range":{"start":{"line":1,"character":0},"end":{"line":7,"character":1}},
+				"selectionRange":{"start":{"line":1,"character":5},"end":{"line":1,"character":6}},
+				"children":[
+					{"name":"a","detail":"int","kind":13,
+						"range":{"start":{"line":1,"character":7},"end":{"line":1,"character":8}},
+						"selectionRange":{"start":{"line":1,"character":7},"end":{"line":1,"character":8}}},
+					{"name":"b","detail":"bool","kind":13,
+						"range":{"start":{"line":1,"character":15},"end":{"line":1,"character":16}},
+						"selectionRange":{"start":{"line":1,"character":15},"end":{"line":1,"character":16}}},
+					{"name":"c","detail":"int","kind":13,
+						"range":{"start":{"line":2,"character":4},"end":{"line":2,"character":10}},
+						"selectionRange":{"start":{"line":2,"character":4},"end":{"line":2,"character":5}}},
+					{"name":"ys","detail":"[bool; 2]","kind":18,
+						"range":{"start":{"line":4,"character":8},"end":{"line":4,"character":21}},
+						"selectionRange":{"start":{"line":4,"character":8},"end":{"line":4,"character":10}}}
+				]}
+		]}`)
+}
+
+func TestServerRequests(t *testing.T) {
+	test := InitLSPTest(t)
+	test.send("initialize", `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"textDocumentSync":1,"hoverProvider":true,"definitionProvider":true,"documentSymbolProvider":true},"serverInfo":{"name":"lmcc"}}}`)
+	test.send("unknown request", `{"jsonrpc":"2.0","id":2,"method":"textDocument/completion","params":{}}`,
+		`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"unknown method textDocument/completion"}}`)
+	test.send("unknown notification", `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":2}}`)
+	test.send("invalid params", `{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"position":"here"}}`,
+		`{"jsonrpc":"2.0","id":3,"error":{"code":-32602,"message":"json: cannot unmarshal string into Go struct field .position of type main.lspPosition"}}`)
+	test.send("shutdown", `{"jsonrpc":"2.0","id":4,"method":"shutdown"}`, `{"jsonrpc":"2.0","id":4,"result":null}`)
+	if !test.server.shutdown {
+		t.Error("server isn't shut down after a shutdown request")
+	}
+}
@@ -3,17 +3,61 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			runCommand(os.Args[2:])
+			return
+		case "explain":
+			explainCommand(os.Args[2:])
+			return
+		case "lsp":
+			lspCommand(os.Args[2:])
+			return
+		case "fmt":
+			fmtCommand(os.Args[2:])
+			return
+		case "interp":
+			interpCommand(os.Args[2:])
+			return
+		case "difftest":
+			difftestCommand(os.Args[2:])
+			return
+		case "generate":
+			generateCommand(os.Args[2:])
+			return
+		}
+	}
+
 	debug := flag.Bool("debug", false, "whether to output the AST")
 	outputPath := flag.String("output", "output.txt", "where to write the output to")
+	memory := flag.Bool("memory", false, "whether to print how the mailboxes are used")
+	boundsCheck := flag.Bool("bounds-check", false, "whether to halt when an array index is out of range")
+	comments := flag.Bool("comments", false, "whether to copy source comments into the output assembly")
+	fold := flag.Bool("fold", true, "whether to fold constant expressions before compiling")
+	peephole := flag.Bool("peephole", true, "whether to run the peephole optimizer")
+	layout := flag.Bool("layout", true, "whether to remove unreachable blocks and reorder blocks to avoid branches")
+	share := flag.Bool("share", true, "whether to share mailboxes between temporaries and local variables whose lifetimes don't overlap")
+	format := flag.String("format", "asm", "the output format: asm, numbers, json or dump")
+	checkOverflow := flag.Bool("check-overflow", false, "whether to halt when addition or subtraction goes out of range")
+	signed := flag.Bool("signed", false, "whether integers go from -500 to 499 instead of 0 to 999")
+	emit := flag.String("emit", "asm", "what to write to the output: asm for the compiled program, ir for the intermediate representation or cfg-dot for its control-flow graph")
+	diagnostics := flag.String("diagnostics", "human", "how to print errors: human for text showing the source they refer to, or json")
 	flag.Parse()
 	if len(flag.Args()) < 1 {
 		fmt.Println("no source file")
-		return
+		os.Exit(1)
+	}
+	if *diagnostics != "human" && *diagnostics != "json" {
+		fmt.Printf("unknown value for -diagnostics '%s'\n", *diagnostics)
+		os.Exit(1)
 	}
 	path := flag.Args()[0]
 
@@ -21,12 +65,29 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+
+	// With JSON diagnostics, standard output is kept for the diagnostics and
+	// everything else meant for people goes to standard error.
+	var reports io.Writer = os.Stdout
+	if *diagnostics == "json" {
+		reports = os.Stderr
+	}
+	fail := func(errors []error) {
+		printErrors(errors, path, string(data), *diagnostics)
+		os.Exit(1)
+	}
+
 	ast, parseErrors := Parse(string(data))
 	if len(parseErrors) > 0 {
-		for _, err := range parseErrors {
-			fmt.Println(err)
+		errors := []error{}
+		for _, diag := range parseErrors {
+			errors = append(errors, diag)
 		}
-		return
+		fail(errors)
+	}
+
+	if *fold {
+		ast = Fold(ast, *signed)
 	}
 
 	if *debug {
@@ -34,18 +95,259 @@ func main() {
 		for _, stmt := range ast {
 			stmt.prettyPrint(&builder, "")
 		}
-		fmt.Print(builder.String())
+		fmt.Fprint(reports, builder.String())
+	}
+
+	if *emit == "ir" || *emit == "cfg-dot" {
+		ir, errors := BuildIR(ast, *signed)
+		if len(errors) > 0 {
+			fail(errors)
+		}
+		builder := strings.Builder{}
+		if *emit == "ir" {
+			ir.write(&builder)
+		} else {
+			ir.writeDot(&builder)
+		}
+		if err := ioutil.WriteFile(*outputPath, []byte(builder.String()), 0644); err != nil {
+			panic(err)
+		}
+		printErrors(nil, path, string(data), *diagnostics)
+		return
+	} else if *emit != "asm" {
+		fail([]error{fmt.Errorf("unknown value for -emit '%s'", *emit)})
+	}
+
+	asm, errors := Compile(ast, Options{boundsCheck: *boundsCheck, comments: *comments, peephole: *peephole, layout: *layout, share: *share, signed: *signed, checkOverflow: *checkOverflow})
+	if *memory || asm.usage().total() > MailboxCount {
+		builder := strings.Builder{}
+		asm.writeMemoryReport(&builder, string(data))
+		fmt.Fprint(reports, builder.String())
+	}
+	if len(errors) > 0 {
+		fail(errors)
 	}
 
-	output, errors := Compile(ast)
+	image, errors := asm.link()
 	if len(errors) > 0 {
-		for _, err := range errors {
+		fail(errors)
+	}
+
+	builder := strings.Builder{}
+	switch *format {
+	case "asm":
+		asm.assemble(&builder)
+	case "numbers":
+		image.writeNumbers(&builder)
+	case "json":
+		if err := image.writeJSON(&builder); err != nil {
+			panic(err)
+		}
+	case "dump":
+		image.writeDump(&builder)
+	default:
+		fail([]error{fmt.Errorf("unknown output format '%s'", *format)})
+	}
+
+	if err := ioutil.WriteFile(*outputPath, []byte(builder.String()), 0644); err != nil {
+		panic(err)
+	}
+
+	report := strings.Builder{}
+	asm.writeOverflowReport(&report, string(data))
+	fmt.Fprint(reports, report.String())
+	printErrors(nil, path, string(data), *diagnostics)
+}
+
+// printErrors renders the diagnostics among errors with the source they point
+// to, and prints any other errors as they are. In JSON they are always
+// printed, as an empty list when there are none.
+func printErrors(errors []error, path, source, format string) {
+	if format == "json" {
+		if err := writeDiagnosticsJSON(os.Stdout, errors, path, source); err != nil {
+			panic(err)
+		}
+		return
+	}
+	for _, err := range errors {
+		if diag, ok := err.(Diagnostic); ok {
+			diag.render(os.Stdout, path, source)
+		} else {
 			fmt.Println(err)
 		}
+	}
+}
+
+func explainCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: lmcc explain CODE")
+		os.Exit(1)
+	}
+	code := strings.ToUpper(args[0])
+	explanation, prs := explanations[code]
+	if !prs {
+		fmt.Fprintf(os.Stderr, "unknown error code '%s'\n", args[0])
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %s\n", code, explanation)
+}
+
+// fmtCommand prints each file formatted, or with -w rewrites the files that
+// aren't formatted. With -check it lists them instead.
+func fmtCommand(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "whether to list the files that aren't formatted instead of printing them")
+	write := flags.Bool("w", false, "whether to rewrite the files that aren't formatted")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Println("no source file")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		formatted, errors := Format(string(data))
+		if len(errors) > 0 {
+			for _, diag := range errors {
+				diag.render(os.Stdout, path, string(data))
+			}
+			failed = true
+			continue
+		}
+		switch {
+		case *check:
+			if formatted != string(data) {
+				fmt.Println(path)
+				failed = true
+			}
+		case *write:
+			if formatted != string(data) {
+				if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+					fmt.Println(err)
+					failed = true
+				}
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runCommand(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	input := flags.String("input", "", "comma separated values to feed to INP")
+	maxSteps := flags.Int("steps", 100000, "the number of instructions to execute before giving up")
+	signed := flags.Bool("signed", false, "whether to read and print values as ten's complement integers from -500 to 499")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Println("no assembly file")
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	inputs, err := parseInputs(*input, *signed)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	asm, err := parseAssembly(string(data))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	image, errors := asm.link()
+	if len(errors) > 0 {
+		fmt.Println(errors[0])
+		os.Exit(1)
+	}
+
+	machine := InitMachine(image.memory, inputs)
+	err = machine.run(*maxSteps)
+	output := machine.output
+	trap := machine.trap(&asm, image)
+	if trap != "" {
+		output = output[:len(output)-2]
+	}
+	show := func(value int) int {
+		if *signed && value >= SignedOffset {
+			value -= 1000
+		}
+		return value
+	}
+	for _, value := range output {
+		fmt.Println(show(value))
+	}
+	switch {
+	case err != nil:
+		fmt.Println(err)
+	case trap == "bounds":
+		fmt.Printf("index %d out of range\n", show(machine.output[len(output)+1]))
+	case trap == "overflow":
+		fmt.Printf("overflow check %d failed\n", machine.output[len(output)+1])
+	default:
 		return
 	}
+	os.Exit(1)
+}
 
-	if err := ioutil.WriteFile(*outputPath, []byte(output), 0644); err != nil {
+// interpCommand runs a program with the interpreter instead of compiling it.
+func interpCommand(args []string) {
+	flags := flag.NewFlagSet("interp", flag.ExitOnError)
+	input := flags.String("input", "", "comma separated values to read with in")
+	maxSteps := flags.Int("steps", 100000, "the number of statements to execute before giving up")
+	signed := flags.Bool("signed", false, "whether integers go from -500 to 499 instead of 0 to 999")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Println("no source file")
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
 		panic(err)
 	}
+	inputs, err := parseInputs(*input, *signed)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// The interpreter takes negative integers as they are rather than in
+	// ten's complement.
+	for i, value := range inputs {
+		if *signed && value >= SignedOffset {
+			inputs[i] = value - 1000
+		}
+	}
+	ast, parseErrors := Parse(string(data))
+	if len(parseErrors) > 0 {
+		for _, diag := range parseErrors {
+			diag.render(os.Stdout, path, string(data))
+		}
+		os.Exit(1)
+	}
+
+	output, err := Interpret(ast, inputs, *signed, *maxSteps)
+	for _, value := range output {
+		fmt.Println(value)
+	}
+	if err != nil {
+		printErrors([]error{err}, path, string(data), "human")
+		os.Exit(1)
+	}
 }
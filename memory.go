@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type MemoryUsage struct {
+	code, variables, constants, temps int
+}
+
+type StatementUsage struct {
+	pos    Position
+	length int
+	usage  MemoryUsage
+}
+
+func (asm *Assembly) usage() MemoryUsage {
+	usage := MemoryUsage{}
+	for _, block := range asm.blocks {
+		switch block.kind {
+		case CodeBlock:
+			usage.code += len(block.insts)
+		case VariableBlock, ArrayBlock, LocalBlock:
+			usage.variables += len(block.insts)
+		case ConstantBlock:
+			usage.constants += len(block.insts)
+		case TempBlock:
+			usage.temps += len(block.insts)
+		}
+	}
+	return usage
+}
+
+func (usage MemoryUsage) plus(other MemoryUsage) MemoryUsage {
+	return MemoryUsage{
+		usage.code + other.code,
+		usage.variables + other.variables,
+		usage.constants + other.constants,
+		usage.temps + other.temps,
+	}
+}
+
+func (usage MemoryUsage) minus(other MemoryUsage) MemoryUsage {
+	return MemoryUsage{
+		usage.code - other.code,
+		usage.variables - other.variables,
+		usage.constants - other.constants,
+		usage.temps - other.temps,
+	}
+}
+
+func (usage MemoryUsage) total() int {
+	return usage.code + usage.variables + usage.constants + usage.temps
+}
+
+func (usage MemoryUsage) String() string {
+	return fmt.Sprintf("%d code, %d variables, %d constants, %d temporaries", usage.code, usage.variables, usage.constants, usage.temps)
+}
+
+// writeMemoryReport prints how the mailboxes are split between code and data,
+// followed by what each top level statement added to the program before it
+// was optimized. Constants and temporaries are shared, so they are charged to
+// the first statement that needed them.
+func (asm *Assembly) writeMemoryReport(w io.Writer, source string) {
+	usage := asm.usage()
+	fmt.Fprintf(w, "memory usage: %d of %d mailboxes\n", usage.total(), MailboxCount)
+	fmt.Fprintf(w, "  code         %3d\n", usage.code)
+	fmt.Fprintf(w, "  variables    %3d\n", usage.variables)
+	fmt.Fprintf(w, "  constants    %3d\n", usage.constants)
+	fmt.Fprintf(w, "  temporaries  %3d\n", usage.temps)
+	if asm.peepholeSaved > 0 {
+		fmt.Fprintf(w, "  the peephole optimizer saved %d mailboxes\n", asm.peepholeSaved)
+	}
+	if asm.layoutSaved > 0 {
+		fmt.Fprintf(w, "  removing unreachable blocks and reordering saved %d mailboxes\n", asm.layoutSaved)
+	}
+	if asm.sharingSaved > 0 {
+		fmt.Fprintf(w, "  sharing mailboxes between temporaries and local variables saved %d mailboxes\n", asm.sharingSaved)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "  %-10s %4s %4s %4s %4s %5s  %s\n", "position", "code", "vars", "cons", "temp", "total", "statement")
+	for _, stmt := range asm.statementUsage {
+		fmt.Fprintf(w, "  %-10s %4d %4d %4d %4d %5d  %s\n", stmt.pos, stmt.usage.code, stmt.usage.variables, stmt.usage.constants, stmt.usage.temps, stmt.usage.total(), statementSummary(source, stmt.pos, stmt.length))
+	}
+}
+
+func statementSummary(source string, pos Position, length int) string {
+	if pos.index+length > len(source) {
+		return ""
+	}
+	text := strings.TrimSpace(source[pos.index : pos.index+length])
+	if index := strings.IndexByte(text, '\n'); index >= 0 {
+		return strings.TrimSpace(text[:index]) + " ..."
+	}
+	return text
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// outputs returns a program that outputs each number from 1 to n, which needs
+// a constant and two instructions for each, along with the final HLT.
+func outputs(n int) string {
+	builder := strings.Builder{}
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&builder, "out %d\n", i)
+	}
+	return builder.String()
+}
+
+func TestMailboxBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// err is the message of the error, or "" if the program fits.
+		err string
+	}{
+		{"exactly full", outputs(33), ""},
+		{"one over", outputs(34), "program needs 103 mailboxes but only 100 are available (69 code, 0 variables, 34 constants, 0 temporaries)"},
+		{
+			"array",
+			"xs: [int; 95]\nout xs[in]\n",
+			"program needs 102 mailboxes but only 100 are available (6 code, 95 variables, 1 constants, 0 temporaries)",
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		asm, errors := Compile(statements, Options{peephole: true, layout: true, share: true})
+		if test.err == "" {
+			if len(errors) > 0 {
+				t.Errorf("%s: %s", test.name, errors[0])
+			} else if total := asm.usage().total(); total > MailboxCount {
+				t.Errorf("%s: uses %d mailboxes without an error", test.name, total)
+			}
+			continue
+		}
+		if len(errors) != 1 {
+			t.Errorf("%s: got errors %v, want one", test.name, errors)
+			continue
+		}
+		diag := errors[0].(Diagnostic)
+		if diag.code != "E022" || diag.msg != test.err {
+			t.Errorf("%s: got %s %q, want E022 %q", test.name, diag.code, diag.msg, test.err)
+		}
+	}
+}
+
+func TestMemoryReport(t *testing.T) {
+	source := "a := in\nb := 2\n// twice\nwhile a > 0 {\n    out a * b\n    a = a - 1\n}\nout 7\n"
+	tests := []struct {
+		name    string
+		options Options
+		want    string
+	}{
+		{
+			"optimized",
+			Options{peephole: true, layout: true, share: true},
+			`memory usage: 41 of 100 mailboxes
+  code          31
+  variables      5
+  constants      5
+  temporaries    0
+  the peephole optimizer saved 8 mailboxes
+  removing unreachable blocks and reordering saved 1 mailboxes
+
+  position   code vars cons temp total  statement
+  (1, 1)        2    1    0    0     3  a := in
+  (2, 1)        2    1    1    0     4  b := 2
+  (4, 1)       19    0    3    1    23  while a > 0 { ...
+  (8, 1)        2    0    1    0     3  out 7
+`,
+		},
+		{
+			"unoptimized",
+			Options{},
+			`memory usage: 50 of 100 mailboxes
+  code          39
+  variables      5
+  constants      5
+  temporaries    1
+
+  position   code vars cons temp total  statement
+  (1, 1)        2    1    0    0     3  a := in
+  (2, 1)        2    1    1    0     4  b := 2
+  (4, 1)       19    0    3    1    23  while a > 0 { ...
+  (8, 1)        2    0    1    0     3  out 7
+`,
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		asm, errors := Compile(statements, test.options)
+		if len(errors) > 0 {
+			t.Fatalf("%s: %s", test.name, errors[0])
+		}
+		builder := strings.Builder{}
+		asm.writeMemoryReport(&builder, source)
+		if got := builder.String(); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
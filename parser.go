@@ -2,32 +2,35 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
-	"strings"
-	"unicode"
-	"unicode/utf8"
 )
 
 const (
+	PRODUCT    = iota
 	SUM        = iota
 	COMPARISON = iota
 	LOGIC      = iota
 	EXPR
 )
 
+// Parser builds the AST from the tokens of the source. Comments are picked up
+// as the tokens after them are reached, so they can be attached to the
+// statement they belong to. failed is set by any error in the current
+// statement, after which the parser skips ahead to where the next statement
+// is likely to start.
 type Parser struct {
-	pos    Position
-	source string
-	errors []ParseError
+	tokens      []Token
+	current     int
+	lexComments []Comment
+	errors      []Diagnostic
+	comments    []Comment
+	failed      bool
 }
 
-type ParseError struct {
-	pos Position
-	msg string
-}
-
-func (err ParseError) String() string {
-	return fmt.Sprintf("%s at %s", err.msg, err.pos)
+type Comment struct {
+	pos  Position
+	text string
 }
 
 type Position struct {
@@ -42,114 +45,182 @@ func (pos Position) String() string {
 	return fmt.Sprintf("(%d, %d)", pos.line, pos.column)
 }
 
-func (parser *Parser) peek() rune {
-	r, _ := utf8.DecodeRuneInString(parser.source[parser.pos.index:])
-	return r
+func (parser *Parser) token() Token {
+	return parser.tokens[parser.current]
 }
 
-func (parser *Parser) next() {
-	r, size := utf8.DecodeRuneInString(parser.source[parser.pos.index:])
-	if r == '\n' {
-		parser.pos.line++
-		parser.pos.column = 1
-	} else {
-		parser.pos.column++
+// end returns the position just after the last token consumed.
+func (parser *Parser) end() Position {
+	if parser.current == 0 {
+		return parser.token().pos
 	}
-	parser.pos.index += size
+	return parser.tokens[parser.current-1].end
 }
 
-func (parser *Parser) eof() bool {
-	_, s := utf8.DecodeRuneInString(parser.source[parser.pos.index:])
-	return s == 0
+// advance moves on to the next token, collecting the comments before it.
+func (parser *Parser) advance() {
+	if parser.token().kind != EOFToken {
+		parser.current++
+	}
+	parser.collectComments()
 }
 
-func (parser *Parser) error(msg string) {
-	parser.errors = append(parser.errors, ParseError{parser.pos, msg})
+func (parser *Parser) collectComments() {
+	for len(parser.lexComments) > 0 && parser.lexComments[0].pos.index < parser.token().pos.index {
+		parser.comments = append(parser.comments, parser.lexComments[0])
+		parser.lexComments = parser.lexComments[1:]
+	}
 }
 
-func (parser *Parser) skipSpaces() {
-	for unicode.IsSpace(parser.peek()) {
-		parser.next()
-	}
+// error reports a problem with the current token.
+func (parser *Parser) error(code, msg string) {
+	parser.report(newError(code, parser.token().span(), msg))
 }
 
-func (parser *Parser) parseInt() (Expr, bool) {
-	if !unicode.IsDigit(parser.peek()) {
-		return Expr{}, false
-	}
-	pos := parser.pos
-	for unicode.IsDigit(parser.peek()) {
-		parser.next()
+// expected reports that something is missing just after the last token
+// consumed, rather than at the next token, which may be on a later line.
+func (parser *Parser) expected(code, what string) {
+	parser.report(newError(code, Span{parser.end(), 0}, "expected "+what))
+}
+
+// report records an error unless the same one has already been reported.
+func (parser *Parser) report(diag Diagnostic) {
+	parser.failed = true
+	for _, err := range parser.errors {
+		if err.primary.span == diag.primary.span && err.msg == diag.msg {
+			return
+		}
 	}
-	contents := parser.source[pos.index:parser.pos.index]
-	value, _ := strconv.Atoi(contents)
-	return Expr{pos, Length(pos, parser.pos), IntLiteral{value}}, true
+	parser.errors = append(parser.errors, diag)
 }
 
-func (parser *Parser) parseIdent() (string, bool) {
-	if !unicode.IsLetter(parser.peek()) {
-		return "", false
+var statementKeywords = map[string]bool{
+	"if":     true,
+	"while":  true,
+	"func":   true,
+	"return": true,
+	"out":    true,
+}
+
+// synchronize skips the rest of a statement that failed to parse, stopping at
+// the first token on a new line, a keyword that starts a statement or a '}'.
+// It always moves past at least one token if the statement consumed none.
+func (parser *Parser) synchronize(start int) {
+	if parser.current == start {
+		parser.advance()
 	}
-	pos := parser.pos
-	for unicode.IsLetter(parser.peek()) || unicode.IsDigit(parser.peek()) {
-		parser.next()
+	for parser.token().kind != EOFToken && !parser.is("}") {
+		token := parser.token()
+		if token.pos.line > parser.end().line || (token.kind == KeywordToken && statementKeywords[token.text]) {
+			return
+		}
+		parser.advance()
 	}
-	name := parser.source[pos.index:parser.pos.index]
-	return name, true
 }
 
-func (parser *Parser) parseSymbol(symbol string) bool {
-	if !strings.HasPrefix(parser.source[parser.pos.index:], symbol) {
+func (parser *Parser) takeComments() []Comment {
+	comments := parser.comments
+	parser.comments = nil
+	return comments
+}
+
+// is reports whether the current token is the keyword or symbol text.
+func (parser *Parser) is(text string) bool {
+	token := parser.token()
+	return (token.kind == KeywordToken || token.kind == SymbolToken) && token.text == text
+}
+
+// accept consumes the current token if it is the keyword or symbol text.
+func (parser *Parser) accept(text string) bool {
+	if !parser.is(text) {
 		return false
 	}
-	parser.pos.index += len(symbol)
+	parser.advance()
 	return true
 }
 
+func (parser *Parser) parseInt() (Expr, bool) {
+	token := parser.token()
+	if token.kind != IntToken {
+		return Expr{}, false
+	}
+	value, err := strconv.Atoi(token.text)
+	if err != nil {
+		parser.error("E021", fmt.Sprintf("integer %s is too big", token.text))
+	}
+	parser.advance()
+	return Expr{token.pos, Length(token.pos, token.end), IntLiteral{value}}, true
+}
+
+func (parser *Parser) parseIdent() (string, bool) {
+	token := parser.token()
+	if token.kind != IdentToken {
+		return "", false
+	}
+	parser.advance()
+	return token.text, true
+}
+
 func (parser *Parser) parseValue() Expr {
-	pos := parser.pos
+	pos := parser.token().pos
 	if literal, ok := parser.parseInt(); ok {
 		return literal
 	}
-	if name, ok := parser.parseIdent(); ok {
-		var node ExprNode
-		switch name {
-		case "true":
-			node = BoolLiteral{true}
-		case "false":
-			node = BoolLiteral{false}
-		case "in":
-			node = Input{}
-		default:
-			node = Ident{name}
+	var node ExprNode
+	switch {
+	case parser.accept("true"):
+		node = BoolLiteral{true}
+	case parser.accept("false"):
+		node = BoolLiteral{false}
+	case parser.accept("in"):
+		node = Input{}
+	case parser.accept("("):
+		expr := parser.parseExpr(EXPR)
+		if !parser.accept(")") {
+			parser.expected("E003", "a ')'")
+			return Expr{}
+		}
+		node = expr.node
+	default:
+		name, ok := parser.parseIdent()
+		if !ok {
+			parser.expected("E004", "a value")
+			return Expr{}
+		}
+		if parser.accept("(") {
+			return parser.parseCall(name, pos)
 		}
-		return Expr{pos, Length(pos, parser.pos), node}
+		if parser.accept("[") {
+			index := parser.parseExpr(EXPR)
+			if !parser.accept("]") {
+				parser.expected("E003", "a ']'")
+				return Expr{}
+			}
+			return Expr{pos, Length(pos, parser.end()), Index{name, index}}
+		}
+		node = Ident{name}
 	}
-	parser.error("expected a value")
-	return Expr{}
+	return Expr{pos, Length(pos, parser.end()), node}
 }
 
 func (parser *Parser) parseInfix(left *Expr, symbol string, prec, symbolPrec int) bool {
-	if prec > symbolPrec && parser.parseSymbol(symbol) {
-		parser.skipSpaces()
+	if prec > symbolPrec && parser.accept(symbol) {
 		right := parser.parseExpr(symbolPrec)
-		*left = Expr{left.pos, Length(left.pos, parser.pos), Binary{symbol, *left, right}}
+		*left = Expr{left.pos, Length(left.pos, parser.end()), Binary{symbol, *left, right}}
 		return true
 	}
 	return false
 }
 
 func (parser *Parser) parseUnary() Expr {
-	pos := parser.pos
-	if parser.parseSymbol("-") {
-		parser.skipSpaces()
-		expr := parser.parseExpr(SUM)
-		return Expr{pos, Length(pos, parser.pos), Unary{"-", expr}}
-	}
-	if parser.parseSymbol("not") {
-		parser.skipSpaces()
+	pos := parser.token().pos
+	if parser.accept("-") {
+		expr := parser.parseExpr(PRODUCT)
+		return Expr{pos, Length(pos, parser.end()), Unary{"-", expr}}
+	}
+	if parser.accept("not") {
 		expr := parser.parseExpr(LOGIC)
-		return Expr{pos, Length(pos, parser.pos), Unary{"not", expr}}
+		return Expr{pos, Length(pos, parser.end()), Unary{"not", expr}}
 	}
 	return parser.parseValue()
 }
@@ -157,9 +228,11 @@ func (parser *Parser) parseUnary() Expr {
 func (parser *Parser) parseExpr(prec int) Expr {
 	left := parser.parseUnary()
 	for {
-		parser.skipSpaces()
+		parsed := parser.parseInfix(&left, "*", prec, PRODUCT) ||
+			parser.parseInfix(&left, "/", prec, PRODUCT) ||
+			parser.parseInfix(&left, "%", prec, PRODUCT) ||
 
-		parsed := parser.parseInfix(&left, "+", prec, SUM) ||
+			parser.parseInfix(&left, "+", prec, SUM) ||
 			parser.parseInfix(&left, "-", prec, SUM) ||
 
 			parser.parseInfix(&left, "==", prec, COMPARISON) ||
@@ -178,91 +251,262 @@ func (parser *Parser) parseExpr(prec int) Expr {
 	}
 }
 
+// parseStatement parses a statement and attaches the comments written
+// before it.
 func (parser *Parser) parseStatement() Statement {
-	pos := parser.pos
+	comments := parser.takeComments()
+	statement := parser.parseStatementNode()
+	statement.comments = append(comments, statement.comments...)
+	return statement
+}
+
+func (parser *Parser) parseStatementNode() Statement {
+	pos := parser.token().pos
 
-	if parser.parseSymbol("if") {
-		parser.skipSpaces()
+	if parser.accept("if") {
 		cond := parser.parseExpr(EXPR)
-		parser.skipSpaces()
 		ifTrue := parser.parseStatement()
-		parser.skipSpaces()
 		var ifFalse Statement
-		if parser.parseSymbol("else") {
-			parser.skipSpaces()
+		if parser.accept("else") {
 			ifFalse = parser.parseStatement()
 		}
-		return Statement{pos, Length(pos, parser.pos), If{cond, ifTrue, ifFalse}}
+		return Statement{pos, Length(pos, parser.end()), If{cond, ifTrue, ifFalse}, nil}
 	}
-	if parser.parseSymbol("while") {
-		parser.skipSpaces()
+	if parser.accept("while") {
 		cond := parser.parseExpr(EXPR)
-		parser.skipSpaces()
 		loop := parser.parseStatement()
-		return Statement{pos, Length(pos, parser.pos), While{cond, loop}}
+		return Statement{pos, Length(pos, parser.end()), While{cond, loop}, nil}
+	}
+	if parser.accept("func") {
+		return parser.parseFunction(pos)
 	}
-	if parser.parseSymbol("out") {
-		parser.skipSpaces()
+	if parser.accept("return") {
+		var expr Expr
+		if !parser.atLineEnd() {
+			expr = parser.parseExpr(EXPR)
+		}
+		return Statement{pos, Length(pos, parser.end()), Return{expr}, nil}
+	}
+	if parser.accept("out") {
 		expr := parser.parseExpr(EXPR)
-		return Statement{pos, Length(pos, parser.pos), Output{expr}}
+		return Statement{pos, Length(pos, parser.end()), Output{expr}, nil}
 	}
-	if parser.parseSymbol("{") {
-		parser.skipSpaces()
+	if parser.accept("{") {
 		statements := parser.parseStatements()
-		if !parser.parseSymbol("}") {
-			parser.error("expected a '}'")
+		if !parser.accept("}") {
+			parser.report(newError("E003", Span{parser.end(), 0}, "expected a '}'").withNote(Span{pos, 1}, "to close this block"))
 		}
-		return Statement{pos, Length(pos, parser.pos), BlockScope{statements}}
+		return Statement{pos, Length(pos, parser.end()), BlockScope{statements}, nil}
 	}
 	name, ok := parser.parseIdent()
-	parser.skipSpaces()
-	if ok && parser.parseSymbol(":") {
-		parser.skipSpaces()
-		ty := Undefined
-		if name, ok := parser.parseIdent(); ok {
-			switch name {
-			case "int":
-				ty = Int
-			case "bool":
-				ty = Bool
-			default:
-				parser.error("invalid type name")
-				return Statement{}
-			}
+	if ok && parser.accept(":") {
+		if parser.accept("[") {
+			return parser.parseArrayDeclaration(name, pos)
+		}
+		ty, ok := parser.parseType()
+		if !ok {
+			return Statement{}
 		}
-		parser.skipSpaces()
 		var expr Expr
-		if parser.parseSymbol("=") {
-			parser.skipSpaces()
+		if parser.accept("=") {
 			expr = parser.parseExpr(EXPR)
 		}
-		return Statement{pos, Length(pos, parser.pos), Declare{name, expr, ty}}
+		return Statement{pos, Length(pos, parser.end()), Declare{name, expr, ty, 0}, nil}
+	}
+	if ok && parser.accept("=") {
+		expr := parser.parseExpr(EXPR)
+		return Statement{pos, Length(pos, parser.end()), Assign{name, expr}, nil}
 	}
-	if ok && parser.parseSymbol("=") {
-		parser.skipSpaces()
+	if ok && parser.accept("[") {
+		index := parser.parseExpr(EXPR)
+		if !parser.accept("]") {
+			parser.expected("E003", "a ']'")
+			return Statement{}
+		}
+		if !parser.accept("=") {
+			parser.expected("E003", "a '='")
+			return Statement{}
+		}
 		expr := parser.parseExpr(EXPR)
-		return Statement{pos, Length(pos, parser.pos), Assign{name, expr}}
+		return Statement{pos, Length(pos, parser.end()), AssignIndex{name, index, expr}, nil}
+	}
+	if ok && parser.accept("(") {
+		call := parser.parseCall(name, pos)
+		return Statement{pos, Length(pos, parser.end()), CallStatement{call}, nil}
 	}
-	parser.error("was expecting a statement")
+	parser.error("E005", "was expecting a statement")
 	return Statement{}
 }
 
+// parseType parses an optional type name, returning Undefined if there
+// isn't one.
+func (parser *Parser) parseType() (Type, bool) {
+	token := parser.token()
+	if token.kind != IdentToken {
+		return Undefined, true
+	}
+	parser.advance()
+	switch token.text {
+	case "int":
+		return Int, true
+	case "bool":
+		return Bool, true
+	}
+	parser.report(newError("E007", token.span(), "invalid type name"))
+	return Undefined, false
+}
+
+// parseArrayDeclaration parses the element type and length of an array
+// declaration such as `xs: [int; 10]` after the opening '['.
+func (parser *Parser) parseArrayDeclaration(name string, pos Position) Statement {
+	ty, ok := parser.parseType()
+	if !ok {
+		return Statement{}
+	}
+	if ty == Undefined {
+		parser.expected("E007", "an element type")
+		return Statement{}
+	}
+	if !parser.accept(";") {
+		parser.expected("E003", "a ';'")
+		return Statement{}
+	}
+	length, ok := parser.parseInt()
+	if !ok || length.node.(IntLiteral).value == 0 {
+		parser.expected("E008", "the length of the array")
+		return Statement{}
+	}
+	if value := length.node.(IntLiteral).value; value > MailboxCount {
+		parser.report(newError("E008", length.span(), fmt.Sprintf("array length %d is more than the %d mailboxes", value, MailboxCount)))
+		return Statement{}
+	}
+	if !parser.accept("]") {
+		parser.expected("E003", "a ']'")
+		return Statement{}
+	}
+	size := length.node.(IntLiteral).value
+	return Statement{pos, Length(pos, parser.end()), Declare{name, Expr{}, ty, size}, nil}
+}
+
+// parseCall parses the arguments of a call after the opening '('.
+func (parser *Parser) parseCall(name string, pos Position) Expr {
+	args := []Expr{}
+	for !parser.accept(")") {
+		if len(args) > 0 && !parser.accept(",") {
+			parser.expected("E003", "a ',' or ')'")
+			return Expr{}
+		}
+		arg := parser.parseExpr(EXPR)
+		if arg.node == nil {
+			return Expr{}
+		}
+		args = append(args, arg)
+	}
+	return Expr{pos, Length(pos, parser.end()), Call{name, args}}
+}
+
+func (parser *Parser) parseFunction(pos Position) Statement {
+	namePos := parser.token().pos
+	name, ok := parser.parseIdent()
+	if !ok {
+		parser.expected("E009", "a function name")
+		return Statement{}
+	}
+	if !parser.accept("(") {
+		parser.expected("E003", "a '('")
+		return Statement{}
+	}
+	params, ok := parser.parseParams()
+	if !ok {
+		// Skip to the body so that it isn't parsed as top level statements.
+		for parser.token().kind != EOFToken && !parser.is("{") && parser.token().pos.line == pos.line {
+			parser.advance()
+		}
+	}
+	ret, _ := parser.parseType()
+	if !parser.is("{") {
+		parser.expected("E003", "a '{'")
+		return Statement{}
+	}
+	body := parser.parseStatement()
+	return Statement{pos, Length(pos, parser.end()), Function{name, params, ret, body, namePos}, nil}
+}
+
+// parseParams parses the parameters of a function after the opening '('.
+func (parser *Parser) parseParams() ([]Param, bool) {
+	params := []Param{}
+	for !parser.accept(")") {
+		if len(params) > 0 && !parser.accept(",") {
+			parser.expected("E003", "a ',' or ')'")
+			return params, false
+		}
+		paramPos := parser.token().pos
+		param, ok := parser.parseIdent()
+		if !ok || !parser.accept(":") {
+			parser.expected("E009", "a parameter")
+			return params, false
+		}
+		ty, ok := parser.parseType()
+		if !ok {
+			return params, false
+		}
+		if ty == Undefined {
+			parser.expected("E007", "a parameter type")
+			return params, false
+		}
+		params = append(params, Param{param, ty, paramPos})
+	}
+	return params, true
+}
+
+// atLineEnd reports whether the next token is on a later line than the last
+// one, or closes the block.
+func (parser *Parser) atLineEnd() bool {
+	token := parser.token()
+	return token.kind == EOFToken || parser.is("}") || token.pos.line > parser.end().line
+}
+
+// parseStatements parses statements up to the end of the block. Statements
+// that fail to parse are kept as far as they got, for tools that work with
+// incomplete programs, unless nothing of them could be parsed at all.
 func (parser *Parser) parseStatements() []Statement {
 	statements := []Statement{}
-	parser.skipSpaces()
-	for !parser.eof() && !(parser.peek() == '}') && !(parser.peek() == ')') {
+	for parser.token().kind != EOFToken && !parser.is("}") && !parser.is(")") {
+		start := parser.current
+		parser.failed = false
 		statement := parser.parseStatement()
+		if parser.failed || statement.node == nil {
+			parser.synchronize(start)
+		}
 		if statement.node == nil {
-			break
+			continue
+		}
+		for len(parser.comments) > 0 && parser.comments[0].pos.line == statement.pos.line {
+			statement.comments = append(statement.comments, parser.comments[0])
+			parser.comments = parser.comments[1:]
 		}
 		statements = append(statements, statement)
-		parser.skipSpaces()
 	}
 	return statements
 }
 
-func Parse(source string) ([]Statement, []ParseError) {
-	parser := Parser{Position{1, 1, 0}, source, []ParseError{}}
+// Parse returns every statement it could parse along with every syntax error,
+// in the order they appear in the source.
+func Parse(source string) ([]Statement, []Diagnostic) {
+	tokens, comments, lexErrors := Lex(source)
+	parser := Parser{tokens, 0, comments, []Diagnostic{}, nil, false}
+	for _, err := range lexErrors {
+		parser.report(err)
+	}
+	parser.collectComments()
 	statements := parser.parseStatements()
+	for parser.token().kind != EOFToken {
+		parser.error("E006", fmt.Sprintf("unexpected '%s'", parser.token().text))
+		parser.advance()
+		statements = append(statements, parser.parseStatements()...)
+	}
+	sort.SliceStable(parser.errors, func(i, j int) bool {
+		return parser.errors[i].primary.span.pos.index < parser.errors[j].primary.span.pos.index
+	})
 	return statements, parser.errors
 }
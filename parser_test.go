@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// errors lists the code and position of each error, and kept is the
+		// number of top level statements that were parsed.
+		errors []string
+		kept   int
+	}{
+		{
+			"no errors",
+			"a := 1\nout a\n",
+			nil,
+			2,
+		},
+		{
+			"every bad line is reported",
+			"a := \nout a\nb = = 2\nout xs[a\nc := 3\n",
+			[]string{"E004 1:5", "E004 3:4", "E003 4:9"},
+			5,
+		},
+		{
+			"one error for each statement",
+			"a := ) ( ]\nout a\n",
+			[]string{"E004 1:5"},
+			2,
+		},
+		{
+			"missing ']' before an error on the next line",
+			"out xs[1\nout 2 $ 3\n",
+			[]string{"E003 1:9", "E001 2:7", "E005 2:9"},
+			2,
+		},
+		{
+			"empty parentheses",
+			"out ()\nout 1\n",
+			[]string{"E004 1:6"},
+			2,
+		},
+		{
+			"missing ')' before an error on the next line",
+			"out (1\nout 2 $ 3\n",
+			[]string{"E003 1:7", "E001 2:7", "E005 2:9"},
+			2,
+		},
+		{
+			"missing ')' in nested parentheses",
+			"out ((1 + 2) * 3\nout (2 * (3 - 1)\nout 4\n",
+			[]string{"E003 1:17", "E003 2:17"},
+			3,
+		},
+		{
+			"extra ')'",
+			"out (1))\nout 2\n",
+			[]string{"E006 1:8"},
+			2,
+		},
+		{
+			"missing value at the end of a line",
+			"out 1 +\nout 2\n",
+			[]string{"E004 1:8"},
+			2,
+		},
+		{
+			"unexpected character",
+			"a := 1 @ 2\nout a\n",
+			[]string{"E001 1:8", "E005 1:10"},
+			2,
+		},
+		{
+			"not a statement",
+			"1 + 2\nout 3\n",
+			[]string{"E005 1:1"},
+			1,
+		},
+		{
+			"error inside a block",
+			"while true {\n    x = \n    out 1\n}\nout 2\n",
+			[]string{"E004 2:8"},
+			2,
+		},
+		{
+			"unclosed block",
+			"if true {\n    out 1\n",
+			[]string{"E003 2:10"},
+			1,
+		},
+		{
+			"unexpected closing brace",
+			"out 1\n}\nout 2\n",
+			[]string{"E006 2:1"},
+			2,
+		},
+		{
+			"bad parameters",
+			"func f(x int) int {\n    return x\n}\nout f(1)\n",
+			[]string{"E009 1:9"},
+			2,
+		},
+		{
+			"bad type",
+			"a: float = 1\nb: int = 2\n",
+			[]string{"E007 1:4"},
+			1,
+		},
+		{
+			"array length too big",
+			"xs: [int; 101]\nys: [int; 100]\n",
+			[]string{"E008 1:11"},
+			1,
+		},
+		{
+			"array length missing",
+			"xs: [int; 0]\nys: [int]\n",
+			[]string{"E008 1:12", "E003 2:9"},
+			0,
+		},
+		{
+			"integer too big",
+			"out 99999999999999999999\nout 1\n",
+			[]string{"E021 1:5"},
+			2,
+		},
+		{
+			"unterminated comment",
+			"out 1\n/* out 2\n",
+			[]string{"E002 2:1"},
+			1,
+		},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		var errors []string
+		for _, diag := range diagnostics {
+			errors = append(errors, fmt.Sprintf("%s %d:%d", diag.code, diag.primary.span.pos.line, diag.primary.span.pos.column))
+		}
+		if !reflect.DeepEqual(errors, test.errors) {
+			t.Errorf("%s: got errors %v, want %v", test.name, errors, test.errors)
+		}
+		if len(statements) != test.kept {
+			t.Errorf("%s: kept %d statements, want %d", test.name, len(statements), test.kept)
+		}
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"-a * b", "((- a) * b)"},
+		{"-a / 2", "((- a) / 2)"},
+		{"-a % b + c", "(((- a) % b) + c)"},
+		{"--a * b", "((- (- a)) * b)"},
+		{"-(a * b)", "(- (a * b))"},
+		{"(a + b) * c", "((a + b) * c)"},
+		{"a - (b - c)", "(a - (b - c))"},
+		{"((a))", "a"},
+		{"(a * (b + c)) % 2", "((a * (b + c)) % 2)"},
+		{"not (a and b)", "(not (a and b))"},
+		{"a or b and c", "((a or b) and c)"},
+		{"a * -b", "(a * (- b))"},
+		{"a - b - c", "((a - b) - c)"},
+		{"a + b * c", "(a + (b * c))"},
+		{"not a and b", "((not a) and b)"},
+		{"not a == b or c", "((not (a == b)) or c)"},
+		{"-a < b", "((- a) < b)"},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse("out " + test.source + "\n")
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %s", test.source, diagnostics[0])
+			continue
+		}
+		builder := strings.Builder{}
+		statements[0].node.(Output).expr.prettyPrint(&builder)
+		if got := builder.String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.source, got, test.want)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	source := "// first\nout 1 // same line\n/* two\n   lines */ out 2\nout 3\n"
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		t.Fatalf("parse: %s", diagnostics[0])
+	}
+	want := [][]string{{"first", "same line"}, {"two lines"}, nil}
+	for i, statement := range statements {
+		got := []string{}
+		for _, comment := range statement.comments {
+			got = append(got, comment.text)
+		}
+		if strings.Join(got, "|") != strings.Join(want[i], "|") {
+			t.Errorf("statement %d: got comments %q, want %q", i, got, want[i])
+		}
+	}
+
+	asm, errors := Compile(statements, Options{comments: true})
+	if len(errors) > 0 {
+		t.Fatalf("compile: %s", errors[0])
+	}
+	builder := strings.Builder{}
+	asm.assemble(&builder)
+	for _, line := range []string{"start\tLDA c1\t// first; same line\n", "\tLDA c2\t// two lines\n", "\tLDA c3\n"} {
+		if !strings.Contains(builder.String(), line) {
+			t.Errorf("assembly has no line %q:\n%s", line, builder.String())
+		}
+	}
+
+	if _, diagnostics := Parse("out 1 /* not closed\n"); len(diagnostics) != 1 || diagnostics[0].code != "E002" {
+		t.Errorf("unterminated comment: got %v", diagnostics)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+// PeepholeRule rewrites the instructions of a block starting at index i,
+// returning whether it changed anything.
+type PeepholeRule struct {
+	name  string
+	apply func(*Peephole, *Block, int) bool
+}
+
+type Peephole struct {
+	asm     *Assembly
+	blocks  map[string]*Block
+	next    map[*Block]*Block
+	patched map[string]bool
+}
+
+var peepholeRules = []PeepholeRule{
+	{"store then load", storeThenLoad},
+	{"load then store", loadThenStore},
+	{"load then load", loadThenLoad},
+	{"compare with zero", compareWithZero},
+	{"code after jump", codeAfterJump},
+	{"branch to branch", branchToBranch},
+	{"branch twice", branchTwice},
+	{"branch to next", branchToNext},
+	{"common store", commonStore},
+}
+
+func isBranch(opcode string) bool {
+	return opcode == "BRA" || opcode == "BRZ" || opcode == "BRP"
+}
+
+func isData(block *Block) bool {
+	return block.kind != CodeBlock
+}
+
+// peephole moves the data after the code and then applies the rules and
+// removes dead stores until nothing changes, returning the number of
+// mailboxes saved.
+func (asm *Assembly) peephole() int {
+	before := asm.usage().total()
+	asm.moveDataLast()
+	for {
+		peephole := asm.initPeephole()
+		changed := false
+		for _, block := range asm.blocks {
+			for i := 0; i < len(block.insts); i++ {
+				for _, rule := range peepholeRules {
+					if rule.apply(&peephole, block, i) {
+						changed = true
+					}
+				}
+			}
+		}
+		if asm.removeEmptyBlocks() {
+			changed = true
+		}
+		if asm.removeDeadStores() {
+			changed = true
+		}
+		if !changed {
+			return before - asm.usage().total()
+		}
+	}
+}
+
+func (asm *Assembly) moveDataLast() {
+	code := []*Block{}
+	data := []*Block{}
+	for _, block := range asm.blocks {
+		if isData(block) {
+			data = append(data, block)
+		} else {
+			code = append(code, block)
+		}
+	}
+	asm.blocks = append(code, data...)
+}
+
+func (asm *Assembly) initPeephole() Peephole {
+	peephole := Peephole{asm, make(map[string]*Block), make(map[*Block]*Block), make(map[string]bool)}
+	for i, block := range asm.blocks {
+		peephole.blocks[block.label] = block
+		if i+1 < len(asm.blocks) && !isData(asm.blocks[i+1]) {
+			peephole.next[block] = asm.blocks[i+1]
+		}
+		for _, inst := range block.insts {
+			if inst.opcode == "STA" {
+				peephole.patched[inst.operand] = true
+			}
+		}
+	}
+	return peephole
+}
+
+// removeEmptyBlocks drops code blocks with no instructions, pointing
+// anything that refers to one at the code block that follows it instead.
+func (asm *Assembly) removeEmptyBlocks() bool {
+	replacements := make(map[string]string)
+	pending := []string{}
+	for _, block := range asm.blocks {
+		if isData(block) {
+			continue
+		}
+		if len(block.insts) == 0 {
+			pending = append(pending, block.label)
+			continue
+		}
+		for _, label := range pending {
+			replacements[label] = block.label
+		}
+		pending = nil
+	}
+	if len(replacements) == 0 {
+		return false
+	}
+	for _, block := range asm.blocks {
+		if _, prs := replacements[block.label]; prs {
+			continue
+		}
+		for i, inst := range block.insts {
+			if label, prs := replacements[inst.operand]; prs {
+				block.insts[i].operand = label
+			}
+		}
+	}
+	removed := make(map[string]bool)
+	for label := range replacements {
+		removed[label] = true
+	}
+	kept := []*Block{}
+	for _, block := range asm.blocks {
+		if !removed[block.label] {
+			kept = append(kept, block)
+		}
+	}
+	asm.blocks = kept
+	return true
+}
+
+// isPatched reports whether the instruction is overwritten while the program
+// runs, in which case it must be left alone.
+func (peephole *Peephole) isPatched(block *Block, i int) bool {
+	return i == 0 && peephole.patched[block.label]
+}
+
+// matches reports whether the block has the given opcodes starting at i,
+// none of which are patched.
+func (peephole *Peephole) matches(block *Block, i int, opcodes ...string) bool {
+	if i+len(opcodes) > len(block.insts) || peephole.isPatched(block, i) {
+		return false
+	}
+	for j, opcode := range opcodes {
+		if block.insts[i+j].opcode != opcode {
+			return false
+		}
+	}
+	return true
+}
+
+// removeInstruction removes an instruction, moving its comment onto the next
+// instruction in the block, or the one before if it was the last, so that the
+// comments copied from the source aren't lost with the code they were on.
+func (block *Block) removeInstruction(i int) {
+	if comment := block.insts[i].comment; comment != "" {
+		if i+1 < len(block.insts) {
+			block.insts[i+1].comment = joinComments(comment, block.insts[i+1].comment)
+		} else if i > 0 {
+			block.insts[i-1].comment = joinComments(block.insts[i-1].comment, comment)
+		}
+	}
+	block.insts = append(block.insts[:i], block.insts[i+1:]...)
+}
+
+func joinComments(first, second string) string {
+	if first == "" || second == "" {
+		return first + second
+	}
+	return first + "; " + second
+}
+
+// resolve follows empty blocks and blocks that only branch elsewhere to find
+// where a branch to label from the block from really ends up. It stops at
+// from itself, which the rule applying is about to change, so that a chain
+// leading back through from isn't mistaken for somewhere else.
+func (peephole *Peephole) resolve(from *Block, label string) string {
+	visited := make(map[string]bool)
+	target := label
+	for !visited[target] && target != from.label {
+		visited[target] = true
+		block, prs := peephole.blocks[target]
+		if !prs || isData(block) || peephole.patched[target] {
+			return target
+		}
+		if len(block.insts) == 0 {
+			next, prs := peephole.next[block]
+			if !prs {
+				return target
+			}
+			target = next.label
+		} else if block.insts[0].opcode == "BRA" {
+			target = block.insts[0].operand
+		} else {
+			return target
+		}
+	}
+	return label
+}
+
+// STA x; LDA x -> STA x
+func storeThenLoad(peephole *Peephole, block *Block, i int) bool {
+	if peephole.matches(block, i, "STA", "LDA") && block.insts[i].operand == block.insts[i+1].operand {
+		block.removeInstruction(i + 1)
+		return true
+	}
+	return false
+}
+
+// LDA x; STA x -> LDA x
+func loadThenStore(peephole *Peephole, block *Block, i int) bool {
+	if peephole.matches(block, i, "LDA", "STA") && block.insts[i].operand == block.insts[i+1].operand {
+		block.removeInstruction(i + 1)
+		return true
+	}
+	return false
+}
+
+// LDA x; LDA y -> LDA y
+func loadThenLoad(peephole *Peephole, block *Block, i int) bool {
+	if peephole.matches(block, i, "LDA", "LDA") {
+		block.removeInstruction(i)
+		return true
+	}
+	return false
+}
+
+// LDA c0; SUB x; BRP l; BRA m -> LDA x; BRZ l; BRA m
+//
+// 0 - x is only positive when x is 0. The accumulator is different on the
+// way out, so this only applies when both ways out are branches.
+func compareWithZero(peephole *Peephole, block *Block, i int) bool {
+	zero, prs := peephole.asm.constants[0]
+	if !prs || !peephole.matches(block, i, "LDA", "SUB", "BRP", "BRA") || block.insts[i].operand != zero {
+		return false
+	}
+	block.insts[i] = Instruction{"LDA", block.insts[i+1].operand, block.insts[i].comment}
+	block.insts[i+1] = Instruction{"BRZ", block.insts[i+2].operand, block.insts[i+1].comment}
+	block.removeInstruction(i + 2)
+	return true
+}
+
+// BRA l; anything -> BRA l
+func codeAfterJump(peephole *Peephole, block *Block, i int) bool {
+	if i+1 >= len(block.insts) || peephole.isPatched(block, i) {
+		return false
+	}
+	if opcode := block.insts[i].opcode; opcode == "BRA" || opcode == "HLT" {
+		for len(block.insts) > i+1 {
+			block.removeInstruction(i + 1)
+		}
+		return true
+	}
+	return false
+}
+
+// BRx l, where l: BRA m -> BRx m
+func branchToBranch(peephole *Peephole, block *Block, i int) bool {
+	inst := &block.insts[i]
+	if !isBranch(inst.opcode) || peephole.isPatched(block, i) {
+		return false
+	}
+	if target := peephole.resolve(block, inst.operand); target != inst.operand {
+		inst.operand = target
+		return true
+	}
+	return false
+}
+
+// BRx l; BRA l -> BRA l
+func branchTwice(peephole *Peephole, block *Block, i int) bool {
+	if !peephole.matches(block, i, block.insts[i].opcode, "BRA") || !isBranch(block.insts[i].opcode) {
+		return false
+	}
+	if block.insts[i].operand == block.insts[i+1].operand {
+		block.removeInstruction(i)
+		return true
+	}
+	return false
+}
+
+// BRx l, where l is the next block -> nothing
+func branchToNext(peephole *Peephole, block *Block, i int) bool {
+	if isData(block) || i != len(block.insts)-1 || !isBranch(block.insts[i].opcode) || peephole.isPatched(block, i) {
+		return false
+	}
+	next, prs := peephole.next[block]
+	if prs && peephole.resolve(block, next.label) == peephole.resolve(block, block.insts[i].operand) {
+		block.removeInstruction(i)
+		return true
+	}
+	return false
+}
+
+// P: ...; STA x; BRA l and Q: ...; STA x, where Q falls through to l, and
+// nothing else enters l -> l: STA x; ...
+//
+// A store made on every way into a block is made once at its start instead,
+// which lets the block use the value still in the accumulator.
+func commonStore(peephole *Peephole, block *Block, i int) bool {
+	if i != 0 || isData(block) || peephole.patched[block.label] || block == peephole.asm.blocks[0] {
+		return false
+	}
+	preds := []*Block{}
+	stores := []int{}
+	for _, other := range peephole.asm.blocks {
+		for j, inst := range other.insts {
+			if inst.operand != block.label {
+				continue
+			}
+			if isData(other) || inst.opcode != "BRA" || j != len(other.insts)-1 || j == 0 {
+				return false
+			}
+			preds = append(preds, other)
+			stores = append(stores, j-1)
+		}
+		if peephole.next[other] == block && fallsThrough(other) {
+			if len(other.insts) == 0 {
+				return false
+			}
+			preds = append(preds, other)
+			stores = append(stores, len(other.insts)-1)
+		}
+	}
+	if len(preds) < 2 {
+		return false
+	}
+	store := preds[0].insts[stores[0]]
+	for k, pred := range preds {
+		inst := pred.insts[stores[k]]
+		if inst.opcode != "STA" || inst.operand != store.operand || peephole.isPatched(pred, stores[k]) {
+			return false
+		}
+	}
+	for k, pred := range preds {
+		pred.removeInstruction(stores[k])
+	}
+	store.comment = ""
+	block.insts = append([]Instruction{store}, block.insts...)
+	return true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseBlocks reads assembly for testing a pass over blocks, where a label on
+// a line of its own is an empty block. Blocks holding only DAT are variables,
+// and c0 is the constant 0.
+func parseBlocks(text string) Assembly {
+	asm := InitAssembly()
+	var block *Block
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, isOpcode := opcodes[fields[0]]; !isOpcode || block == nil {
+			label := ""
+			if !isOpcode {
+				label = fields[0]
+				fields = fields[1:]
+			}
+			block = asm.newBlock(label)
+		}
+		if len(fields) > 0 {
+			block.emitInstruction(fields[0], strings.Join(fields[1:], ""))
+		}
+	}
+	for _, block := range asm.blocks {
+		data := len(block.insts) > 0
+		for _, inst := range block.insts {
+			if inst.opcode != "DAT" {
+				data = false
+			}
+		}
+		if block.label == "c0" {
+			block.kind = ConstantBlock
+			asm.constants[0] = block.label
+		} else if data {
+			block.kind = VariableBlock
+		}
+	}
+	return asm
+}
+
+// blockText writes the blocks one instruction to a line, with the label of
+// each block on its first line.
+func blockText(asm *Assembly) string {
+	lines := []string{}
+	for _, block := range asm.blocks {
+		if len(block.insts) == 0 {
+			lines = append(lines, block.label)
+		}
+		for i, inst := range block.insts {
+			label := ""
+			if i == 0 {
+				label = block.label
+			}
+			lines = append(lines, strings.Join(strings.Fields(label+" "+inst.opcode+" "+inst.operand), " "))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		inputs [][]int
+		want   [][]int
+	}{
+		{
+			// The empty if leaves a block that only branches back through
+			// the block before it, which must keep its branch.
+			"branch chain back to itself",
+			"a := in\nif a < 4 { out 1 } else if a < 9 { if a == 5 { } }\nout 2\n",
+			[][]int{{1}, {5}, {6}, {9}},
+			[][]int{{1, 2}, {2}, {2}, {2}},
+		},
+		{
+			"store then load",
+			"a := in\nb := a + 1\nout b\n",
+			[][]int{{4}},
+			[][]int{{5}},
+		},
+		{
+			"compare with zero",
+			"a := in\nif 0 < a { out 2 } else { out 1 }\n",
+			[][]int{{0}, {3}},
+			[][]int{{1}, {2}},
+		},
+		{
+			"equal and not equal",
+			"a := in\nif a == 0 { out 1 } else { out 2 }\nif a != 3 { out 3 } else { out 4 }\n",
+			[][]int{{0}, {3}, {999}},
+			[][]int{{1, 3}, {2, 4}, {2, 3}},
+		},
+		{
+			"common store",
+			"a := in\nb := 0\nif a > 3 { b = 7 } else { b = 9 }\nout b\n",
+			[][]int{{5}, {1}},
+			[][]int{{7}, {9}},
+		},
+		{
+			"branch to next in a loop",
+			"i := 0\nwhile i < 3 { if i > 0 and i < 2 { out 9 } out i  i = i + 1 }\n",
+			[][]int{{}},
+			[][]int{{0, 9, 1, 2}},
+		},
+		{
+			"branch to next on equal in a loop",
+			"i := 0\nwhile i < 3 { if i == 1 { out 9 } out i  i = i + 1 }\n",
+			[][]int{{}},
+			[][]int{{0, 9, 1, 2}},
+		},
+	}
+	for _, test := range tests {
+		for _, peephole := range []bool{false, true} {
+			for i, input := range test.inputs {
+				got := compileAndRun(t, test.source, Options{peephole: peephole, layout: true, share: true}, input)
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("%s with peephole %t on %v: got %v, want %v", test.name, peephole, input, got, test.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestPeepholeRules(t *testing.T) {
+	tests := []struct {
+		rule string
+		text string
+		want string
+	}{
+		{"store then load", "STA x\nLDA x\nHLT\nx DAT\n", "STA x\nHLT\nx DAT\n"},
+		{"store then load", "STA x\nLDA y\nHLT\nx DAT\ny DAT\n", "STA x\nLDA y\nHLT\nx DAT\ny DAT\n"},
+		{"load then store", "LDA x\nSTA x\nOUT\nHLT\nx DAT\n", "LDA x\nOUT\nHLT\nx DAT\n"},
+		{"load then load", "LDA x\nLDA y\nOUT\nHLT\nx DAT\ny DAT\n", "LDA y\nOUT\nHLT\nx DAT\ny DAT\n"},
+		{
+			"load then load",
+			"BRA s\ns LDA x\nLDA y\nOUT\nHLT\nSTA s\nx DAT\ny DAT\n",
+			"BRA s\ns LDA x\nLDA y\nOUT\nHLT\nSTA s\nx DAT\ny DAT\n",
+		},
+		{
+			"compare with zero",
+			"LDA c0\nSUB x\nBRP a\nBRA b\na OUT\nb HLT\nc0 DAT\nx DAT\n",
+			"LDA x\nBRZ a\nBRA b\na OUT\nb HLT\nc0 DAT\nx DAT\n",
+		},
+		{"code after jump", "BRA a\nOUT\na HLT\nOUT\n", "BRA a\na HLT\n"},
+		{"branch to branch", "BRZ a\nHLT\na BRA b\nb OUT\nHLT\n", "BRZ b\nHLT\na BRA b\nb OUT\nHLT\n"},
+		{"branch to branch", "BRZ a\nHLT\na\nb BRA c\nc HLT\n", "BRZ c\nHLT\na\nb BRA c\nc HLT\n"},
+		{
+			// The chain from x leads back to x, which must keep its branch.
+			"branch to branch",
+			"x BRZ a\nHLT\na BRA x\n",
+			"x BRZ a\nHLT\na BRA x\n",
+		},
+		{"branch twice", "BRZ a\nBRA a\na HLT\n", "BRA a\na HLT\n"},
+		{"branch twice", "BRZ a\nBRA b\na HLT\nb HLT\n", "BRZ a\nBRA b\na HLT\nb HLT\n"},
+		{"branch to next", "OUT\nBRA a\na HLT\n", "OUT\na HLT\n"},
+		{"branch to next", "OUT\nBRP b\na HLT\nb OUT\nHLT\n", "OUT\nBRP b\na HLT\nb OUT\nHLT\n"},
+		{
+			// Resolving a chain that leads back to x must stop.
+			"branch to next",
+			"x OUT\nBRA a\na BRA x\n",
+			"x OUT\na BRA x\n",
+		},
+		{
+			"common store",
+			"LDA x\nBRZ q\nSTA y\nBRA l\nq LDA x\nSTA y\nl LDA y\nOUT\nHLT\nx DAT\ny DAT\n",
+			"LDA x\nBRZ q\nBRA l\nq LDA x\nl STA y\nLDA y\nOUT\nHLT\nx DAT\ny DAT\n",
+		},
+		{
+			"common store",
+			"LDA x\nBRZ q\nSTA y\nBRA l\nq LDA x\nSTA x\nl LDA y\nOUT\nHLT\nx DAT\ny DAT\n",
+			"LDA x\nBRZ q\nSTA y\nBRA l\nq LDA x\nSTA x\nl LDA y\nOUT\nHLT\nx DAT\ny DAT\n",
+		},
+	}
+	for _, test := range tests {
+		var rule PeepholeRule
+		for _, r := range peepholeRules {
+			if r.name == test.rule {
+				rule = r
+			}
+		}
+		asm := parseBlocks(test.text)
+		for changed := true; changed; {
+			changed = false
+			peephole := asm.initPeephole()
+			for _, block := range asm.blocks {
+				for i := 0; i < len(block.insts); i++ {
+					if rule.apply(&peephole, block, i) {
+						changed = true
+					}
+				}
+			}
+		}
+		if got := blockText(&asm); got != test.want {
+			t.Errorf("%s on %q: got %q, want %q", test.rule, test.text, got, test.want)
+		}
+	}
+}
+
+func TestRemoveEmptyBlocks(t *testing.T) {
+	asm := parseBlocks("BRZ a\nBRA b\na\nb\nc OUT\nHLT\n")
+	if !asm.removeEmptyBlocks() {
+		t.Error("removed nothing")
+	}
+	if got, want := blockText(&asm), "BRZ c\nBRA c\nc OUT\nHLT\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if asm.removeEmptyBlocks() {
+		t.Error("removed blocks a second time")
+	}
+}
+
+func TestRemoveInstructionKeepsComments(t *testing.T) {
+	tests := []struct {
+		remove int
+		want   []string
+	}{
+		{0, []string{"a; b", "", "c"}},
+		{1, []string{"a", "b", "c"}},
+		{3, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		block := Block{"", CodeBlock, []Instruction{{"LDA", "x", "a"}, {"STA", "y", "b"}, {"LDA", "y", ""}, {"OUT", "", "c"}}}
+		block.removeInstruction(test.remove)
+		comments := []string{}
+		for _, inst := range block.insts {
+			comments = append(comments, inst.comment)
+		}
+		if !reflect.DeepEqual(comments[:len(test.want)], test.want) {
+			t.Errorf("removing %d: got comments %q, want %q", test.remove, comments, test.want)
+		}
+	}
+}
+
+func TestPeepholeKeepsComments(t *testing.T) {
+	source := "x := in\n// first\nout x\n// second\nx = 6\n// third\nout x\ni := 0\n// fourth\nwhile i < 2 {\n    // fifth\n    i = i + 1\n}\n// sixth\nif x > 3 {\n    out 1\n} else {\n    // seventh\n    out 2\n}\n"
+	statements, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+	for _, options := range []Options{
+		{comments: true},
+		{comments: true, peephole: true},
+		{comments: true, peephole: true, layout: true, share: true},
+	} {
+		asm, errors := Compile(Fold(statements, false), options)
+		if len(errors) > 0 {
+			t.Fatal(errors[0])
+		}
+		builder := strings.Builder{}
+		asm.assemble(&builder)
+		text := builder.String()
+		last := 0
+		for _, comment := range []string{"first", "second", "third", "fourth", "fifth", "sixth", "seventh"} {
+			index := strings.Index(text[last:], comment)
+			if index < 0 {
+				t.Errorf("%+v: comment %q is missing or out of order in\n%s", options, comment, text)
+				break
+			}
+			last += index
+		}
+	}
+}
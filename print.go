@@ -29,6 +29,12 @@ func (ident Ident) prettyPrint(builder *strings.Builder) {
 	fmt.Fprintf(builder, "%s", ident.name)
 }
 
+func (index Index) prettyPrint(builder *strings.Builder) {
+	fmt.Fprintf(builder, "%s[", index.name)
+	index.index.prettyPrint(builder)
+	fmt.Fprint(builder, "]")
+}
+
 func (bin Binary) prettyPrint(builder *strings.Builder) {
 	fmt.Fprint(builder, "(")
 	bin.left.prettyPrint(builder)
@@ -51,6 +57,10 @@ func (stmt Statement) prettyPrint(builder *strings.Builder, indent string) {
 }
 
 func (decl Declare) prettyPrint(builder *strings.Builder, indent string) {
+	if decl.size > 0 {
+		fmt.Fprintf(builder, "%s : [%s; %d]", decl.name, decl.ty, decl.size)
+		return
+	}
 	fmt.Fprintf(builder, "%s :", decl.name)
 	if decl.ty != Undefined {
 		fmt.Fprintf(builder, " %s ", decl.ty)
@@ -66,6 +76,13 @@ func (assign Assign) prettyPrint(builder *strings.Builder, indent string) {
 	assign.expr.prettyPrint(builder)
 }
 
+func (assign AssignIndex) prettyPrint(builder *strings.Builder, indent string) {
+	fmt.Fprintf(builder, "%s[", assign.name)
+	assign.index.prettyPrint(builder)
+	fmt.Fprint(builder, "] = ")
+	assign.expr.prettyPrint(builder)
+}
+
 func (stmt If) prettyPrint(builder *strings.Builder, indent string) {
 	fmt.Fprint(builder, "if ")
 	stmt.cond.prettyPrint(builder)
@@ -78,7 +95,7 @@ func (stmt If) prettyPrint(builder *strings.Builder, indent string) {
 }
 
 func (stmt While) prettyPrint(builder *strings.Builder, indent string) {
-	fmt.Fprint(builder, "if ")
+	fmt.Fprint(builder, "while ")
 	stmt.cond.prettyPrint(builder)
 	fmt.Fprint(builder, "\n")
 	stmt.loop.prettyPrint(builder, indent)
@@ -96,3 +113,42 @@ func (output Output) prettyPrint(builder *strings.Builder, indent string) {
 	fmt.Fprint(builder, "out ")
 	output.expr.prettyPrint(builder)
 }
+
+func (call Call) prettyPrint(builder *strings.Builder) {
+	fmt.Fprintf(builder, "%s(", call.name)
+	for i, arg := range call.args {
+		if i > 0 {
+			fmt.Fprint(builder, ", ")
+		}
+		arg.prettyPrint(builder)
+	}
+	fmt.Fprint(builder, ")")
+}
+
+func (function Function) prettyPrint(builder *strings.Builder, indent string) {
+	fmt.Fprintf(builder, "func %s(", function.name)
+	for i, param := range function.params {
+		if i > 0 {
+			fmt.Fprint(builder, ", ")
+		}
+		fmt.Fprintf(builder, "%s: %s", param.name, param.ty)
+	}
+	fmt.Fprint(builder, ")")
+	if function.ret != Undefined {
+		fmt.Fprintf(builder, " %s", function.ret)
+	}
+	fmt.Fprint(builder, "\n")
+	function.body.prettyPrint(builder, indent)
+}
+
+func (stmt CallStatement) prettyPrint(builder *strings.Builder, indent string) {
+	stmt.call.prettyPrint(builder)
+}
+
+func (ret Return) prettyPrint(builder *strings.Builder, indent string) {
+	fmt.Fprint(builder, "return")
+	if ret.expr.node != nil {
+		fmt.Fprint(builder, " ")
+		ret.expr.prettyPrint(builder)
+	}
+}
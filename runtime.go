@@ -0,0 +1,204 @@
+package main
+
+// Routine is a subroutine shared by every call site. Callers store the
+// arguments in the routine's mailboxes, then overwrite the exit mailbox with
+// a branch back to themselves before jumping to the entry, since the LMC has
+// no way to jump to an address held in memory.
+type Routine struct {
+	entry  string
+	exit   string
+	args   []string
+	emit   func(*Assembly, *Routine)
+	locals []string
+}
+
+var routines = map[string]func(*Assembly, *Routine){
+	"mul":  emitMultiply,
+	"div":  emitDivide,
+	"smul": emitSignedMultiply,
+	"sdiv": emitSignedDivide,
+}
+
+// useRoutine reserves the labels for a runtime routine the first time it is
+// needed. The code itself is only emitted by emitRuntime once compilation is
+// finished, so a routine is included once and only when it is used.
+func (asm *Assembly) useRoutine(name string, args, locals int) *Routine {
+	if routine, prs := asm.runtime[name]; prs {
+		return routine
+	}
+	routine := &Routine{
+		entry: asm.uniqueLabel(name),
+		exit:  asm.uniqueLabel(name + "_exit"),
+		emit:  routines[name],
+	}
+	for i := 0; i < args; i++ {
+		routine.args = append(routine.args, asm.uniqueLabel(name+"_"+string(rune('a'+i))))
+	}
+	for i := 0; i < locals; i++ {
+		routine.locals = append(routine.locals, asm.uniqueLabel(name+"_"+string(rune('r'+i))))
+	}
+	asm.runtime[name] = routine
+	asm.routineOrder = append(asm.routineOrder, name)
+	return routine
+}
+
+// emitCall jumps to entry after patching exit to return to a new block, which
+// becomes the current block.
+func (asm *Assembly) emitCall(block **Block, entry, exit string) {
+	returnBlock := asm.newUniqueBlock()
+	(*block).emitInstruction("LDA", asm.getInstructionConstant("BRA", returnBlock.label))
+	(*block).emitInstruction("STA", exit)
+	(*block).emitInstruction("BRA", entry)
+	*block = returnBlock
+}
+
+func (asm *Assembly) emitRuntime() {
+	for _, name := range asm.routineOrder {
+		routine := asm.runtime[name]
+		for _, label := range append(routine.args, routine.locals...) {
+			asm.createVariable(label, 0, VariableBlock)
+		}
+		routine.emit(asm, routine)
+	}
+}
+
+// emitMultiply computes a * b by adding a to the result b times.
+func emitMultiply(asm *Assembly, routine *Routine) {
+	emitMultiplyFrom(asm, routine, asm.newBlock(routine.entry))
+}
+
+// emitSignedMultiply multiplies two ten's complement integers, negating both
+// first when b is negative so that the loop runs |b| times.
+func emitSignedMultiply(asm *Assembly, routine *Routine) {
+	a, b := routine.args[0], routine.args[1]
+	entry := asm.newBlock(routine.entry)
+	negate := asm.newUniqueBlock()
+	start := asm.newUniqueBlock()
+
+	entry.emitInstruction("LDA", b)
+	entry.emitInstruction("SUB", asm.getConstant(SignedOffset))
+	entry.emitInstruction("BRP", negate.label)
+	entry.emitInstruction("BRA", start.label)
+
+	emitNegate(asm, negate, a)
+	emitNegate(asm, negate, b)
+	emitMultiplyFrom(asm, routine, start)
+}
+
+// emitNegate replaces the ten's complement integer at label with its negation.
+func emitNegate(asm *Assembly, block *Block, label string) {
+	block.emitInstruction("LDA", asm.getConstant(0))
+	block.emitInstruction("SUB", label)
+	block.emitInstruction("STA", label)
+}
+
+// emitMultiplyFrom emits the loop that multiplies, starting in entry.
+func emitMultiplyFrom(asm *Assembly, routine *Routine, entry *Block) {
+	a, b, result := routine.args[0], routine.args[1], routine.locals[0]
+	loop := asm.newUniqueBlock()
+	done := asm.newUniqueBlock()
+	exit := asm.newBlock(routine.exit)
+
+	entry.emitInstruction("LDA", asm.getConstant(0))
+	entry.emitInstruction("STA", result)
+	entry.emitInstruction("BRA", loop.label)
+
+	loop.emitInstruction("LDA", b)
+	loop.emitInstruction("BRZ", done.label)
+	loop.emitInstruction("SUB", asm.getConstant(1))
+	loop.emitInstruction("STA", b)
+	loop.emitInstruction("LDA", result)
+	loop.emitInstruction("ADD", a)
+	loop.emitInstruction("STA", result)
+	loop.emitInstruction("BRA", loop.label)
+
+	done.emitInstruction("LDA", result)
+	exit.emitInstruction("HLT", "")
+}
+
+// emitDivide leaves a / b in the accumulator and a % b in the first argument
+// by repeatedly subtracting b from a. Dividing by zero gives a quotient of 0
+// and leaves a as the remainder.
+func emitDivide(asm *Assembly, routine *Routine) {
+	done := emitDivideFrom(asm, routine, asm.newBlock(routine.entry))
+	done.emitInstruction("LDA", routine.locals[0])
+	asm.newBlock(routine.exit).emitInstruction("HLT", "")
+}
+
+// emitSignedDivide divides two ten's complement integers by dividing their
+// magnitudes. The quotient is negated when exactly one of them is negative
+// and the remainder when a is, so the quotient is truncated towards zero.
+func emitSignedDivide(asm *Assembly, routine *Routine) {
+	a, b := routine.args[0], routine.args[1]
+	quotient, negQuotient, negRemainder := routine.locals[0], routine.locals[1], routine.locals[2]
+	entry := asm.newBlock(routine.entry)
+	negateA := asm.newUniqueBlock()
+	checkB := asm.newUniqueBlock()
+	negateB := asm.newUniqueBlock()
+	start := asm.newUniqueBlock()
+
+	entry.emitInstruction("LDA", asm.getConstant(0))
+	entry.emitInstruction("STA", negQuotient)
+	entry.emitInstruction("STA", negRemainder)
+	entry.emitInstruction("LDA", a)
+	entry.emitInstruction("SUB", asm.getConstant(SignedOffset))
+	entry.emitInstruction("BRP", negateA.label)
+	entry.emitInstruction("BRA", checkB.label)
+
+	emitNegate(asm, negateA, a)
+	negateA.emitInstruction("LDA", asm.getConstant(1))
+	negateA.emitInstruction("STA", negQuotient)
+	negateA.emitInstruction("STA", negRemainder)
+
+	checkB.emitInstruction("LDA", b)
+	checkB.emitInstruction("SUB", asm.getConstant(SignedOffset))
+	checkB.emitInstruction("BRP", negateB.label)
+	checkB.emitInstruction("BRA", start.label)
+
+	emitNegate(asm, negateB, b)
+	negateB.emitInstruction("LDA", asm.getConstant(1))
+	negateB.emitInstruction("SUB", negQuotient)
+	negateB.emitInstruction("STA", negQuotient)
+
+	done := emitDivideFrom(asm, routine, start)
+	fixQuotient := asm.newUniqueBlock()
+	result := asm.newUniqueBlock()
+	done.emitInstruction("LDA", negRemainder)
+	done.emitInstruction("BRZ", fixQuotient.label)
+	emitNegate(asm, done, a)
+	fixQuotient.emitInstruction("LDA", negQuotient)
+	fixQuotient.emitInstruction("BRZ", result.label)
+	emitNegate(asm, fixQuotient, quotient)
+	result.emitInstruction("LDA", quotient)
+	asm.newBlock(routine.exit).emitInstruction("HLT", "")
+}
+
+// emitDivideFrom emits the loop that divides, starting in entry, and returns
+// the empty block it finishes in. The constants are looked up before any
+// block is created, since a new constant's block would otherwise sit between
+// the returned block and the one the caller goes on to create after it.
+func emitDivideFrom(asm *Assembly, routine *Routine, entry *Block) *Block {
+	a, b, quotient := routine.args[0], routine.args[1], routine.locals[0]
+	zero, one := asm.getConstant(0), asm.getConstant(1)
+	loop := asm.newUniqueBlock()
+	step := asm.newUniqueBlock()
+	done := asm.newUniqueBlock()
+
+	entry.emitInstruction("LDA", zero)
+	entry.emitInstruction("STA", quotient)
+	entry.emitInstruction("LDA", b)
+	entry.emitInstruction("BRZ", done.label)
+	entry.emitInstruction("BRA", loop.label)
+
+	loop.emitInstruction("LDA", a)
+	loop.emitInstruction("SUB", b)
+	loop.emitInstruction("BRP", step.label)
+	loop.emitInstruction("BRA", done.label)
+
+	step.emitInstruction("STA", a)
+	step.emitInstruction("LDA", quotient)
+	step.emitInstruction("ADD", one)
+	step.emitInstruction("STA", quotient)
+	step.emitInstruction("BRA", loop.label)
+	return done
+}
@@ -4,6 +4,20 @@ type Scope struct {
 	hashmap      map[string]*Variable
 	lastDecl     *Variable
 	currentDepth int
+	functions    map[string]*Signature
+	function     *Signature
+	signed       bool
+	references   []Reference
+}
+
+type Signature struct {
+	span   Span
+	name   Span
+	params []Type
+	labels []string
+	ret    Type
+	entry  string
+	exit   string
 }
 
 type Variable struct {
@@ -13,23 +27,30 @@ type Variable struct {
 	prevName *Variable
 	prevDecl *Variable
 	depth    int
+	size     int
+	span     Span
+}
+
+// Reference is a variable or function named in the source, including where it
+// is declared, which the language server uses to find what is under the
+// cursor.
+type Reference struct {
+	span     Span
+	variable *Variable
+	function *Signature
 }
 
 func InitScope() Scope {
-	return Scope{hashmap: make(map[string]*Variable)}
+	return Scope{hashmap: make(map[string]*Variable), functions: make(map[string]*Signature)}
 }
 
-func (scope *Scope) declare(name string, kind Type) string {
-	prev, prs := scope.hashmap[name]
-	variable := Variable{}
-	if prs {
-		variable = Variable{name, prev.label + "_", kind, prev, scope.lastDecl, scope.currentDepth}
-	} else {
-		variable = Variable{name, name, kind, nil, scope.lastDecl, scope.currentDepth}
-	}
+// declare adds a variable whose name is at span.
+func (scope *Scope) declare(name string, label string, kind Type, size int, span Span) {
+	prev := scope.hashmap[name]
+	variable := Variable{name, label, kind, prev, scope.lastDecl, scope.currentDepth, size, span}
 	scope.hashmap[name] = &variable
 	scope.lastDecl = &variable
-	return variable.label
+	scope.references = append(scope.references, Reference{span, &variable, nil})
 }
 
 func (scope *Scope) get(name string) (string, Type, bool) {
@@ -40,6 +61,15 @@ func (scope *Scope) get(name string) (string, Type, bool) {
 	return "", 0, false
 }
 
+// use looks up a variable named at span, recording the reference.
+func (scope *Scope) use(name string, span Span) (*Variable, bool) {
+	variable, prs := scope.hashmap[name]
+	if prs {
+		scope.references = append(scope.references, Reference{span, variable, nil})
+	}
+	return variable, prs
+}
+
 func (scope *Scope) pushScope() {
 	scope.currentDepth++
 }
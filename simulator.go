@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Machine struct {
+	memory   [MailboxCount]int
+	acc      int
+	pc       int
+	negative bool
+	halted   bool
+	steps    int
+	input    []int
+	output   []int
+}
+
+// errNoInput and errNotHalted end a run of the simulator or interpreter
+// early, and are told apart from other errors when comparing the two.
+var (
+	errNoInput   = errors.New("no input is left")
+	errNotHalted = errors.New("program did not halt")
+)
+
+// assembleText converts mnemonic assembly into the contents of the
+// mailboxes, resolving labels to their addresses.
+func assembleText(text string) ([MailboxCount]int, error) {
+	asm, err := parseAssembly(text)
+	if err != nil {
+		return [MailboxCount]int{}, err
+	}
+	image, errors := asm.link()
+	if len(errors) > 0 {
+		return image.memory, errors[0]
+	}
+	return image.memory, nil
+}
+
+func InitMachine(memory [MailboxCount]int, input []int) Machine {
+	return Machine{memory: memory, input: input}
+}
+
+// step executes a single instruction. ADD and SUB wrap around modulo 1000,
+// with SUB setting the negative flag that BRP tests when it underflows.
+func (machine *Machine) step() error {
+	if machine.pc < 0 || machine.pc >= MailboxCount {
+		return fmt.Errorf("program counter %d out of range", machine.pc)
+	}
+	inst := machine.memory[machine.pc]
+	opcode, address := inst/100, inst%100
+	machine.pc++
+	machine.steps++
+
+	switch opcode {
+	case 0:
+		machine.halted = true
+	case 1:
+		machine.acc = (machine.acc + machine.memory[address]) % 1000
+		machine.negative = false
+	case 2:
+		machine.acc -= machine.memory[address]
+		machine.negative = machine.acc < 0
+		if machine.negative {
+			machine.acc += 1000
+		}
+	case 3:
+		machine.memory[address] = machine.acc
+	case 5:
+		machine.acc = machine.memory[address]
+		machine.negative = false
+	case 6:
+		machine.pc = address
+	case 7:
+		if machine.acc == 0 {
+			machine.pc = address
+		}
+	case 8:
+		if !machine.negative {
+			machine.pc = address
+		}
+	case 9:
+		switch address {
+		case 1:
+			if len(machine.input) == 0 {
+				return fmt.Errorf("input requested at mailbox %d but %w", machine.pc-1, errNoInput)
+			}
+			machine.acc = machine.input[0]
+			machine.negative = false
+			machine.input = machine.input[1:]
+		case 2:
+			machine.output = append(machine.output, machine.acc)
+		default:
+			return fmt.Errorf("invalid instruction %03d at mailbox %d", inst, machine.pc-1)
+		}
+	default:
+		return fmt.Errorf("invalid instruction %03d at mailbox %d", inst, machine.pc-1)
+	}
+	return nil
+}
+
+func (machine *Machine) run(maxSteps int) error {
+	for !machine.halted {
+		if machine.steps >= maxSteps {
+			return fmt.Errorf("%w within %d steps", errNotHalted, maxSteps)
+		}
+		if err := machine.step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trap returns the label of the trap a machine halted in, which has output a
+// marker followed by an index or code, or "" if it halted anywhere else.
+func (machine *Machine) trap(asm *Assembly, image Image) string {
+	if !machine.halted || len(machine.output) < 2 {
+		return ""
+	}
+	for _, block := range asm.blocks {
+		for _, label := range trapLabels {
+			if block.label == label && machine.pc-1 == image.labels[label]+len(block.insts)-1 {
+				return label
+			}
+		}
+	}
+	return ""
+}
+
+func parseInputs(list string, signed bool) ([]int, error) {
+	inputs := []int{}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input '%s'", field)
+		}
+		if signed {
+			if value < -SignedOffset || value >= SignedOffset {
+				return nil, fmt.Errorf("input %d is outside the range -500 to 499", value)
+			}
+			value = (value + 1000) % 1000
+		} else if value < 0 || value > 999 {
+			return nil, fmt.Errorf("input %d is outside the range 0 to 999", value)
+		}
+		inputs = append(inputs, value)
+	}
+	return inputs, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMachine(t *testing.T) {
+	tests := []struct {
+		name   string
+		memory []int
+		input  []int
+		output []int
+		err    error
+	}{
+		{
+			"add wraps around",
+			[]int{901, 105, 902, 0, 0, 3},
+			[]int{998},
+			[]int{1},
+			nil,
+		},
+		{
+			"sub wraps around",
+			[]int{901, 205, 902, 0, 0, 3},
+			[]int{1},
+			[]int{998},
+			nil,
+		},
+		{
+			"brp taken without underflow",
+			[]int{901, 208, 805, 508, 902, 0, 0, 0, 3},
+			[]int{3},
+			[]int{},
+			nil,
+		},
+		{
+			"brp not taken after underflow",
+			[]int{901, 208, 806, 508, 902, 0, 0, 0, 3},
+			[]int{2},
+			[]int{3},
+			nil,
+		},
+		{
+			"lda clears the negative flag",
+			[]int{901, 209, 509, 806, 902, 0, 0, 0, 0, 3},
+			[]int{2},
+			[]int{},
+			nil,
+		},
+		{
+			"add clears the negative flag",
+			[]int{901, 209, 109, 806, 902, 0, 0, 0, 0, 3},
+			[]int{2},
+			[]int{},
+			nil,
+		},
+		{
+			"brz",
+			[]int{901, 704, 902, 0, 510, 902, 0, 0, 0, 0, 7},
+			[]int{0},
+			[]int{7},
+			nil,
+		},
+		{
+			"no input left",
+			[]int{901, 901, 0},
+			[]int{1},
+			[]int{},
+			errNoInput,
+		},
+		{
+			"not halted",
+			[]int{600},
+			[]int{},
+			[]int{},
+			errNotHalted,
+		},
+	}
+	for _, test := range tests {
+		memory := [MailboxCount]int{}
+		copy(memory[:], test.memory)
+		machine := InitMachine(memory, test.input)
+		err := machine.run(1000)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		output := append([]int{}, machine.output...)
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%s: got %v, want %v", test.name, output, test.output)
+		}
+	}
+}
+
+func TestMachineInvalidInstruction(t *testing.T) {
+	memory := [MailboxCount]int{400}
+	machine := InitMachine(memory, nil)
+	if err := machine.run(1000); err == nil {
+		t.Error("got no error for instruction 400")
+	}
+}
+
+func TestParseInputs(t *testing.T) {
+	tests := []struct {
+		list   string
+		signed bool
+		want   []int
+		err    bool
+	}{
+		{"5, 3,,7", false, []int{5, 3, 7}, false},
+		{"", false, []int{}, false},
+		{"999", false, []int{999}, false},
+		{"1000", false, nil, true},
+		{"-1", false, nil, true},
+		{"-1,-500,499", true, []int{999, 500, 499}, false},
+		{"500", true, nil, true},
+		{"x", false, nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseInputs(test.list, test.signed)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.list, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.list, got, test.want)
+		}
+	}
+}
+
+func TestMachineTrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		options Options
+		input   []int
+		trap    string
+		output  []int
+	}{
+		{"overflow", "a := in\nout 998\nout a - 1\n", Options{checkOverflow: true}, []int{0}, "overflow", []int{998, 998, 1}},
+		{"no overflow", "a := in\nout 998\nout a - 1\n", Options{checkOverflow: true}, []int{3}, "", []int{998, 2}},
+		{"signed output of -2", "a := in\nout 0 - 2\nout a - 1\n", Options{checkOverflow: true, signed: true}, []int{0}, "", []int{998, 999}},
+		{"signed overflow", "a := in\nout 0 - 2\nout a - 1\n", Options{checkOverflow: true, signed: true}, []int{500}, "overflow", []int{998, 998, 1}},
+		{"index out of range", "xs: [int; 2]\nout 999\nout xs[in]\n", Options{boundsCheck: true}, []int{4}, "bounds", []int{999, 999, 4}},
+		{"index in range", "xs: [int; 2]\nout 999\nout xs[in]\n", Options{boundsCheck: true}, []int{1}, "", []int{999, 0}},
+	}
+	for _, test := range tests {
+		statements, diagnostics := Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Fatalf("%s: %s", test.name, diagnostics[0])
+		}
+		test.options.peephole, test.options.layout, test.options.share = true, true, true
+		asm, errors := Compile(Fold(statements, test.options.signed), test.options)
+		if len(errors) > 0 {
+			t.Fatalf("%s: %s", test.name, errors[0])
+		}
+		image, errors := asm.link()
+		if len(errors) > 0 {
+			t.Fatalf("%s: %s", test.name, errors[0])
+		}
+		machine := InitMachine(image.memory, test.input)
+		if err := machine.run(1000); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if trap := machine.trap(&asm, image); trap != test.trap {
+			t.Errorf("%s: got trap %q, want %q", test.name, trap, test.trap)
+		}
+		if !reflect.DeepEqual(machine.output, test.output) {
+			t.Errorf("%s: got %v, want %v", test.name, machine.output, test.output)
+		}
+	}
+}